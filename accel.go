@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Internal nginx location mapped onto StorageDir, e.g. "/protected/" for
+//
+//	location /protected/ { internal; alias /path/to/storage/; }
+//
+// When set, allowed GET/HEAD decisions carry X-Accel-Redirect, so nginx can
+// serve the bytes itself.
+var AccelRedirectPrefix = "" // override with ACCEL_REDIRECT_PREFIX
+
+// Internal location of a storage-relative path, percent-encoded for nginx
+func accelRedirectURI(relPath string) string {
+	u := url.URL{Path: strings.TrimSuffix(AccelRedirectPrefix, "/") + "/" + strings.TrimPrefix(relPath, "/")}
+	return u.EscapedPath()
+}
+
+// GET /auth with X-Original-URI (and X-Original-Method) set by nginx: the
+// auth_request decision alone, as a status with no body. Allowed requests
+// get 200, a missing or invalid token 401/403. Every other refusal
+// (read-only mode, bad paths, ...) also answers 403, since auth_request
+// treats any other status as a server error.
+func authDecisionHandler(check http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Original-URI") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		check.ServeHTTP(&decisionWriter{ResponseWriter: w}, r)
+	}
+}
+
+// auth_request only understands 2xx, 401 and 403 and fails the client's
+// request with 500 on anything else, so other refusals become 403
+func authRequestStatus(status int) int {
+	if status >= 300 && status != http.StatusUnauthorized && status != http.StatusForbidden {
+		return http.StatusForbidden
+	}
+	return status
+}
+
+// Answers an auth_request subrequest to the middleware with a status
+// auth_request understands, keeping the body
+type subrequestWriter struct {
+	http.ResponseWriter
+}
+
+func (w *subrequestWriter) WriteHeader(status int) {
+	w.ResponseWriter.WriteHeader(authRequestStatus(status))
+}
+
+func (w *subrequestWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Keeps the status and headers of a response but drops its body
+type decisionWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (d *decisionWriter) WriteHeader(status int) {
+	if d.wrote {
+		return
+	}
+	d.wrote = true
+	d.Header().Del("Content-Type")
+	d.ResponseWriter.WriteHeader(authRequestStatus(status))
+}
+
+func (d *decisionWriter) Write(p []byte) (int, error) {
+	d.WriteHeader(http.StatusOK)
+	return len(p), nil
+}
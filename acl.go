@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	aclPrivate    = "private"
+	aclPublicRead = "public-read"
+)
+
+// PUT /{token}/path?acl=public-read lets anyone GET/HEAD that one object at
+// /path without a token; ?acl=private (the default) revokes it. The ACL is
+// kept in the object's metadata, so it survives overwrites and moves.
+func aclHandler(w http.ResponseWriter, r *http.Request) {
+	acl := r.URL.Query().Get("acl")
+	if acl != aclPrivate && acl != aclPublicRead {
+		httpError(w, r, "acl must be private or public-read", http.StatusBadRequest)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) < 2 {
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	relPath := parts[1]
+	target, err := resolvePath(relPath)
+	if err != nil || target == filepath.Clean(StorageDir) {
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	// Making an object public hands out a tokenless read of it, so the token
+	// needs read as well as the write access the path grant gives PUT
+	if re := tokenRegex(r); re == nil || !pathAllowed(re, relPath) {
+		writePathForbidden(w, r)
+		return
+	}
+	if !checkReadClaims(w, r, target, false) {
+		return
+	}
+
+	unlock, err := lockPathsFor(r, target)
+	if err != nil {
+		writeWriteInProgress(w, r)
+		return
+	}
+	defer unlock()
+	info, err := os.Stat(target)
+	if err != nil {
+		httpError(w, r, "Not found", http.StatusNotFound)
+		return
+	}
+	if info.IsDir() {
+		httpError(w, r, "ACLs can only be set on files", http.StatusBadRequest)
+		return
+	}
+	err = updateMeta(target, func(m *objectMeta) {
+		m.Path = storageRel(target)
+		m.ACL = acl
+		if acl == aclPrivate {
+			m.ACL = ""
+		}
+	})
+	if err != nil {
+		writeStorageError(w, r, "Failed to write metadata", err)
+		return
+	}
+
+	debugf("acl %s %s\n", acl, relPath)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"success": true, "path": relPath, "acl": acl})
+}
+
+// Stored ACL of an object, private when it has none
+func (m *objectMeta) acl() string {
+	if m.ACL == "" {
+		return aclPrivate
+	}
+	return m.ACL
+}
+
+// Whether a tokenless GET may read this one object
+func objectPublicRead(target string) bool {
+	if info, err := os.Stat(target); err != nil || info.IsDir() {
+		return false
+	}
+	meta, err := readMeta(target)
+	return err == nil && meta.ACL == aclPublicRead
+}
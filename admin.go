@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+var AdminSecret = "" // override with ADMIN_SECRET, enables /admin/* (Authorization: Bearer <secret>)
+
+// While draining, /readyz reports 503 so load balancers stop routing new
+// traffic here; requests that still arrive are served normally.
+var draining atomic.Bool
+
+// Only let requests bearing the admin secret through
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(AdminSecret)) != 1 {
+			debugf("[admin] unauthorized %s %s from %s\n", r.Method, r.URL.Path, clientIP(r))
+			writeError(w, r, http.StatusUnauthorized, errorEnvelope{Code: "unauthorized", Error: "Admin secret required"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// POST /admin/drain and /admin/undrain
+func drainHandler(drain bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if draining.Swap(drain) != drain {
+			state := "disabled"
+			if drain {
+				state = "enabled"
+			}
+			fmt.Printf("[admin] drain mode %s by %s\n", state, clientIP(r))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"success": true, "draining": drain})
+	}
+}
+
+// Readiness probe, distinct from the /healthz liveness probe
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() {
+		writeError(w, r, http.StatusServiceUnavailable, errorEnvelope{Code: "draining", Error: "Server is draining"})
+		return
+	}
+	if storageUnwritable.Load() && !probeWritable() {
+		writeError(w, r, http.StatusServiceUnavailable, errorEnvelope{Code: "storage_unwritable", Error: "Storage is not writable"})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"ready": true})
+}
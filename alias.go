@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A MOVE sent with X-Keep-Alias: true leaves the old path redirecting (301)
+// to the new one for AliasTTL, so shared download links survive a
+// reorganisation. Aliases are persisted to AliasFile. An object stored at
+// the old path again takes precedence over its alias.
+var (
+	AliasTTL  = 7 * 24 * time.Hour // override with ALIAS_TTL
+	AliasFile = ".aliases.json"    // override with ALIAS_FILE
+)
+
+type pathAlias struct {
+	To      string    `json:"to"`
+	Expires time.Time `json:"expires"`
+}
+
+var (
+	aliasMu sync.Mutex
+	aliases = map[string]*pathAlias{} // by old storage-relative path
+)
+
+// Load persisted aliases, dropping expired ones
+func loadAliases() {
+	data, err := os.ReadFile(AliasFile)
+	if err != nil {
+		return
+	}
+	loaded := map[string]*pathAlias{}
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		fmt.Printf("warning: ignoring unreadable %s: %v\n", AliasFile, err)
+		return
+	}
+	now := now()
+	for from, a := range loaded {
+		if a.Expires.After(now) {
+			aliases[from] = a
+		}
+	}
+}
+
+// Persist aliases atomically; caller holds aliasMu
+func saveAliases() {
+	now := now()
+	for from, a := range aliases {
+		if !a.Expires.After(now) {
+			delete(aliases, from)
+		}
+	}
+	data, err := json.Marshal(aliases)
+	if err != nil {
+		return
+	}
+	tmp := filepath.Join(filepath.Dir(AliasFile), "."+filepath.Base(AliasFile)+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		fmt.Printf("warning: failed to persist aliases: %v\n", err)
+		return
+	}
+	os.Rename(tmp, AliasFile)
+}
+
+// Record a move from -> to. Aliases already pointing at from follow the
+// object; with keep, from itself becomes an alias until the returned time.
+func noteMoveAlias(from, to string, keep bool) time.Time {
+	aliasMu.Lock()
+	defer aliasMu.Unlock()
+	changed := false
+	if _, ok := aliases[to]; ok {
+		delete(aliases, to) // an object lives there now
+		changed = true
+	}
+	for _, a := range aliases {
+		if a.To == from {
+			a.To, changed = to, true
+		}
+	}
+	var expires time.Time
+	if keep {
+		expires = now().Add(AliasTTL)
+		aliases[from] = &pathAlias{To: to, Expires: expires}
+		changed = true
+	}
+	if changed {
+		saveAliases()
+	}
+	return expires
+}
+
+// Where an unexpired alias at rel points
+func aliasTarget(rel string) (string, bool) {
+	aliasMu.Lock()
+	defer aliasMu.Unlock()
+	a, ok := aliases[rel]
+	if !ok || !a.Expires.After(now()) {
+		return "", false
+	}
+	return a.To, true
+}
+
+// Answer a request for the missing object target with a redirect when its
+// path is an alias, keeping the URL's token segment (if any) and query
+func redirectAlias(w http.ResponseWriter, r *http.Request, relPath, target string) bool {
+	to, ok := aliasTarget(storageRel(target))
+	if !ok {
+		return false
+	}
+	prefix, ok := strings.CutSuffix(r.URL.Path, relPath)
+	if !ok {
+		return false
+	}
+	u := url.URL{Path: prefix + to, RawQuery: r.URL.RawQuery}
+	debugf("alias %s -> %s\n", relPath, to)
+	w.Header().Set("Location", u.String())
+	w.WriteHeader(http.StatusMovedPermanently)
+	return true
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	AuditLog            = ""        // override with AUDIT_LOG, append-only JSON lines file
+	AuditMaxBytes int64 = 100 << 20 // override with AUDIT_MAX_BYTES, rotate the audit log past this size
+	AuditWebhook        = ""        // override with AUDIT_WEBHOOK, POST each event to this URL
+)
+
+// One audit record; written as a single JSON line
+type auditEvent struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Method  string    `json:"method"`
+	Path    string    `json:"path"`
+	Dest    string    `json:"destination,omitempty"`
+	IP      string    `json:"ip"`
+	JTI     string    `json:"jti,omitempty"`
+	Subject string    `json:"sub,omitempty"`
+	Status  int       `json:"status"`
+	Outcome string    `json:"outcome"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+var (
+	auditMu    sync.Mutex
+	auditFile  *os.File
+	auditSize  int64
+	auditQueue chan []byte
+)
+
+func auditEnabled() bool {
+	return AuditLog != "" || AuditWebhook != ""
+}
+
+// Open the audit sinks; called once at startup
+func initAudit() error {
+	if AuditLog != "" {
+		if err := openAuditLog(); err != nil {
+			return err
+		}
+	}
+	if AuditWebhook != "" {
+		auditQueue = make(chan []byte, 1024)
+		go auditWebhookLoop()
+	}
+	return nil
+}
+
+func openAuditLog() error {
+	f, err := os.OpenFile(AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	auditFile, auditSize = f, info.Size()
+	return nil
+}
+
+// Move the full log aside (never truncate) and start a new one
+func rotateAuditLog() error {
+	auditFile.Close()
+	rotated := AuditLog + "." + now().UTC().Format("20060102T150405.000000000")
+	if err := os.Rename(AuditLog, rotated); err != nil {
+		fmt.Printf("warning: failed to rotate audit log: %v\n", err)
+	}
+	return openAuditLog()
+}
+
+// Record an event for the request. Token claims come from the auth context.
+func audit(r *http.Request, event, path string, status int, reason string) {
+	if !auditEnabled() {
+		return
+	}
+	ev := auditEvent{
+		Time:   now().UTC(),
+		Event:  event,
+		Method: r.Method,
+		Path:   path,
+		IP:     clientIP(r),
+		Status: status,
+		Reason: reason,
+	}
+	if r.Method == "MOVE" {
+		ev.Dest = r.Header.Get("Destination")
+	}
+	if c := tokenClaims(r); c != nil {
+		ev.JTI, ev.Subject = c.ID, c.Subject
+	}
+	ev.Outcome = "success"
+	if status >= 400 {
+		ev.Outcome = "failure"
+	}
+
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	auditMu.Lock()
+	if auditFile != nil {
+		if AuditMaxBytes > 0 && auditSize+int64(len(line)) > AuditMaxBytes && auditSize > 0 {
+			if err := rotateAuditLog(); err != nil {
+				fmt.Printf("warning: failed to reopen audit log: %v\n", err)
+			}
+		}
+		if auditFile != nil {
+			n, err := auditFile.Write(line)
+			auditSize += int64(n)
+			if err != nil {
+				fmt.Printf("warning: failed to write audit log: %v\n", err)
+			}
+		}
+	}
+	auditMu.Unlock()
+
+	if auditQueue != nil {
+		select {
+		case auditQueue <- line:
+		default:
+			fmt.Println("warning: audit webhook queue full, dropping event")
+		}
+	}
+}
+
+func auditWebhookLoop() {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for line := range auditQueue {
+		resp, err := client.Post(AuditWebhook, "application/json", bytes.NewReader(line))
+		if err != nil {
+			fmt.Printf("warning: audit webhook failed: %v\n", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			fmt.Printf("warning: audit webhook returned %d\n", resp.StatusCode)
+		}
+	}
+}
+
+// Map a mutating request to its audit event name
+func auditEventName(r *http.Request) string {
+	if isMkdirRequest(r) {
+		return "mkdir"
+	}
+	switch r.Method {
+	case http.MethodPost:
+		if r.URL.Query().Has("delete") {
+			return "delete"
+		}
+		if r.URL.Query().Has("share") {
+			return "share"
+		}
+		return "upload"
+	case http.MethodPut:
+		if r.URL.Query().Has("acl") {
+			return "acl"
+		}
+		if r.URL.Query().Has("retention") {
+			return "retention"
+		}
+		return "upload"
+	case http.MethodPatch:
+		return "truncate"
+	case http.MethodDelete:
+		return "delete"
+	case "MOVE":
+		return "move"
+	}
+	return "write"
+}
+
+// Captures the response status for the audit trail
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
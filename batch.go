@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Per-item outcome of a batch request (form upload, tar import, batch
+// delete). Code is machine-readable and set whenever Success is false.
+type batchResult struct {
+	Field   string `json:"field,omitempty"`
+	Path    string `json:"path"`
+	Success bool   `json:"success"`
+	Size    int64  `json:"size,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (res *batchResult) fail(code, msg string) {
+	res.Success, res.Code, res.Error = false, code, msg
+}
+
+// Record that the token does not cover the item, hidden as a missing
+// object with HIDE_FORBIDDEN
+func (res *batchResult) failForbidden() {
+	if HideForbidden {
+		res.fail("not_found", "Not found")
+		return
+	}
+	res.fail("forbidden", "Forbidden: Path not allowed")
+}
+
+// Record a storage error on the item
+func (res *batchResult) failErr(err error) {
+	code := "internal_error"
+	switch {
+	case errors.Is(err, errTooLarge):
+		code = "too_large"
+	case errors.Is(err, errQuotaExceeded):
+		code = "quota_exceeded"
+	case errors.Is(err, errDirFull):
+		code = "directory_full"
+	case errors.Is(err, errObjectLimit):
+		code = "object_limit_exceeded"
+	case errors.Is(err, errBadGzip):
+		code = "bad_request"
+	case errors.Is(err, errSlowUpload):
+		code = "request_timeout"
+	case errors.Is(err, errKeyCase):
+		code = "key_case_conflict"
+	case errors.Is(err, errRetained):
+		code = "retention_locked"
+	case errors.Is(err, errReservedName):
+		code = "reserved_name"
+	case errors.Is(err, errUploadRejected):
+		code = "upload_rejected"
+	case errors.Is(err, errWriteInProgress):
+		code = "write_in_progress"
+	case noteUnwritable(err):
+		code = "storage_unwritable"
+	}
+	res.fail(code, err.Error())
+}
+
+// 200 when every item succeeded, 207 Multi-Status when any failed. Errors
+// that make the whole request unusable are reported before this with 4xx.
+func writeBatchResults(w http.ResponseWriter, results []batchResult) {
+	allOK := true
+	for _, res := range results {
+		allOK = allOK && res.Success
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !allOK {
+		w.WriteHeader(http.StatusMultiStatus)
+	}
+	json.NewEncoder(w).Encode(map[string]any{"success": allOK, "files": results})
+}
+
+// POST /{token}/prefix/?delete with {"paths": ["a.txt", "sub/b.txt"]}
+// deletes each path below prefix, as if sent as individual DELETEs
+func batchDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) < 2 {
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	prefix := parts[1]
+
+	var req struct {
+		Paths []string `json:"paths"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil || len(req.Paths) == 0 {
+		httpError(w, r, `Body must be {"paths": [...]} with at least one path`, http.StatusBadRequest)
+		return
+	}
+	re := tokenRegex(r)
+	missingOK := DeleteMissingOK || strings.EqualFold(r.Header.Get("X-Idempotent"), "true")
+
+	results := make([]batchResult, 0, len(req.Paths))
+	for _, p := range req.Paths {
+		res := batchResult{Path: p}
+		relPath := strings.TrimPrefix(path.Join("/", prefix, p), "/")
+		target, err := resolvePath(relPath)
+		switch {
+		case checkCanonicalPath("/"+strings.TrimPrefix(p, "/")) != nil || err != nil || target == filepath.Clean(StorageDir):
+			res.fail("invalid_path", "Invalid path")
+		case re != nil && !pathAllowed(re, relPath):
+			res.failForbidden()
+		default:
+			res.Path = relPath
+			deleteBatchItem(r, &res, target, missingOK)
+		}
+		results = append(results, res)
+	}
+	writeBatchResults(w, results)
+}
+
+func deleteBatchItem(r *http.Request, res *batchResult, target string, missingOK bool) {
+	unlock, err := lockPathsFor(r, target)
+	if err != nil {
+		res.failErr(err)
+		return
+	}
+	defer unlock()
+	info, err := os.Stat(target)
+	switch {
+	case os.IsNotExist(err):
+		if missingOK {
+			res.Success = true
+		} else {
+			res.fail("not_found", "Not found")
+		}
+	case err == nil && info.IsDir():
+		res.fail("invalid_path", "Directories cannot be deleted")
+	case checkRetention(target) != nil:
+		res.failErr(errRetained)
+	default:
+		if err := deleteObject(target); err != nil {
+			res.failErr(err)
+			return
+		}
+		debugf("deleted %s\n", res.Path)
+		res.Success = true
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// POST /{token}/dir/?cas stores the body at dir/ab/cd/<sha256>, named by its
+// own digest, and returns that path. Uploading content already stored there
+// (checked by hashing the stored file) writes nothing and answers 200
+// instead of 201, so an immutable blob store deduplicates for free. The token must cover the directory named (dir/,
+// with or without the trailing slash). The body
+// is staged under .parts/ while it is hashed, then written into place.
+func casUploadHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) < 2 {
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	dir, err := resolvePath(parts[1])
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		httpError(w, r, "Content-addressed uploads go to a directory", http.StatusBadRequest)
+		return
+	}
+
+	policy := policyFor(storageRel(dir))
+	if ct := r.Header.Get("Content-Type"); !policy.allowsContentType(ct) {
+		writeContentTypeError(w, r, ct)
+		return
+	}
+	limit, byToken := fileLimitFor(tokenClaims(r), dir)
+	if limit > 0 && r.ContentLength > limit {
+		writeFileTooLarge(w, r, "Failed to upload", limit, byToken)
+		return
+	}
+	if remaining := quotaRemaining(0); remaining >= 0 && r.ContentLength > remaining {
+		writeQuotaError(w, r)
+		return
+	}
+
+	// Stage and hash in one pass; the name is only known at the end
+	if err := os.MkdirAll(partsRoot(), DirMode); err != nil {
+		writeStorageError(w, r, "Failed to upload", err)
+		return
+	}
+	staged, err := createTemp(partsRoot())
+	if err != nil {
+		writeStorageError(w, r, "Failed to upload", err)
+		return
+	}
+	defer os.Remove(staged.Name())
+	defer staged.Close()
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(staged, h), quotaLimit(limitReader(r.Body, limit), 0))
+	if errors.Is(err, errQuotaExceeded) {
+		writeQuotaError(w, r)
+		return
+	}
+	if errors.Is(err, errTooLarge) {
+		writeFileTooLarge(w, r, "Failed to upload", limit, byToken)
+		return
+	}
+	if err != nil {
+		noteCanceled(r, "upload")
+		writeStorageError(w, r, "Failed to upload", err)
+		return
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	// The token was checked against the directory the request named; the
+	// object must land inside it, whatever aliases make of the derived path
+	rel := path.Join(storageRel(dir), sum[:2], sum[2:4], sum)
+	dest, err := resolvePath(rel)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !within(dest, dir) {
+		writePathForbidden(w, r)
+		return
+	}
+
+	unlock, err := lockPathsFor(r, dest)
+	if err != nil {
+		writeWriteInProgress(w, r)
+		return
+	}
+	defer unlock()
+
+	// A plain PUT can put any bytes at a digest's path, so the name alone
+	// proves nothing: only skip the write when the content really matches
+	resp := map[string]any{"success": true, "path": storageRel(dest), "sha256": sum, "size": size}
+	if info, err := os.Stat(dest); err == nil && !info.IsDir() && info.Size() == size {
+		if stored, err := fileSHA256(r, dest); err == nil && stored == sum {
+			debugf("content-addressed upload of %s already stored\n", rel)
+			w.Header().Set("Content-Type", "application/json")
+			resp["created"] = false
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+	}
+
+	if err := checkKeyCase(dest, ""); err != nil {
+		writeKeyCaseError(w, r, err)
+		return
+	}
+	if err := checkRetention(dest); err != nil {
+		writeRetentionError(w, r, err)
+		return
+	}
+	if err := checkDirCapacity(dest); err != nil {
+		writeDirFullError(w, r, dest)
+		return
+	}
+	if _, scope, err := checkObjectLimit(r, dest, ""); err != nil {
+		writeObjectLimitError(w, r, scope)
+		return
+	}
+	if _, err := staged.Seek(0, io.SeekStart); err != nil {
+		writeStorageError(w, r, "Failed to upload", err)
+		return
+	}
+	target := uploadTarget(dest)
+	oldSize := fileSize(target)
+	n, err := writeObject(target, quotaLimit(staged, oldSize))
+	if errors.Is(err, errQuotaExceeded) {
+		writeQuotaError(w, r)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, r, "Failed to upload", err)
+		return
+	}
+	addUsage(n - oldSize)
+
+	debugf("uploaded %s (content-addressed)\n", rel)
+	if target != dest {
+		resp["quarantined"] = true
+	}
+	resp["created"] = true
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Hex SHA-256 of a stored file, hashed afresh rather than from the
+// checksum cache, whose refresh would take the lock the caller holds
+func fileSHA256(r *http.Request, p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, &ctxReader{r.Context(), f}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
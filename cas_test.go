@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCASDedupChecksStoredContent(t *testing.T) {
+	srv := newTestServer(t)
+	tok := testToken(t, "^/blobs/.*")
+	content := "the real blob"
+	sum := sha256.Sum256([]byte(content))
+	digest := hex.EncodeToString(sum[:])
+	blob := "blobs/" + digest[:2] + "/" + digest[2:4] + "/" + digest
+	cas := func() (int, bool) {
+		resp := doRequest(t, http.MethodPost, srv.URL+"/"+tok+"/blobs/?cas", content)
+		var body struct {
+			Created bool `json:"created"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body.Created
+	}
+
+	// Same size, different bytes, written with a plain PUT
+	if resp := doRequest(t, http.MethodPut, srv.URL+"/"+tok+"/"+blob, "a forged blob"); resp.StatusCode >= 300 {
+		t.Fatalf("PUT: status %d", resp.StatusCode)
+	}
+	if status, created := cas(); status != http.StatusCreated || !created {
+		t.Fatalf("upload over a forged blob: status %d, created %v", status, created)
+	}
+	if b, _ := os.ReadFile(filepath.Join(StorageDir, filepath.FromSlash(blob))); string(b) != content {
+		t.Fatalf("blob holds %q", b)
+	}
+	if status, created := cas(); status != http.StatusOK || created {
+		t.Fatalf("repeat upload: status %d, created %v", status, created)
+	}
+}
+
+func TestCASRespectsRetention(t *testing.T) {
+	srv := newTestServer(t)
+	tok := testToken(t, "^/blobs/.*")
+	content := "retained blob"
+	sum := sha256.Sum256([]byte(content))
+	digest := hex.EncodeToString(sum[:])
+	blob := "blobs/" + digest[:2] + "/" + digest[2:4] + "/" + digest
+
+	doRequest(t, http.MethodPut, srv.URL+"/"+tok+"/"+blob, "forged, locked")
+	until := now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if resp := doRequest(t, http.MethodPut, srv.URL+"/"+tok+"/"+blob+"?retention="+until, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("retention: status %d", resp.StatusCode)
+	}
+	resp := doRequest(t, http.MethodPost, srv.URL+"/"+tok+"/blobs/?cas", content)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("upload over a retained object: status %d", resp.StatusCode)
+	}
+	if env := decodeEnvelope(t, resp); env.Code != "retention_locked" {
+		t.Fatalf("code %q", env.Code)
+	}
+}
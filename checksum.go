@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// Digests computed for one version of the object, kept in its metadata
+type checksumCache struct {
+	Size    int64             `json:"size"`
+	ModTime time.Time         `json:"modTime"`
+	Sums    map[string]string `json:"sums"`
+}
+
+// GET /{token}/path?checksum=sha256 (or md5, sha1): hash the stored bytes
+// server-side and return the hex digest instead of the content. Results are
+// cached in the object's metadata until its size or modtime changes.
+func checksumHandler(w http.ResponseWriter, r *http.Request, target string, f *os.File, info os.FileInfo) {
+	algo := r.URL.Query().Get("checksum")
+	if _, ok := checksumAlgorithms[algo]; !ok {
+		httpError(w, r, "checksum must be md5, sha1 or sha256", http.StatusBadRequest)
+		return
+	}
+
+	sum, err := objectChecksum(r.Context(), target, info, algo, f)
+	if err != nil {
+		httpError(w, r, "Failed to checksum: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"path":      storageRel(target),
+		"algorithm": algo,
+		"checksum":  sum,
+		"size":      info.Size(),
+	})
+}
+
+// Digest of target for algo, taken from its metadata while the cached
+// size and modtime still match, otherwise hashed from f (opened here when
+// nil) and cached. algo must be a key of checksumAlgorithms.
+func objectChecksum(ctx context.Context, target string, info os.FileInfo, algo string, f *os.File) (string, error) {
+	meta, err := readMeta(target)
+	if err != nil {
+		return "", err
+	}
+	if c := meta.Checksums; c != nil && c.Size == info.Size() && c.ModTime.Equal(info.ModTime()) && c.Sums[algo] != "" {
+		return c.Sums[algo], nil
+	}
+
+	if f == nil {
+		if f, err = os.Open(target); err != nil {
+			return "", err
+		}
+		defer f.Close()
+	}
+	h := checksumAlgorithms[algo]()
+	if _, err := io.Copy(h, &ctxReader{ctx, f}); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	cacheChecksum(target, info, algo, sum)
+	return sum, nil
+}
+
+// Remember a digest unless the object changed while it was being hashed
+func cacheChecksum(target string, info os.FileInfo, algo, sum string) {
+	unlock := lockPath(target)
+	defer unlock()
+	now, err := os.Stat(target)
+	if err != nil || now.Size() != info.Size() || !now.ModTime().Equal(info.ModTime()) {
+		return
+	}
+	updateMeta(target, func(m *objectMeta) {
+		m.Path = storageRel(target)
+		if m.Checksums == nil || m.Checksums.Size != info.Size() || !m.Checksums.ModTime.Equal(info.ModTime()) {
+			m.Checksums = &checksumCache{Size: info.Size(), ModTime: info.ModTime(), Sums: map[string]string{}}
+		}
+		m.Checksums.Sums[algo] = sum
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"sync"
+)
+
+// Bounds on the path regex a token carries. Go's RE2 engine matches in
+// linear time, so the cost a hostile claim can impose is in compiling it:
+// huge patterns and deeply nested groups or repetitions.
+var (
+	MaxPathClaimLength = 1024 // override with MAX_PATH_CLAIM_LENGTH, in bytes
+	MaxPathClaimDepth  = 16   // override with MAX_PATH_CLAIM_DEPTH, nesting of groups and repetitions
+
+	// A claim that grants every path (an empty one, ".*", "^/") is more often
+	// a mistake than a deliberate full-access token, so such claims are
+	// refused unless this is set
+	AllowBroadPathClaims = false // override with ALLOW_BROAD_PATH_CLAIMS
+)
+
+// Paths no scoped claim has reason to match, drawn at startup so a claim
+// cannot be written to avoid them
+var broadClaimProbes = func() []string {
+	id, _ := randomID()
+	return []string{"/", "/" + id, "/" + id + "/" + id}
+}()
+
+// Compiled claim regexes by pattern, so a token reused across requests is
+// compiled once. Cleared when it fills rather than tracking recency.
+var (
+	claimRegexMu    sync.Mutex
+	claimRegexes    = map[string]*regexp.Regexp{}
+	claimRegexLimit = 1024
+)
+
+// Compile a path claim after checking it against the size and nesting bounds
+func compilePathClaim(pattern string) (*regexp.Regexp, error) {
+	claimRegexMu.Lock()
+	re, ok := claimRegexes[pattern]
+	claimRegexMu.Unlock()
+	if ok {
+		return re, nil
+	}
+
+	if len(pattern) > MaxPathClaimLength {
+		return nil, fmt.Errorf("pattern is %d bytes, limit is %d", len(pattern), MaxPathClaimLength)
+	}
+	tree, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	if d := regexDepth(tree); d > MaxPathClaimDepth {
+		return nil, fmt.Errorf("pattern nests %d deep, limit is %d", d, MaxPathClaimDepth)
+	}
+	re, err = regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if !AllowBroadPathClaims && isBroadClaim(re) {
+		return nil, fmt.Errorf("pattern %q grants every path; set ALLOW_BROAD_PATH_CLAIMS to accept it", pattern)
+	}
+
+	claimRegexMu.Lock()
+	if len(claimRegexes) >= claimRegexLimit {
+		clear(claimRegexes)
+	}
+	claimRegexes[pattern] = re
+	claimRegexMu.Unlock()
+	return re, nil
+}
+
+func isBroadClaim(re *regexp.Regexp) bool {
+	for _, p := range broadClaimProbes {
+		if !pathAllowed(re, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// Nesting depth of capture groups and repetitions in a parsed regex
+func regexDepth(re *syntax.Regexp) int {
+	deepest := 0
+	for _, sub := range re.Sub {
+		deepest = max(deepest, regexDepth(sub))
+	}
+	switch re.Op {
+	case syntax.OpCapture, syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		deepest++
+	}
+	return deepest
+}
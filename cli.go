@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Client subcommands, so the binary can script a running server or, with
+// -local, the storage directory itself:
+//
+//	objectstorage token -path '^/foo/' -ttl 1h
+//	objectstorage upload report.pdf docs/report.pdf
+//	objectstorage download docs/report.pdf [out|-]
+//	objectstorage delete docs/report.pdf
+//	objectstorage list docs
+//
+// Against a server (-server, default $STORAGE_URL or http://localhost:8000)
+// the token comes from -token or $STORAGE_TOKEN, or is minted from SECRET
+// for just the path being accessed.
+var cliCommands = map[string]func(args []string) error{
+	"token":    cliToken,
+	"upload":   cliUpload,
+	"download": cliDownload,
+	"delete":   cliDelete,
+	"list":     cliList,
+}
+
+var errUsage = errors.New("usage")
+
+func runCLI(name string, args []string) int {
+	err := cliCommands[name](args)
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, errUsage), errors.Is(err, flag.ErrHelp):
+		return 2
+	}
+	fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+	return 1
+}
+
+func cliToken(args []string) error {
+	fs := flag.NewFlagSet("token", flag.ContinueOnError)
+	pathRe := fs.String("path", "", "path regex the token grants, e.g. ^/foo/")
+	sub := fs.String("sub", "", "subject (sub claim)")
+	ttl := fs.Duration("ttl", time.Hour, "lifetime, 0 for a token that never expires")
+	maxUploads := fs.Int("max-uploads", 0, "max_uploads claim")
+	maxObjects := fs.Int64("max-objects", 0, "max_objects claim")
+	noList := fs.Bool("no-list", false, "set can_list false: objects can be fetched but directories not listed")
+	noRead := fs.Bool("no-read", false, "set can_read false: directories can be listed but objects not fetched")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *pathRe == "" && (PathTemplate == "" || *sub == "") {
+		fmt.Fprintln(os.Stderr, "usage: objectstorage token -path REGEX [-sub S] [-ttl 1h] [-max-uploads N] [-max-objects N] [-no-list] [-no-read]")
+		return errUsage
+	}
+	if _, err := regexp.Compile(*pathRe); err != nil {
+		return fmt.Errorf("invalid -path: %w", err)
+	}
+	claims := Claims{Path: *pathRe, MaxUploads: *maxUploads, MaxObjects: *maxObjects,
+		RegisteredClaims: jwt.RegisteredClaims{Subject: *sub}}
+	if *noList {
+		claims.CanList = new(bool)
+	}
+	if *noRead {
+		claims.CanRead = new(bool)
+	}
+	token, err := mintToken(claims, *ttl)
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
+
+// Sign claims with SECRET, expiring after ttl unless it is 0
+func mintToken(claims Claims, ttl time.Duration) (string, error) {
+	now := now()
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	if ttl > 0 {
+		claims.ExpiresAt = jwt.NewNumericDate(now.Add(ttl))
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(Secret)
+}
+
+// Flags shared by the commands that touch objects
+type cliTarget struct {
+	fs     *flag.FlagSet
+	server *string
+	token  *string
+	local  *bool
+}
+
+func newCLITarget(name string) *cliTarget {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	server := os.Getenv("STORAGE_URL")
+	if server == "" {
+		server = "http://localhost:8000"
+	}
+	return &cliTarget{
+		fs:     fs,
+		server: fs.String("server", server, "server base URL"),
+		token:  fs.String("token", os.Getenv("STORAGE_TOKEN"), "token, minted from SECRET when empty"),
+		local:  fs.Bool("local", false, "operate on the storage directory instead of a server"),
+	}
+}
+
+func (t *cliTarget) parse(args []string, usage string, min, max int) error {
+	if err := t.fs.Parse(args); err != nil {
+		return err
+	}
+	if n := t.fs.NArg(); n < min || n > max {
+		fmt.Fprintf(os.Stderr, "usage: objectstorage %s [-server URL] [-token T] [-local] %s\n", t.fs.Name(), usage)
+		return errUsage
+	}
+	if *t.local {
+		return initMetadataStore()
+	}
+	return nil
+}
+
+// URL of a storage-relative path on the server, with a token that covers it
+func (t *cliTarget) url(rel string, dir bool) (string, error) {
+	rel = strings.Trim(rel, "/")
+	token := *t.token
+	if token == "" {
+		pattern := "^/" + regexp.QuoteMeta(rel)
+		if dir {
+			pattern += "/?$"
+		} else {
+			pattern += "$"
+		}
+		var err error
+		if token, err = mintToken(Claims{Path: pattern}, 5*time.Minute); err != nil {
+			return "", err
+		}
+	}
+	segs := strings.Split(rel, "/")
+	for i, s := range segs {
+		segs[i] = url.PathEscape(s)
+	}
+	u := strings.TrimSuffix(*t.server, "/") + "/" + token + "/" + strings.Join(segs, "/")
+	if dir {
+		u = strings.TrimSuffix(u, "/") + "/"
+	}
+	return u, nil
+}
+
+// Send a request and turn a non-2xx answer into an error carrying the server's message
+func (t *cliTarget) do(method, rel string, dir bool, body io.Reader) (*http.Response, error) {
+	u, err := t.url(rel, dir)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var env errorEnvelope
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(data, &env) == nil && env.Error != "" {
+			return nil, fmt.Errorf("%s (%d %s)", env.Error, resp.StatusCode, env.Code)
+		}
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return resp, nil
+}
+
+func cliUpload(args []string) error {
+	t := newCLITarget("upload")
+	if err := t.parse(args, "SRC DEST", 2, 2); err != nil {
+		return err
+	}
+	src, rel := t.fs.Arg(0), t.fs.Arg(1)
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if *t.local {
+		dest, err := resolvePath(rel)
+		if err != nil {
+			return err
+		}
+		if dest == filepath.Clean(StorageDir) {
+			return errors.New("invalid path")
+		}
+		unlock := lockPath(dest)
+		defer unlock()
+		_, err = writeObject(dest, f)
+		return err
+	}
+	resp, err := t.do(http.MethodPut, rel, false, f)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func cliDownload(args []string) error {
+	t := newCLITarget("download")
+	if err := t.parse(args, "SRC [DEST|-]", 1, 2); err != nil {
+		return err
+	}
+	rel, out := t.fs.Arg(0), t.fs.Arg(1)
+	if out == "" {
+		out = filepath.Base(rel)
+	}
+
+	var body io.ReadCloser
+	if *t.local {
+		target, err := resolvePath(rel)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(target)
+		if err != nil {
+			return err
+		}
+		body = f
+	} else {
+		resp, err := t.do(http.MethodGet, rel, false, nil)
+		if err != nil {
+			return err
+		}
+		body = resp.Body
+	}
+	defer body.Close()
+
+	if out == "-" {
+		_, err := io.Copy(os.Stdout, body)
+		return err
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		os.Remove(out)
+		return err
+	}
+	return f.Close()
+}
+
+func cliDelete(args []string) error {
+	t := newCLITarget("delete")
+	if err := t.parse(args, "PATH", 1, 1); err != nil {
+		return err
+	}
+	rel := t.fs.Arg(0)
+	if *t.local {
+		target, err := resolvePath(rel)
+		if err != nil {
+			return err
+		}
+		unlock := lockPath(target)
+		defer unlock()
+		if info, err := os.Stat(target); err != nil {
+			return err
+		} else if info.IsDir() {
+			return errors.New("directories cannot be deleted")
+		}
+		if err := checkRetention(target); err != nil {
+			return err
+		}
+		return deleteObject(target)
+	}
+	resp, err := t.do(http.MethodDelete, rel, false, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func cliList(args []string) error {
+	t := newCLITarget("list")
+	if err := t.parse(args, "[DIR]", 0, 1); err != nil {
+		return err
+	}
+	rel := t.fs.Arg(0)
+
+	var entries []listEntry
+	if *t.local {
+		dir, err := resolvePath(rel)
+		if err != nil {
+			return err
+		}
+		if entries, err = readListing(context.Background(), dir, false); err != nil {
+			return err
+		}
+	} else {
+		resp, err := t.do(http.MethodGet, rel, true, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		var listing struct {
+			Entries []listEntry `json:"entries"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&listing); err != nil {
+			return fmt.Errorf("unexpected listing: %w", err)
+		}
+		entries = listing.Entries
+	}
+
+	for _, e := range entries {
+		if e.Type == "dir" {
+			fmt.Printf("%12s  %s  %s/\n", "-", e.ModTime.UTC().Format(time.RFC3339), e.Name)
+		} else {
+			fmt.Printf("%12d  %s  %s\n", e.Size, e.ModTime.UTC().Format(time.RFC3339), e.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+// Package client is a small Go client for the object storage server. It
+// builds the token-in-path URLs, verifies upload checksums, retries
+// transient failures and drives the multipart (resumable) upload protocol.
+//
+//	c := client.New("https://files.example.com", token)
+//	err := c.Upload(ctx, "docs/report.pdf", f)
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Client struct {
+	BaseURL    string // e.g. https://files.example.com, without the token
+	Token      string
+	HTTPClient *http.Client
+
+	Retries    int           // further attempts after a transient failure (network error, 429, 502-504)
+	RetryDelay time.Duration // wait before the first retry, doubling after each; Retry-After wins when sent
+	PartSize   int64         // part size UploadLarge uses
+}
+
+func New(baseURL, token string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		Token:      token,
+		HTTPClient: http.DefaultClient,
+		Retries:    3,
+		RetryDelay: 500 * time.Millisecond,
+		PartSize:   16 << 20,
+	}
+}
+
+// Error is a non-2xx answer, carrying the server's error envelope
+type Error struct {
+	Status  int
+	Code    string // stable identifier such as not_found or quota_exceeded
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("objectstorage: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// Whether err is the server reporting a missing object
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Status == http.StatusNotFound
+}
+
+var ErrChecksumMismatch = errors.New("objectstorage: stored checksum does not match the uploaded bytes")
+
+type Entry struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type"` // "file" or "dir"
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+func (c *Client) url(path string, query url.Values) string {
+	segs := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i, s := range segs {
+		segs[i] = url.PathEscape(s)
+	}
+	u := c.BaseURL + "/" + c.Token + "/" + strings.Join(segs, "/")
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// Send a request, retrying transient failures. body is rewound before each
+// retry; a body that cannot be rewound is sent only once.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body io.Reader, header http.Header) (*http.Response, error) {
+	seeker, canRewind := body.(io.Seeker)
+	if body == nil {
+		canRewind = true
+	}
+	delay := c.RetryDelay
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, c.url(path, query), body)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := c.HTTPClient.Do(req)
+		if err == nil && resp.StatusCode < 300 {
+			return resp, nil
+		}
+		if err == nil {
+			err = readError(resp)
+		}
+		if attempt >= c.Retries || !canRewind || !retryable(resp, err) || ctx.Err() != nil {
+			return nil, err
+		}
+		wait := delay
+		if resp != nil {
+			if s, perr := strconv.Atoi(resp.Header.Get("Retry-After")); perr == nil {
+				wait = time.Duration(s) * time.Second
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+		if seeker != nil {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if resp == nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func readError(resp *http.Response) error {
+	defer resp.Body.Close()
+	e := &Error{Status: resp.StatusCode, Message: resp.Status}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var env struct {
+		Code  string `json:"code"`
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(data, &env) == nil && env.Error != "" {
+		e.Code, e.Message = env.Code, env.Error
+	}
+	return e
+}
+
+// Upload stores r at path, replacing any existing object, and checks the
+// SHA-256 the server computed against the bytes sent. Retries need r to be
+// an io.Seeker positioned at the start of the data.
+func (c *Client) Upload(ctx context.Context, path string, r io.Reader) error {
+	h := sha256.New()
+	var body io.Reader = &hashingReader{r: r, h: h}
+	if _, ok := r.(io.Seeker); ok {
+		body = hashingSeeker{body.(*hashingReader)}
+	}
+	header := http.Header{"X-Checksum-Trailer": {"true"}}
+	resp, err := c.do(ctx, http.MethodPut, path, nil, body, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body) // trailers arrive after the body
+	if sum := resp.Trailer.Get("X-Checksum-SHA256"); sum != "" && sum != hex.EncodeToString(h.Sum(nil)) {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// Hashes what is read, starting over when rewound for a retry
+type hashingReader struct {
+	r io.Reader
+	h interface {
+		io.Writer
+		Reset()
+	}
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n])
+	return n, err
+}
+
+type hashingSeeker struct{ *hashingReader }
+
+func (hs hashingSeeker) Seek(offset int64, whence int) (int64, error) {
+	hs.h.Reset()
+	return hs.r.(io.Seeker).Seek(offset, whence)
+}
+
+// Download opens the object at path; the caller closes the body
+func (c *Client) Download(ctx context.Context, path string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, path, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *Client) Delete(ctx context.Context, path string) error {
+	resp, err := c.do(ctx, http.MethodDelete, path, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// List returns the direct children of the directory prefix ("" for the root)
+func (c *Client) List(ctx context.Context, prefix string) ([]Entry, error) {
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	resp, err := c.do(ctx, http.MethodGet, prefix, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var listing struct {
+		Entries []Entry `json:"entries"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&listing); err != nil {
+		return nil, fmt.Errorf("objectstorage: unexpected listing: %w", err)
+	}
+	return listing.Entries, nil
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Multipart is an upload session of the server's parts protocol. Parts can
+// be sent in any order and re-sent after a failure, so keeping ID lets an
+// interrupted upload be resumed later with Resume.
+type Multipart struct {
+	c    *Client
+	Path string
+	ID   string
+}
+
+// CreateMultipart starts a multipart upload to path
+func (c *Client) CreateMultipart(ctx context.Context, path string) (*Multipart, error) {
+	resp, err := c.do(ctx, http.MethodPost, path, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var created struct {
+		UploadID string `json:"uploadId"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return nil, err
+	}
+	return &Multipart{c: c, Path: path, ID: created.UploadID}, nil
+}
+
+// Resume continues the multipart upload id to path
+func (c *Client) Resume(path, id string) *Multipart {
+	return &Multipart{c: c, Path: path, ID: id}
+}
+
+func (m *Multipart) query(extra url.Values) url.Values {
+	q := url.Values{"uploadId": {m.ID}}
+	for k, v := range extra {
+		q[k] = v
+	}
+	return q
+}
+
+// UploadPart sends part n (1-based), replacing an earlier copy of it
+func (m *Multipart) UploadPart(ctx context.Context, n int, r io.ReadSeeker) error {
+	resp, err := m.c.do(ctx, http.MethodPut, m.Path, m.query(url.Values{"partNumber": {strconv.Itoa(n)}}), r, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Complete assembles parts 1..N into the object
+func (m *Multipart) Complete(ctx context.Context) error {
+	resp, err := m.c.do(ctx, http.MethodPost, m.Path, m.query(nil), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Abort discards the session and its parts
+func (m *Multipart) Abort(ctx context.Context) error {
+	resp, err := m.c.do(ctx, http.MethodDelete, m.Path, m.query(nil), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// UploadLarge uploads size bytes of r to path in PartSize parts, each
+// retried on its own. On failure the session is left in place and returned
+// so the caller can Resume it or Abort it.
+func (c *Client) UploadLarge(ctx context.Context, path string, r io.ReaderAt, size int64) (*Multipart, error) {
+	m, err := c.CreateMultipart(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return m, m.UploadFrom(ctx, r, size, 1)
+}
+
+// UploadFrom sends the parts of r from part number first onwards, then
+// completes the upload; first > 1 skips parts a previous attempt stored.
+func (m *Multipart) UploadFrom(ctx context.Context, r io.ReaderAt, size int64, first int) error {
+	partSize := max(m.c.PartSize, 1)
+	for n := first; int64(n-1)*partSize < size || n == 1; n++ {
+		off := int64(n-1) * partSize
+		part := io.NewSectionReader(r, off, min(partSize, size-off))
+		if err := m.UploadPart(ctx, n, part); err != nil {
+			return err
+		}
+	}
+	return m.Complete(ctx)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Directories younger than this are left alone by compaction: an upload may
+// have just created one and not yet written its file into it.
+const compactGrace = time.Minute
+
+// POST /admin/compact removes empty directories left behind by out-of-band
+// changes or failed operations, deepest first. Internal directories
+// (versions, staged parts, quarantine), the storage root and directories
+// created with MKCOL, which hold a dirMarker, are kept.
+func compactHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	root := filepath.Clean(StorageDir)
+	entries, err := readStorageDir(root)
+	if err != nil {
+		httpError(w, r, "Failed to read storage: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c := &compaction{cutoff: now().Add(-compactGrace)}
+	for _, e := range entries {
+		if e.IsDir() && !isReservedName(e.Name()) {
+			c.prune(storageChild(root, e.Name()), 1)
+		}
+	}
+
+	fmt.Printf("[admin] compact removed %d empty directories, by %s\n", c.removed, clientIP(r))
+	resp := map[string]any{"success": true, "removed": c.removed}
+	if c.truncated {
+		resp["truncated"] = true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+type compaction struct {
+	cutoff    time.Time
+	removed   int
+	truncated bool // a directory below MaxWalkDepth was left unvisited
+}
+
+// Remove the empty directories below and including dir (depth levels below
+// the root), reporting whether dir itself went
+func (c *compaction) prune(dir string, depth int) bool {
+	if MaxWalkDepth > 0 && depth > MaxWalkDepth {
+		c.truncated = c.truncated || !isEmptyDir(dir)
+		return false
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	removed, left := c.removed, 0
+	for _, e := range entries {
+		if !e.IsDir() || isReservedName(e.Name()) {
+			left++
+			continue
+		}
+		if !c.prune(filepath.Join(dir, e.Name()), depth+1) {
+			left++
+		}
+	}
+	if left > 0 {
+		return false
+	}
+	// Removing children bumped dir's mtime, so only a fresh dir of its own is skipped
+	if info, err := os.Stat(dir); err != nil || (c.removed == removed && info.ModTime().After(c.cutoff)) {
+		return false
+	}
+	// os.Remove refuses a directory something was written into meanwhile
+	noteOwnWrite(dir)
+	if os.Remove(dir) != nil {
+		return false
+	}
+	invalidateDirCounts(dir)
+	c.removed++
+	return true
+}
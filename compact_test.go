@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCompactKeepsExplicitDirectories(t *testing.T) {
+	prev := AdminSecret
+	AdminSecret = "admin"
+	t.Cleanup(func() { AdminSecret = prev })
+	srv := newTestServer(t)
+	base := srv.URL + "/" + testToken(t, "^/data/.*")
+
+	if resp := doRequest(t, "MKCOL", base+"/data/made", ""); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("MKCOL: status %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, http.MethodPut, base+"/data/put/", ""); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT dir/: status %d", resp.StatusCode)
+	}
+	// Left behind out of band
+	leftover := filepath.Join(StorageDir, "data", "leftover", "deep")
+	if err := os.MkdirAll(leftover, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// An explicit directory survives its last file being deleted
+	doRequest(t, http.MethodPut, base+"/data/made/a.txt", "a")
+	doRequest(t, http.MethodDelete, base+"/data/made/a.txt", "")
+
+	// Past the grace period for fresh directories
+	old := time.Now().Add(-time.Hour)
+	for _, d := range []string{"made", "put", "leftover", "leftover/deep"} {
+		os.Chtimes(filepath.Join(StorageDir, "data", d), old, old)
+	}
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/admin/compact", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Removed int `json:"removed"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Removed != 2 {
+		t.Fatalf("removed %d directories, want 2", body.Removed)
+	}
+	for _, d := range []string{"made", "put"} {
+		if _, err := os.Stat(filepath.Join(StorageDir, "data", d)); err != nil {
+			t.Fatalf("explicit directory %s removed: %v", d, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(StorageDir, "data", "leftover")); !os.IsNotExist(err) {
+		t.Fatalf("leftover directory kept: %v", err)
+	}
+
+	// The marker stays out of listings
+	list := readBody(t, doRequest(t, http.MethodGet, base+"/data/made/", ""))
+	var listing struct {
+		Entries []listEntry `json:"entries"`
+	}
+	if err := json.Unmarshal([]byte(list), &listing); err != nil || len(listing.Entries) != 0 {
+		t.Fatalf("listing %s, %v", list, err)
+	}
+}
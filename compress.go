@@ -0,0 +1,160 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// On-the-fly response compression. Listings past listingGzipMin are always
+// compressed for clients that accept it; with COMPRESS_DOWNLOADS, file
+// downloads whose Content-Type is in CompressTypes are too. BROTLI adds br
+// to gzip, and the client's Accept-Encoding q-values pick between them,
+// br winning a tie as it compresses web content better. Range requests,
+// objects stored encoded and X-Accel-Redirect transfers are sent as is.
+var (
+	Brotli            = false // override with BROTLI
+	CompressDownloads = false // override with COMPRESS_DOWNLOADS
+
+	// override with COMPRESS_TYPES (comma separated), "type/*" matching a whole type
+	CompressTypes = []string{"text/*", "application/json", "application/javascript", "application/xml", "image/svg+xml"}
+)
+
+// Encodings offered on the fly, best first
+func compressOffers() []string {
+	if Brotli {
+		return []string{"br", "gzip"}
+	}
+	return []string{"gzip"}
+}
+
+// The offered encoding Accept-Encoding ranks highest, "" for none. An
+// explicit entry beats "*", q=0 refuses, and ties go to the earlier offer.
+func negotiateEncoding(r *http.Request, offers ...string) string {
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		if q := encodingQuality(r.Header.Get("Accept-Encoding"), offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+func encodingQuality(accept, enc string) float64 {
+	q, wildcard := -1.0, -1.0
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.TrimSpace(name)
+		v := 1.0
+		if s, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				v = f
+			}
+		}
+		switch {
+		case strings.EqualFold(name, enc):
+			q = v
+		case name == "*":
+			wildcard = v
+		}
+	}
+	if q < 0 {
+		q = wildcard
+	}
+	return max(q, 0)
+}
+
+// Whether a download of this Content-Type is worth compressing
+func compressibleType(ct string) bool {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	for _, t := range CompressTypes {
+		if prefix, ok := strings.CutSuffix(t, "/*"); (ok && strings.HasPrefix(mt, prefix+"/")) || mt == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Encoding to compress a download of name with on the fly, "" to send it
+// as stored. content is sniffed when the extension does not tell the type.
+func downloadEncoding(w http.ResponseWriter, r *http.Request, name string, content io.ReadSeeker) string {
+	if !CompressDownloads || r.Header.Get("Range") != "" {
+		return ""
+	}
+	ct := w.Header().Get("Content-Type")
+	if ct == "" {
+		ct = mime.TypeByExtension(filepath.Ext(name))
+	}
+	if ct == "" {
+		var buf [512]byte
+		n, _ := io.ReadFull(content, buf[:])
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			return ""
+		}
+		ct = http.DetectContentType(buf[:n])
+	}
+	if !strings.Contains(strings.Join(w.Header().Values("Vary"), ","), "Accept-Encoding") {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	if !compressibleType(ct) {
+		return ""
+	}
+	return negotiateEncoding(r, compressOffers()...)
+}
+
+// Compresses everything written through it with enc, dropping the
+// Content-Length set for the uncompressed body. The encoder starts on the
+// first byte, so bodiless answers (304, HEAD) are left alone.
+type compressWriter struct {
+	http.ResponseWriter
+	enc string
+	zw  io.WriteCloser
+}
+
+func newCompressWriter(w http.ResponseWriter, enc string) *compressWriter {
+	w.Header().Set("Content-Encoding", enc)
+	w.Header().Del("Accept-Ranges")
+	if etag := w.Header().Get("ETag"); strings.HasSuffix(etag, `"`) {
+		// A different representation needs its own validator
+		w.Header().Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+enc+`"`)
+	}
+	return &compressWriter{ResponseWriter: w, enc: enc}
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	cw.Header().Del("Content-Length")
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.zw == nil {
+		cw.Header().Del("Content-Length")
+		if cw.enc == "br" {
+			cw.zw = brotli.NewWriterLevel(cw.ResponseWriter, brotli.DefaultCompression)
+		} else {
+			cw.zw = gzip.NewWriter(cw.ResponseWriter)
+		}
+	}
+	return cw.zw.Write(p)
+}
+
+// Finish the compressed stream
+func (cw *compressWriter) Close() error {
+	if cw.zw == nil {
+		return nil
+	}
+	return cw.zw.Close()
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		accept string
+		want   string
+	}{
+		{"gzip, br", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"gzip;q=0.2, br;q=0.8", "br"},
+		{"br;q=0, gzip;q=0.1", "gzip"},
+		{"br;q=0, *", "gzip"},
+		{"*", "br"},
+		{"identity", ""},
+		{"", ""},
+	} {
+		r, _ := http.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", tc.accept)
+		if got := negotiateEncoding(r, "br", "gzip"); got != tc.want {
+			t.Errorf("Accept-Encoding %q: got %q, want %q", tc.accept, got, tc.want)
+		}
+	}
+}
+
+func withCompression(t *testing.T) {
+	t.Helper()
+	prevBr, prevDl := Brotli, CompressDownloads
+	Brotli, CompressDownloads = true, true
+	t.Cleanup(func() { Brotli, CompressDownloads = prevBr, prevDl })
+}
+
+func fetch(t *testing.T, url, acceptEncoding, rangeHeader string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Accept-Encoding", acceptEncoding) // set by hand, so the client does not decode
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestDownloadCompression(t *testing.T) {
+	withCompression(t)
+	srv := newTestServer(t)
+	base := srv.URL + "/" + testToken(t, "^/data/.*")
+	text := strings.Repeat("compress me please ", 500)
+	doRequest(t, http.MethodPut, base+"/data/a.txt", text)
+	doRequest(t, http.MethodPut, base+"/data/a.png", text)
+
+	resp := fetch(t, base+"/data/a.txt", "gzip, br", "")
+	if enc := resp.Header.Get("Content-Encoding"); enc != "br" {
+		t.Fatalf("Content-Encoding %q, want br", enc)
+	}
+	if b, err := io.ReadAll(brotli.NewReader(resp.Body)); err != nil || string(b) != text {
+		t.Fatalf("br body decodes to %d bytes, %v", len(b), err)
+	}
+	if !strings.HasSuffix(resp.Header.Get("ETag"), `-br"`) {
+		t.Fatalf("ETag %q not marked as the br representation", resp.Header.Get("ETag"))
+	}
+
+	resp = fetch(t, base+"/data/a.txt", "br;q=0.1, gzip", "")
+	if enc := resp.Header.Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Content-Encoding %q, want gzip", enc)
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(zr); err != nil || string(b) != text {
+		t.Fatalf("gzip body decodes to %d bytes, %v", len(b), err)
+	}
+
+	resp = fetch(t, base+"/data/a.txt", "br", "bytes=0-9")
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("range: status %d, Content-Encoding %q", resp.StatusCode, resp.Header.Get("Content-Encoding"))
+	}
+	resp = fetch(t, base+"/data/a.png", "br", "")
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+		t.Fatalf("image compressed with %q", enc)
+	}
+}
+
+func TestListingBrotli(t *testing.T) {
+	withCompression(t)
+	srv := newTestServer(t)
+	base := srv.URL + "/" + testToken(t, "^/data/.*")
+	for i := 0; i < 40; i++ {
+		doRequest(t, http.MethodPut, base+"/data/file-with-a-long-name-"+strings.Repeat("x", i)+".txt", "x")
+	}
+	resp := fetch(t, base+"/data/", "gzip, br", "")
+	if enc := resp.Header.Get("Content-Encoding"); enc != "br" {
+		t.Fatalf("listing Content-Encoding %q, want br", enc)
+	}
+	if b, err := io.ReadAll(brotli.NewReader(resp.Body)); err != nil || !strings.Contains(string(b), `"entries"`) {
+		t.Fatalf("listing decodes to %q, %v", b, err)
+	}
+}
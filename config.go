@@ -0,0 +1,480 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Split a comma separated env var, dropping blanks
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Parse an octal permission env var like "0700", keeping def when unset
+func parseModeEnv(name string, def os.FileMode) (os.FileMode, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || v > 0777 {
+		return def, fmt.Errorf("invalid %s %q: expected octal permissions like 0755", name, s)
+	}
+	return os.FileMode(v), nil
+}
+
+// Parse a positive integer env var, keeping def when unset
+func parseIntEnv(name string, def int) (int, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v <= 0 {
+		return def, fmt.Errorf("invalid %s %q: expected a positive integer", name, s)
+	}
+	return v, nil
+}
+
+// Parse a count limit env var where 0 disables the limit, keeping def when unset
+func parseLimitEnv(name string, def int) (int, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 {
+		return def, fmt.Errorf("invalid %s %q: expected a non-negative integer", name, s)
+	}
+	return v, nil
+}
+
+// Parse a byte size env var where 0 means unlimited, keeping def when unset
+func parseSizeEnv(name string, def int64) (int64, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v < 0 {
+		return def, fmt.Errorf("invalid %s %q: expected a size in bytes", name, s)
+	}
+	return v, nil
+}
+
+// Parse a duration env var like "30s", where 0 disables, keeping def when unset
+func parseDurationEnv(name string, def time.Duration) (time.Duration, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return def, nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil || v < 0 {
+		return def, fmt.Errorf("invalid %s %q: expected a duration like 30s", name, s)
+	}
+	return v, nil
+}
+
+// Parse a boolean env var such as "true"/"1", keeping def when unset
+func parseBoolEnv(name string, def bool) (bool, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return def, fmt.Errorf("invalid %s %q: expected true or false", name, s)
+	}
+	return v, nil
+}
+
+// Load env overrides for the tunables, collecting every malformed or
+// conflicting value so they can all be reported at once
+func loadConfig() configErrors {
+	var errs configErrors
+	var err error
+	if DirMode, err = parseModeEnv("DIR_MODE", DirMode); err != nil {
+		errs = append(errs, err)
+	}
+	if FileMode, err = parseModeEnv("FILE_MODE", FileMode); err != nil {
+		errs = append(errs, err)
+	}
+	for status, name := range map[int]string{http.StatusNotFound: "ERROR_PAGE_404", http.StatusForbidden: "ERROR_PAGE_403"} {
+		if file := os.Getenv(name); file != "" {
+			if err := loadErrorPage(status, file); err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s: %v", name, err))
+			}
+		}
+	}
+	if s := os.Getenv("ROOT_RESPONSE"); s != "" {
+		if !json.Valid([]byte(s)) {
+			errs = append(errs, fmt.Errorf("invalid ROOT_RESPONSE: expected a JSON document"))
+		}
+		RootResponse = []byte(s + "\n")
+	}
+	if MaxPathDepth, err = parseIntEnv("MAX_PATH_DEPTH", MaxPathDepth); err != nil {
+		errs = append(errs, err)
+	}
+	if MaxWalkDepth, err = parseLimitEnv("MAX_WALK_DEPTH", MaxWalkDepth); err != nil {
+		errs = append(errs, err)
+	}
+	if MaxNameLength, err = parseIntEnv("MAX_NAME_LENGTH", MaxNameLength); err != nil {
+		errs = append(errs, err)
+	}
+	if AllowBroadPathClaims, err = parseBoolEnv("ALLOW_BROAD_PATH_CLAIMS", AllowBroadPathClaims); err != nil {
+		errs = append(errs, err)
+	}
+	if MaxPathClaimLength, err = parseIntEnv("MAX_PATH_CLAIM_LENGTH", MaxPathClaimLength); err != nil {
+		errs = append(errs, err)
+	}
+	if MaxPathClaimDepth, err = parseIntEnv("MAX_PATH_CLAIM_DEPTH", MaxPathClaimDepth); err != nil {
+		errs = append(errs, err)
+	}
+	if MaxUploadBytes, err = parseSizeEnv("MAX_UPLOAD_BYTES", MaxUploadBytes); err != nil {
+		errs = append(errs, err)
+	}
+	if MaxUploadsPerToken, err = parseLimitEnv("MAX_UPLOADS_PER_TOKEN", MaxUploadsPerToken); err != nil {
+		errs = append(errs, err)
+	}
+	if IntrospectRateLimit, err = parseIntEnv("INTROSPECT_RATE_LIMIT", IntrospectRateLimit); err != nil {
+		errs = append(errs, err)
+	}
+	if ReadHeaderTimeout, err = parseDurationEnv("READ_HEADER_TIMEOUT", ReadHeaderTimeout); err != nil {
+		errs = append(errs, err)
+	}
+	if ReadTimeout, err = parseDurationEnv("READ_TIMEOUT", ReadTimeout); err != nil {
+		errs = append(errs, err)
+	}
+	if BodyReadTimeout, err = parseDurationEnv("BODY_READ_TIMEOUT", BodyReadTimeout); err != nil {
+		errs = append(errs, err)
+	}
+	if MinUploadRate, err = parseSizeEnv("MIN_UPLOAD_RATE", MinUploadRate); err != nil {
+		errs = append(errs, err)
+	}
+	if WriteTimeout, err = parseDurationEnv("WRITE_TIMEOUT", WriteTimeout); err != nil {
+		errs = append(errs, err)
+	}
+	if IdleTimeout, err = parseDurationEnv("IDLE_TIMEOUT", IdleTimeout); err != nil {
+		errs = append(errs, err)
+	}
+	if MaxHeaderBytes, err = parseIntEnv("MAX_HEADER_BYTES", MaxHeaderBytes); err != nil {
+		errs = append(errs, err)
+	}
+	if MaxURILength, err = parseIntEnv("MAX_URI_LENGTH", MaxURILength); err != nil {
+		errs = append(errs, err)
+	}
+	TLSCert, TLSKey = os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY")
+	if (TLSCert == "") != (TLSKey == "") {
+		errs = append(errs, fmt.Errorf("TLS_CERT and TLS_KEY must be set together"))
+	}
+	if H2C, err = parseBoolEnv("H2C", H2C); err != nil {
+		errs = append(errs, err)
+	}
+	if H2C && TLSCert != "" {
+		errs = append(errs, fmt.Errorf("H2C cannot be combined with TLS_CERT, which already negotiates HTTP/2"))
+	}
+	if s := os.Getenv("TMP_DIR"); s != "" {
+		TmpDir = s
+	}
+	switch s := os.Getenv("ETAG_MODE"); s {
+	case "":
+	case "weak", "strong":
+		ETagMode = s
+	default:
+		errs = append(errs, fmt.Errorf("invalid ETAG_MODE %q: expected weak or strong", s))
+	}
+	if PartUploadTTL, err = parseDurationEnv("PART_UPLOAD_TTL", PartUploadTTL); err != nil {
+		errs = append(errs, err)
+	}
+	if Quarantine, err = parseBoolEnv("QUARANTINE", Quarantine); err != nil {
+		errs = append(errs, err)
+	}
+	if QuarantineTTL, err = parseDurationEnv("QUARANTINE_TTL", QuarantineTTL); err != nil {
+		errs = append(errs, err)
+	}
+	if StorageQuotaBytes, err = parseSizeEnv("STORAGE_QUOTA_BYTES", StorageQuotaBytes); err != nil {
+		errs = append(errs, err)
+	}
+	if MaxDirEntries, err = parseLimitEnv("MAX_DIR_ENTRIES", MaxDirEntries); err != nil {
+		errs = append(errs, err)
+	}
+	if IdempotencyTTL, err = parseDurationEnv("IDEMPOTENCY_TTL", IdempotencyTTL); err != nil {
+		errs = append(errs, err)
+	}
+	if s := os.Getenv("IDEMPOTENCY_FILE"); s != "" {
+		IdempotencyFile = s
+	}
+	if AliasTTL, err = parseDurationEnv("ALIAS_TTL", AliasTTL); err != nil {
+		errs = append(errs, err)
+	}
+	if s := os.Getenv("ALIAS_FILE"); s != "" {
+		AliasFile = s
+	}
+	if ShareTTL, err = parseDurationEnv("SHARE_TTL", ShareTTL); err != nil {
+		errs = append(errs, err)
+	}
+	if ShareMaxTTL, err = parseDurationEnv("SHARE_MAX_TTL", ShareMaxTTL); err != nil {
+		errs = append(errs, err)
+	}
+	if ShareTTL > ShareMaxTTL {
+		errs = append(errs, fmt.Errorf("SHARE_TTL %s exceeds SHARE_MAX_TTL %s", ShareTTL, ShareMaxTTL))
+	}
+	if s := os.Getenv("SHARE_FILE"); s != "" {
+		ShareFile = s
+	}
+	if s := os.Getenv("ACCEL_REDIRECT_PREFIX"); s != "" {
+		if !strings.HasPrefix(s, "/") {
+			errs = append(errs, fmt.Errorf("invalid ACCEL_REDIRECT_PREFIX %q: must start with /", s))
+		}
+		AccelRedirectPrefix = s
+	}
+	if s := os.Getenv("PATH_ALIASES"); s != "" {
+		for _, item := range splitList(s) {
+			alias, target, ok := strings.Cut(item, "=")
+			alias, target = strings.Trim(alias, "/"), strings.Trim(target, "/")
+			if !ok || alias == "" || target == "" || checkCanonicalPath("/"+alias) != nil || checkCanonicalPath("/"+target) != nil {
+				errs = append(errs, fmt.Errorf("invalid PATH_ALIASES entry %q: expected alias=target with both non-empty paths", item))
+				continue
+			}
+			PathAliases[alias] = target
+		}
+		for alias, target := range PathAliases {
+			if canonicalPath(target) != target {
+				errs = append(errs, fmt.Errorf("invalid PATH_ALIASES: %s points into another alias", alias))
+			}
+		}
+	}
+	if s := os.Getenv("STORAGE_VOLUMES"); s != "" {
+		// Compared as absolute paths, so ./storage and its absolute spelling
+		// are caught as the same root
+		abs := func(p string) string {
+			if a, err := filepath.Abs(p); err == nil {
+				return a
+			}
+			return filepath.Clean(p)
+		}
+		root := abs(StorageDir)
+		var seen []string
+		StorageVolumes = nil
+		for _, v := range splitList(s) {
+			v = filepath.Clean(v)
+			a := abs(v)
+			switch {
+			case a == root:
+				errs = append(errs, fmt.Errorf("invalid STORAGE_VOLUMES: %s is the storage directory itself", v))
+				continue
+			case strings.HasPrefix(a, root+string(filepath.Separator)), strings.HasPrefix(root, a+string(filepath.Separator)):
+				errs = append(errs, fmt.Errorf("invalid STORAGE_VOLUMES: %s overlaps the storage directory %s", v, StorageDir))
+				continue
+			}
+			dup := false
+			for _, other := range seen {
+				if a == other {
+					errs = append(errs, fmt.Errorf("invalid STORAGE_VOLUMES: %s is listed twice", v))
+					dup = true
+				} else if strings.HasPrefix(a, other+string(filepath.Separator)) || strings.HasPrefix(other, a+string(filepath.Separator)) {
+					errs = append(errs, fmt.Errorf("invalid STORAGE_VOLUMES: %s overlaps %s", v, other))
+				}
+			}
+			if !dup {
+				seen = append(seen, a)
+				StorageVolumes = append(StorageVolumes, v)
+			}
+		}
+		if AccelRedirectPrefix != "" {
+			errs = append(errs, fmt.Errorf("ACCEL_REDIRECT_PREFIX cannot be combined with STORAGE_VOLUMES"))
+		}
+	}
+	if s := os.Getenv("ADMIN_SECRET"); s != "" {
+		AdminSecret = s
+	}
+	if s := os.Getenv("PREFIX_CONFIG"); s != "" {
+		PrefixConfig = s
+	}
+	if s := os.Getenv("PUBLIC_READ_PREFIXES"); s != "" {
+		PublicReadPrefixes = splitList(s)
+	}
+	if s := os.Getenv("CORS_ORIGINS"); s != "" {
+		CORSOrigins = splitList(s)
+	}
+	if s, ok := os.LookupEnv("CORS_EXPOSE_HEADERS"); ok {
+		CORSExposeHeaders = splitList(s)
+	}
+	if s := os.Getenv("PATH_TEMPLATE"); s != "" {
+		if !strings.Contains(s, "{sub}") {
+			errs = append(errs, fmt.Errorf("invalid PATH_TEMPLATE %q: expected a {sub} placeholder", s))
+		} else if _, err := regexp.Compile(strings.ReplaceAll(s, "{sub}", "sub")); err != nil {
+			errs = append(errs, fmt.Errorf("invalid PATH_TEMPLATE %q: %v", s, err))
+		}
+		PathTemplate = s
+	}
+	if s := os.Getenv("METADATA_STORE"); s != "" {
+		MetadataStoreKind = s
+	}
+	if s := os.Getenv("METADATA_DB"); s != "" {
+		MetadataDB = s
+	}
+	if s := os.Getenv("AUDIT_LOG"); s != "" {
+		AuditLog = s
+	}
+	if AuditMaxBytes, err = parseSizeEnv("AUDIT_MAX_BYTES", AuditMaxBytes); err != nil {
+		errs = append(errs, err)
+	}
+	if s := os.Getenv("AUDIT_WEBHOOK"); s != "" {
+		AuditWebhook = s
+	}
+	if DeleteMissingOK, err = parseBoolEnv("DELETE_MISSING_OK", DeleteMissingOK); err != nil {
+		errs = append(errs, err)
+	}
+	if HideForbidden, err = parseBoolEnv("HIDE_FORBIDDEN", HideForbidden); err != nil {
+		errs = append(errs, err)
+	}
+	if PathPlaceholders, err = parseBoolEnv("PATH_PLACEHOLDERS", PathPlaceholders); err != nil {
+		errs = append(errs, err)
+	}
+	if ReadOnly, err = parseBoolEnv("READ_ONLY", ReadOnly); err != nil {
+		errs = append(errs, err)
+	}
+	if Debug, err = parseBoolEnv("DEBUG", Debug); err != nil {
+		errs = append(errs, err)
+	}
+	if s := os.Getenv("CACHE_CONTROL"); s != "" {
+		CacheControl = s
+	}
+	if s := os.Getenv("CACHE_CONTROL_PUBLIC"); s != "" {
+		CacheControlPublic = s
+	}
+	if s := os.Getenv("DEFAULT_CONTENT_TYPE"); s != "" {
+		if _, _, err := mime.ParseMediaType(s); err != nil {
+			errs = append(errs, fmt.Errorf("invalid DEFAULT_CONTENT_TYPE %q: %v", s, err))
+		}
+		DefaultContentType = s
+	}
+	if GzipStatic, err = parseBoolEnv("GZIP_STATIC", GzipStatic); err != nil {
+		errs = append(errs, err)
+	}
+	if BrotliStatic, err = parseBoolEnv("BROTLI_STATIC", BrotliStatic); err != nil {
+		errs = append(errs, err)
+	}
+	if Brotli, err = parseBoolEnv("BROTLI", Brotli); err != nil {
+		errs = append(errs, err)
+	}
+	if CompressDownloads, err = parseBoolEnv("COMPRESS_DOWNLOADS", CompressDownloads); err != nil {
+		errs = append(errs, err)
+	}
+	if s := os.Getenv("COMPRESS_TYPES"); s != "" {
+		CompressTypes = splitList(s)
+	}
+	if DirectoryIndex, err = parseBoolEnv("DIRECTORY_INDEX", DirectoryIndex); err != nil {
+		errs = append(errs, err)
+	}
+	if ShareOpenFiles, err = parseBoolEnv("SHARE_OPEN_FILES", ShareOpenFiles); err != nil {
+		errs = append(errs, err)
+	}
+	if WatchStorage, err = parseBoolEnv("WATCH_STORAGE", WatchStorage); err != nil {
+		errs = append(errs, err)
+	}
+	if WatchDebounce, err = parseDurationEnv("WATCH_DEBOUNCE", WatchDebounce); err != nil {
+		errs = append(errs, err)
+	}
+	if SlowRequestThreshold, err = parseDurationEnv("SLOW_REQUEST_THRESHOLD", SlowRequestThreshold); err != nil {
+		errs = append(errs, err)
+	}
+	if UIEnabled, err = parseBoolEnv("UI_ENABLED", UIEnabled); err != nil {
+		errs = append(errs, err)
+	}
+	if MetricsEnabled, err = parseBoolEnv("METRICS_ENABLED", MetricsEnabled); err != nil {
+		errs = append(errs, err)
+	}
+	if s := os.Getenv("METRICS_SIZE_BUCKETS"); s != "" {
+		var buckets []float64
+		for _, item := range splitList(s) {
+			v, err := strconv.ParseInt(item, 10, 64)
+			if err != nil || v <= 0 || (len(buckets) > 0 && float64(v) <= buckets[len(buckets)-1]) {
+				errs = append(errs, fmt.Errorf("invalid METRICS_SIZE_BUCKETS %q: expected ascending sizes in bytes", s))
+				buckets = nil
+				break
+			}
+			buckets = append(buckets, float64(v))
+		}
+		if buckets != nil {
+			SizeBuckets = buckets
+		}
+	}
+	if MaxDownloadDuration, err = parseDurationEnv("MAX_DOWNLOAD_DURATION", MaxDownloadDuration); err != nil {
+		errs = append(errs, err)
+	}
+	if RequestTimeout, err = parseDurationEnv("REQUEST_TIMEOUT", RequestTimeout); err != nil {
+		errs = append(errs, err)
+	}
+	if DownloadFlushInterval, err = parseDurationEnv("DOWNLOAD_FLUSH_INTERVAL", DownloadFlushInterval); err != nil {
+		errs = append(errs, err)
+	}
+	if DecompressOnDemand, err = parseBoolEnv("DECOMPRESS_ON_DEMAND", DecompressOnDemand); err != nil {
+		errs = append(errs, err)
+	}
+	if NormalizeUnicode, err = parseBoolEnv("NORMALIZE_UNICODE", NormalizeUnicode); err != nil {
+		errs = append(errs, err)
+	}
+	switch s := os.Getenv("FSYNC_POLICY"); s {
+	case "":
+	case "always", "batch", "never":
+		FsyncPolicy = s
+	default:
+		errs = append(errs, fmt.Errorf("invalid FSYNC_POLICY %q: expected always, batch or never", s))
+	}
+	if FsyncInterval, err = parseDurationEnv("FSYNC_INTERVAL", FsyncInterval); err != nil {
+		errs = append(errs, err)
+	}
+	if FsyncInterval <= 0 {
+		errs = append(errs, fmt.Errorf("invalid FSYNC_INTERVAL %s: must be positive", FsyncInterval))
+	}
+	switch s := os.Getenv("KEY_CASE"); s {
+	case "":
+	case "sensitive", "lower", "reject":
+		KeyCase = s
+	default:
+		errs = append(errs, fmt.Errorf("invalid KEY_CASE %q: expected sensitive, lower or reject", s))
+	}
+	if TruncateExtend, err = parseBoolEnv("TRUNCATE_EXTEND", TruncateExtend); err != nil {
+		errs = append(errs, err)
+	}
+	if ConfigDump, err = parseBoolEnv("CONFIG_DUMP", ConfigDump); err != nil {
+		errs = append(errs, err)
+	}
+	if RequireSecret, err = parseBoolEnv("REQUIRE_SECRET", RequireSecret); err != nil {
+		errs = append(errs, err)
+	}
+
+	// Limits that parse fine alone but contradict each other
+	if len(Secret) == 0 {
+		errs = append(errs, fmt.Errorf("SECRET must not be empty"))
+	}
+	if string(Secret) == defaultSecret && RequireSecret {
+		errs = append(errs, fmt.Errorf("SECRET is the built-in default and REQUIRE_SECRET is set; set your own SECRET"))
+	}
+	if ReadTimeout > 0 && ReadHeaderTimeout > ReadTimeout {
+		errs = append(errs, fmt.Errorf("READ_HEADER_TIMEOUT %s exceeds READ_TIMEOUT %s", ReadHeaderTimeout, ReadTimeout))
+	}
+	if MaxURILength > MaxHeaderBytes {
+		errs = append(errs, fmt.Errorf("MAX_URI_LENGTH %d exceeds MAX_HEADER_BYTES %d, which includes the request line", MaxURILength, MaxHeaderBytes))
+	}
+	if MaxUploadBytes > 0 && StorageQuotaBytes > 0 && MaxUploadBytes > StorageQuotaBytes {
+		errs = append(errs, fmt.Errorf("MAX_UPLOAD_BYTES %d exceeds STORAGE_QUOTA_BYTES %d", MaxUploadBytes, StorageQuotaBytes))
+	}
+	return errs
+}
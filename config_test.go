@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run loadConfig with env set, restoring the settings it may change
+func loadConfigWith(t *testing.T, env map[string]string) configErrors {
+	t.Helper()
+	prevSecret, prevRequire := Secret, RequireSecret
+	prevHeader, prevRead := ReadHeaderTimeout, ReadTimeout
+	prevHeaderBytes, prevURI := MaxHeaderBytes, MaxURILength
+	t.Cleanup(func() {
+		Secret, RequireSecret = prevSecret, prevRequire
+		ReadHeaderTimeout, ReadTimeout = prevHeader, prevRead
+		MaxHeaderBytes, MaxURILength = prevHeaderBytes, prevURI
+	})
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	return loadConfig()
+}
+
+func TestLoadConfigDefaultSecret(t *testing.T) {
+	Secret = []byte(defaultSecret)
+	if errs := loadConfigWith(t, nil); len(errs) != 0 {
+		t.Fatalf("default secret refused without REQUIRE_SECRET: %v", errs)
+	}
+	errs := loadConfigWith(t, map[string]string{"REQUIRE_SECRET": "true"})
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "SECRET is the built-in default") {
+		t.Fatalf("errors %v", errs)
+	}
+	Secret = []byte("my-own-secret")
+	if errs := loadConfigWith(t, map[string]string{"REQUIRE_SECRET": "true"}); len(errs) != 0 {
+		t.Fatalf("own secret refused: %v", errs)
+	}
+}
+
+func TestLoadConfigListsEveryProblem(t *testing.T) {
+	Secret = []byte("my-own-secret")
+	errs := loadConfigWith(t, map[string]string{
+		"READ_TIMEOUT":        "5s",
+		"READ_HEADER_TIMEOUT": "10s",
+		"MAX_HEADER_BYTES":    "1024",
+		"MAX_URI_LENGTH":      "4096",
+		"REQUIRE_SECRET":      "maybe",
+	})
+	for _, want := range []string{
+		"READ_HEADER_TIMEOUT 10s exceeds READ_TIMEOUT 5s",
+		"MAX_URI_LENGTH 4096 exceeds MAX_HEADER_BYTES 1024",
+		"REQUIRE_SECRET",
+	} {
+		if !strings.Contains(errs.Error(), want) {
+			t.Errorf("missing %q in:\n%v", want, errs)
+		}
+	}
+	if len(errs) != 3 {
+		t.Fatalf("%d problems, want 3:\n%v", len(errs), errs)
+	}
+	if ReadTimeout != 5*time.Second {
+		t.Fatalf("READ_TIMEOUT parsed as %s", ReadTimeout)
+	}
+}
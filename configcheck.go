@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// With CONFIG_DUMP, the effective value of every setting is printed at
+// startup so operators can confirm what the server runs with. Secrets are
+// replaced by their length.
+var ConfigDump = false // override with CONFIG_DUMP
+
+// Every problem found in the configuration, reported together so a
+// misconfigured deployment is fixed in one pass instead of one per restart
+type configErrors []error
+
+func (e configErrors) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "invalid configuration (%d problem", len(e))
+	if len(e) != 1 {
+		b.WriteString("s")
+	}
+	b.WriteString("):")
+	for i, err := range e {
+		fmt.Fprintf(&b, "\n  %d. %v", i+1, err)
+	}
+	return b.String()
+}
+
+// Each storage root must exist (or be creatable) and accept new files, or
+// every upload would fail once traffic arrives
+func checkStorageWritable() configErrors {
+	var errs configErrors
+	for _, dir := range append([]string{StorageDir}, StorageVolumes...) {
+		if err := os.MkdirAll(dir, DirMode); err != nil {
+			errs = append(errs, fmt.Errorf("storage directory %s cannot be created: %v", dir, err))
+			continue
+		}
+		f, err := createTemp(dir)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("storage directory %s is not writable: %v", dir, err))
+			continue
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
+	return errs
+}
+
+func redactSecret(s string) string {
+	if s == "" {
+		return ""
+	}
+	return fmt.Sprintf("<redacted, length %d>", len(s))
+}
+
+// A webhook URL may carry credentials in its userinfo or query
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return redactSecret(s)
+	}
+	if u.User != nil {
+		u.User = url.User("redacted")
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "redacted"
+	}
+	return u.String()
+}
+
+func dumpConfig() {
+	settings := map[string]any{
+		"SECRET":                  redactSecret(string(Secret)),
+		"ADMIN_SECRET":            redactSecret(AdminSecret),
+		"AUDIT_WEBHOOK":           redactURL(AuditWebhook),
+		"ACCEL_REDIRECT_PREFIX":   AccelRedirectPrefix,
+		"ALIAS_FILE":              AliasFile,
+		"ALIAS_TTL":               AliasTTL,
+		"ALLOW_BROAD_PATH_CLAIMS": AllowBroadPathClaims,
+		"AUDIT_LOG":               AuditLog,
+		"AUDIT_MAX_BYTES":         AuditMaxBytes,
+		"BODY_READ_TIMEOUT":       BodyReadTimeout,
+		"BROTLI":                  Brotli,
+		"BROTLI_STATIC":           BrotliStatic,
+		"CACHE_CONTROL":           CacheControl,
+		"CACHE_CONTROL_PUBLIC":    CacheControlPublic,
+		"COMPRESS_DOWNLOADS":      CompressDownloads,
+		"COMPRESS_TYPES":          strings.Join(CompressTypes, ","),
+		"CORS_EXPOSE_HEADERS":     strings.Join(CORSExposeHeaders, ","),
+		"CORS_ORIGINS":            strings.Join(CORSOrigins, ","),
+		"DEBUG":                   Debug,
+		"DECOMPRESS_ON_DEMAND":    DecompressOnDemand,
+		"DEFAULT_CONTENT_TYPE":    DefaultContentType,
+		"DELETE_MISSING_OK":       DeleteMissingOK,
+		"DIRECTORY_INDEX":         DirectoryIndex,
+		"DIR_MODE":                fmt.Sprintf("%04o", DirMode),
+		"DOWNLOAD_FLUSH_INTERVAL": DownloadFlushInterval,
+		"ETAG_MODE":               ETagMode,
+		"FILE_MODE":               fmt.Sprintf("%04o", FileMode),
+		"FSYNC_INTERVAL":          FsyncInterval,
+		"FSYNC_POLICY":            FsyncPolicy,
+		"GZIP_STATIC":             GzipStatic,
+		"H2C":                     H2C,
+		"HIDE_FORBIDDEN":          HideForbidden,
+		"IDEMPOTENCY_FILE":        IdempotencyFile,
+		"IDEMPOTENCY_TTL":         IdempotencyTTL,
+		"IDLE_TIMEOUT":            IdleTimeout,
+		"INTROSPECT_RATE_LIMIT":   IntrospectRateLimit,
+		"KEY_CASE":                KeyCase,
+		"MAX_DIR_ENTRIES":         MaxDirEntries,
+		"MAX_DOWNLOAD_DURATION":   MaxDownloadDuration,
+		"MAX_HEADER_BYTES":        MaxHeaderBytes,
+		"MAX_NAME_LENGTH":         MaxNameLength,
+		"MAX_PATH_CLAIM_DEPTH":    MaxPathClaimDepth,
+		"MAX_PATH_CLAIM_LENGTH":   MaxPathClaimLength,
+		"MAX_PATH_DEPTH":          MaxPathDepth,
+		"MAX_UPLOADS_PER_TOKEN":   MaxUploadsPerToken,
+		"MAX_UPLOAD_BYTES":        MaxUploadBytes,
+		"MAX_URI_LENGTH":          MaxURILength,
+		"MAX_WALK_DEPTH":          MaxWalkDepth,
+		"METADATA_DB":             MetadataDB,
+		"METADATA_STORE":          MetadataStoreKind,
+		"METRICS_ENABLED":         MetricsEnabled,
+		"METRICS_SIZE_BUCKETS":    SizeBuckets,
+		"MIN_UPLOAD_RATE":         MinUploadRate,
+		"NORMALIZE_UNICODE":       NormalizeUnicode,
+		"PART_UPLOAD_TTL":         PartUploadTTL,
+		"PATH_ALIASES":            len(PathAliases),
+		"PATH_PLACEHOLDERS":       PathPlaceholders,
+		"PATH_TEMPLATE":           PathTemplate,
+		"PREFIX_CONFIG":           PrefixConfig,
+		"PUBLIC_READ_PREFIXES":    strings.Join(PublicReadPrefixes, ","),
+		"QUARANTINE":              Quarantine,
+		"QUARANTINE_TTL":          QuarantineTTL,
+		"READ_HEADER_TIMEOUT":     ReadHeaderTimeout,
+		"READ_ONLY":               ReadOnly,
+		"READ_TIMEOUT":            ReadTimeout,
+		"REQUEST_TIMEOUT":         RequestTimeout,
+		"REQUIRE_SECRET":          RequireSecret,
+		"SHARE_FILE":              ShareFile,
+		"SHARE_MAX_TTL":           ShareMaxTTL,
+		"SHARE_OPEN_FILES":        ShareOpenFiles,
+		"SHARE_TTL":               ShareTTL,
+		"SLOW_REQUEST_THRESHOLD":  SlowRequestThreshold,
+		"STORAGE_QUOTA_BYTES":     StorageQuotaBytes,
+		"STORAGE_VOLUMES":         strings.Join(StorageVolumes, ","),
+		"TLS_CERT":                TLSCert,
+		"TLS_KEY":                 TLSKey,
+		"TMP_DIR":                 TmpDir,
+		"TRUNCATE_EXTEND":         TruncateExtend,
+		"UI_ENABLED":              UIEnabled,
+		"WATCH_DEBOUNCE":          WatchDebounce,
+		"WATCH_STORAGE":           WatchStorage,
+		"WRITE_TIMEOUT":           WriteTimeout,
+	}
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Println("Effective configuration:")
+	for _, name := range names {
+		fmt.Printf("  %s=%v\n", name, settings[name])
+	}
+}
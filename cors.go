@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+var (
+	CORSOrigins       = []string{} // override with CORS_ORIGINS (comma separated, or *), empty disables CORS
+	CORSExposeHeaders = []string{  // override with CORS_EXPOSE_HEADERS (comma separated)
+		"ETag", "Last-Modified", "Content-Length", "Content-Range", "Accept-Ranges",
+		"Content-Encoding", "X-Checksum-SHA256", "Idempotent-Replayed", "Retry-After", "X-Object-ACL",
+		"X-Object-Retain-Until",
+	}
+)
+
+const corsAllowMethods = "GET, HEAD, PUT, POST, PATCH, DELETE, MOVE, MKCOL"
+
+func corsOriginAllowed(origin string) bool {
+	for _, o := range CORSOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add CORS headers for allowed origins and answer preflight requests
+// before they reach the token check
+func cors(next http.Handler) http.Handler {
+	if len(CORSOrigins) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !corsOriginAllowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Add("Vary", "Origin")
+		// Without this, fetch() cannot read checksums, ETags or ranges
+		h.Set("Access-Control-Expose-Headers", strings.Join(CORSExposeHeaders, ", "))
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", corsAllowMethods)
+			if req := r.Header.Get("Access-Control-Request-Headers"); req != "" {
+				h.Set("Access-Control-Allow-Headers", req)
+			}
+			h.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Uploads must deliver at least MinUploadRate bytes per second, checked over
+// each BodyReadTimeout window, or they are aborted with 408. With no rate set
+// a body that sends nothing for a whole window is aborted. Independent of
+// READ_TIMEOUT, which caps the whole request however fast it is.
+var (
+	BodyReadTimeout       = time.Duration(0) // override with BODY_READ_TIMEOUT, 0 disables
+	MinUploadRate   int64 = 0                // override with MIN_UPLOAD_RATE, bytes per second
+)
+
+var errSlowUpload = errors.New("upload body stalled below the minimum rate")
+
+// Reader that stops as soon as the request context is canceled, so a
+// client disconnect aborts a copy promptly instead of draining dead I/O
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+type ctxReadCloser struct {
+	ctxReader
+	io.Closer
+}
+
+// ReadSeeker variant for http.ServeContent
+type ctxReadSeeker struct {
+	ctxReader
+	io.Seeker
+}
+
+func withContext(ctx context.Context, rs io.ReadSeeker) io.ReadSeeker {
+	return &ctxReadSeeker{ctxReader{ctx, rs}, rs}
+}
+
+// Make the request body honor cancellation of the request context
+func contextBody(r *http.Request) {
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &ctxReadCloser{ctxReader{r.Context(), r.Body}, r.Body}
+	}
+}
+
+// Enforce BodyReadTimeout and MinUploadRate on the request body
+func minRateBody(w http.ResponseWriter, r *http.Request) {
+	if BodyReadTimeout > 0 && r.Body != nil && r.Body != http.NoBody {
+		need := MinUploadRate * int64(BodyReadTimeout/time.Second)
+		if need < 1 {
+			need = 1
+		}
+		r.Body = &minRateReader{ReadCloser: r.Body, rc: http.NewResponseController(w), need: need}
+	}
+}
+
+// Each window must bring in need bytes; a new window starts as soon as it
+// does. The connection read deadline marks the end of the current window so
+// a body that stops sending entirely is cut off too.
+type minRateReader struct {
+	io.ReadCloser
+	rc      *http.ResponseController
+	need    int64
+	started bool
+	end     time.Time
+	got     int64
+}
+
+func (m *minRateReader) startWindow(now time.Time) {
+	m.end, m.got = now.Add(BodyReadTimeout), 0
+	m.rc.SetReadDeadline(m.end)
+}
+
+func (m *minRateReader) Read(p []byte) (int, error) {
+	// The clock starts at the first read, which is also when the server
+	// answers Expect: 100-continue, so waiting on that does not count
+	if !m.started {
+		m.started = true
+		m.startWindow(now())
+	}
+	n, err := m.ReadCloser.Read(p)
+	m.got += int64(n)
+	now := now()
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded), err == nil && m.got < m.need && now.After(m.end):
+		return n, errSlowUpload
+	case err != nil:
+		m.rc.SetReadDeadline(time.Time{}) // leave the connection as we found it
+	case m.got >= m.need:
+		m.startWindow(now)
+	}
+	return n, err
+}
+
+// Count a transfer aborted because the client went away
+func noteCanceled(r *http.Request, direction string) {
+	if r.Context().Err() != nil {
+		transfersCanceled.WithLabelValues(direction).Inc()
+	}
+}
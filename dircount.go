@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Cap on entries (files and subdirectories) directly inside one directory,
+// to avoid the "100k files in one dir" cliff. Counts are cached per
+// directory and adjusted on writes instead of re-reading the directory.
+var MaxDirEntries = 0 // override with MAX_DIR_ENTRIES, 0 disables
+
+var (
+	dirCountMu sync.Mutex
+	dirCounts  = map[string]int{}
+	errDirFull = errors.New("directory is full")
+)
+
+// Visible entries in dir, from cache or a one-time ReadDir
+func dirEntryCount(dir string) int {
+	dirCountMu.Lock()
+	defer dirCountMu.Unlock()
+	if n, ok := dirCounts[dir]; ok {
+		return n
+	}
+	entries, _ := readStorageDir(dir)
+	n := 0
+	for _, e := range entries {
+		if !isReservedName(e.Name()) && !isDirIndex(e.Name()) {
+			n++
+		}
+	}
+	dirCounts[dir] = n
+	return n
+}
+
+// Refuse creating a new object in a directory that is already at the cap
+func checkDirCapacity(dest string) error {
+	if MaxDirEntries <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(dest); err == nil {
+		return nil // overwrites do not add entries
+	}
+	if dirEntryCount(storageParent(dest)) >= MaxDirEntries {
+		return errDirFull
+	}
+	return nil
+}
+
+// Adjust the cached count of dest's directory by delta, if it is cached,
+// along with the object counts of the scopes containing it
+func noteDirEntry(dest string, delta int) {
+	noteObjectCount(dest, int64(delta))
+	dirCountMu.Lock()
+	defer dirCountMu.Unlock()
+	if n, ok := dirCounts[storageParent(dest)]; ok {
+		dirCounts[storageParent(dest)] = n + delta
+	}
+}
+
+// Drop cached counts for dir and its ancestors after directories were created or removed
+func invalidateDirCounts(dir string) {
+	dirCountMu.Lock()
+	defer dirCountMu.Unlock()
+	stop := filepath.Clean(StorageDir)
+	for {
+		delete(dirCounts, dir)
+		if dir == stop || dir == storageParent(dir) {
+			return
+		}
+		dir = storageParent(dir)
+	}
+}
+
+func writeDirFullError(w http.ResponseWriter, r *http.Request, dest string) {
+	writeError(w, r, http.StatusConflict, errorEnvelope{
+		Code:  "directory_full",
+		Error: "Directory has reached its entry limit, store new objects in a subdirectory",
+		Limit: int64(MaxDirEntries),
+		Usage: int64(dirEntryCount(storageParent(dest))),
+	})
+}
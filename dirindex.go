@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// With DIRECTORY_INDEX, every directory keeps an index.json holding its
+// listing, rebuilt after something in it changes, so a CDN in front of the
+// server can answer listings as plain cached GETs of dir/index.json.
+// The file is left out of listings, and no write, move or delete may use
+// that name. Indexes are only written when something changes: a directory
+// untouched since DIRECTORY_INDEX was turned on has none until its next
+// write. Reading one needs the listing permission of its directory.
+//
+// A change only marks the indexes above it stale; they are rebuilt together
+// every dirIndexDelay, or right away when one is fetched through the server,
+// so uploads never wait on index writes.
+var DirectoryIndex = false // override with DIRECTORY_INDEX
+
+const (
+	dirIndexName  = "index.json"
+	dirIndexDelay = time.Second
+)
+
+var errReservedName = errors.New(dirIndexName + " is generated by the server")
+
+var (
+	dirIndexMu     sync.Mutex // guards staleIndexes
+	staleIndexes   = map[string]struct{}{}
+	dirIndexLoopOn bool
+
+	// Serializes rebuilds, so the last write of an index reflects the
+	// state after the last change
+	dirIndexGenMu sync.Mutex
+)
+
+func isDirIndex(name string) bool {
+	return DirectoryIndex && name == dirIndexName
+}
+
+// Refuse writing, moving or deleting an object under the index's name
+func checkReservedName(p string) error {
+	if isDirIndex(filepath.Base(p)) {
+		return errReservedName
+	}
+	return nil
+}
+
+// Where the index of the storage directory dir lives
+func dirIndexPath(dir string) string {
+	return storagePath(path.Join(storageRel(dir), dirIndexName))
+}
+
+// Mark the index of dir and of each directory above it stale, since their
+// listings may have gained or lost an entry too
+func refreshDirIndexes(dir string) {
+	if !DirectoryIndex {
+		return
+	}
+	root := filepath.Clean(StorageDir)
+	dirIndexMu.Lock()
+	defer dirIndexMu.Unlock()
+	for !isInternalPath(dir) {
+		staleIndexes[dir] = struct{}{}
+		if dir == root || !insideStorage(dir) {
+			break
+		}
+		dir = storageParent(dir)
+	}
+	if !dirIndexLoopOn {
+		dirIndexLoopOn = true
+		go dirIndexLoop()
+	}
+}
+
+func dirIndexLoop() {
+	for range time.Tick(dirIndexDelay) {
+		dirIndexMu.Lock()
+		dirs := staleIndexes
+		staleIndexes = map[string]struct{}{}
+		dirIndexMu.Unlock()
+		for dir := range dirs {
+			rebuildDirIndex(dir)
+		}
+	}
+}
+
+// Bring the index of dir up to date before it is served, if it is stale
+func freshDirIndex(dir string) {
+	dirIndexMu.Lock()
+	_, stale := staleIndexes[dir]
+	delete(staleIndexes, dir)
+	dirIndexMu.Unlock()
+	if stale {
+		rebuildDirIndex(dir)
+	}
+}
+
+// Directories that are gone are skipped
+func rebuildDirIndex(dir string) {
+	dirIndexGenMu.Lock()
+	defer dirIndexGenMu.Unlock()
+	if err := writeDirIndex(dir); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("warning: failed to write %s: %v\n", dirIndexPath(dir), err)
+	}
+}
+
+// Marks an index.json as the server's, so a user file of that name is
+// never overwritten
+const dirIndexGenerator = "objectstorage"
+
+type dirIndex struct {
+	Path      string      `json:"path"`
+	Entries   []listEntry `json:"entries"`
+	Generator string      `json:"generator"`
+}
+
+// Whether the index.json at p was written by the server
+func isGeneratedIndex(p string) bool {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return false
+	}
+	var idx dirIndex
+	return json.Unmarshal(data, &idx) == nil && idx.Generator == dirIndexGenerator
+}
+
+// Caller holds dirIndexGenMu
+func writeDirIndex(dir string) error {
+	target := dirIndexPath(dir)
+	if _, err := os.Stat(target); err == nil && !isGeneratedIndex(target) {
+		return fmt.Errorf("%s exists and was not generated by the server, leaving it alone", storageRel(target))
+	}
+	list, err := readListing(context.Background(), dir, false)
+	if err != nil {
+		return err
+	}
+	rel := "" // as GET dir/ names it
+	if r := storageRel(dir); r != "." {
+		rel = r + "/"
+	}
+	data, err := json.Marshal(dirIndex{Path: rel, Entries: list, Generator: dirIndexGenerator})
+	if err != nil {
+		return err
+	}
+	tmp, err := createTemp(filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(append(data, '\n'))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	noteOwnWrite(target)
+	return storageFS.Rename(tmp.Name(), target)
+}
+
+// Objects already stored under the index's name, which DIRECTORY_INDEX
+// would hide from listings and refuse to delete; startup refuses them
+func checkDirIndexNames() error {
+	if !DirectoryIndex {
+		return nil
+	}
+	var found []string
+	walkStorage(filepath.Clean(StorageDir), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() && isReservedName(d.Name()) {
+			return filepath.SkipDir
+		}
+		if d.Name() == dirIndexName && d.Type().IsRegular() && !isGeneratedIndex(p) {
+			found = append(found, storageRel(p))
+		}
+		return nil
+	})
+	if len(found) == 0 {
+		return nil
+	}
+	return fmt.Errorf("DIRECTORY_INDEX is set but these objects already use the name %s; rename them first: %v", dirIndexName, found)
+}
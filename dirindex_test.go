@@ -0,0 +1,130 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func withDirectoryIndex(t *testing.T) {
+	t.Helper()
+	prev := DirectoryIndex
+	DirectoryIndex = true
+	t.Cleanup(func() { DirectoryIndex = prev })
+}
+
+// Codes of a batch response's items, in order
+func batchCodes(t *testing.T, resp *http.Response) []string {
+	t.Helper()
+	var body struct {
+		Files []batchResult `json:"files"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	var codes []string
+	for _, f := range body.Files {
+		codes = append(codes, f.Code)
+	}
+	return codes
+}
+
+func TestDirIndexNameReservedOnEveryWritePath(t *testing.T) {
+	withDirectoryIndex(t)
+	srv := newTestServer(t)
+	base := srv.URL + "/" + testToken(t, "^/data/.*")
+
+	var tarBody bytes.Buffer
+	tw := tar.NewWriter(&tarBody)
+	tw.WriteHeader(&tar.Header{Name: "index.json", Mode: 0644, Size: 2, Typeflag: tar.TypeReg})
+	tw.Write([]byte("{}"))
+	tw.Close()
+	resp := doRequest(t, http.MethodPost, base+"/data/?import=tar", tarBody.String())
+	if codes := batchCodes(t, resp); len(codes) != 1 || codes[0] != "reserved_name" {
+		t.Fatalf("tar import: codes %v", codes)
+	}
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	part, _ := mw.CreateFormFile("f", "index.json")
+	part.Write([]byte("{}"))
+	mw.Close()
+	req, _ := http.NewRequest(http.MethodPost, base+"/data/", &form)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if codes := batchCodes(t, resp); len(codes) != 1 || codes[0] != "reserved_name" {
+		t.Fatalf("multipart: codes %v", codes)
+	}
+
+	// The server's own index survives a batch delete naming it
+	doRequest(t, http.MethodPut, base+"/data/a.txt", "a")
+	if resp := doRequest(t, http.MethodGet, base+"/data/index.json", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET index: status %d", resp.StatusCode)
+	}
+	resp = doRequest(t, http.MethodPost, base+"/data/?delete", `{"paths": ["index.json"]}`)
+	if codes := batchCodes(t, resp); len(codes) != 1 || codes[0] != "reserved_name" {
+		t.Fatalf("batch delete: codes %v", codes)
+	}
+	if _, err := os.Stat(filepath.Join(StorageDir, "data", "index.json")); err != nil {
+		t.Fatalf("index removed: %v", err)
+	}
+}
+
+func TestDirIndexRebuiltWhenFetched(t *testing.T) {
+	withDirectoryIndex(t)
+	srv := newTestServer(t)
+	base := srv.URL + "/" + testToken(t, "^/data/.*")
+
+	doRequest(t, http.MethodPut, base+"/data/a.txt", "a")
+	doRequest(t, http.MethodPut, base+"/data/b.txt", "b")
+	resp := doRequest(t, http.MethodGet, base+"/data/index.json", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET index: status %d", resp.StatusCode)
+	}
+	var idx dirIndex
+	if err := json.NewDecoder(resp.Body).Decode(&idx); err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Entries) != 2 || idx.Entries[0].Name != "a.txt" || idx.Entries[1].Name != "b.txt" {
+		t.Fatalf("index entries %+v", idx.Entries)
+	}
+}
+
+func TestDirIndexLeavesUserFilesAlone(t *testing.T) {
+	StorageDir = t.TempDir()
+	metaStore = sidecarStore{}
+	user := filepath.Join(StorageDir, "docs", "index.json")
+	os.MkdirAll(filepath.Dir(user), 0755)
+	os.WriteFile(user, []byte(`{"mine": true}`), 0644)
+
+	withDirectoryIndex(t)
+	err := checkDirIndexNames()
+	if err == nil || !strings.Contains(err.Error(), "docs/index.json") {
+		t.Fatalf("startup check = %v, want the user file named", err)
+	}
+	if err := writeDirIndex(filepath.Dir(user)); err == nil {
+		t.Fatal("index written over a user file")
+	}
+	if b, _ := os.ReadFile(user); string(b) != `{"mine": true}` {
+		t.Fatalf("user file now holds %s", b)
+	}
+
+	// Indexes the server wrote itself pass the startup check
+	os.Remove(user)
+	if err := writeDirIndex(filepath.Dir(user)); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkDirIndexNames(); err != nil {
+		t.Fatalf("startup check refused a generated index: %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sync"
+)
+
+// Recursive directory sizes for ?sizes=true listings. Walking is expensive,
+// so totals are cached per directory and dropped for every ancestor of a
+// path whose contents change.
+var (
+	dirSizeMu  sync.Mutex
+	dirSizes   = map[string]int64{}
+	dirSizeGen uint64 // bumped on invalidation so a walk racing a write is not cached
+)
+
+const dirSizeCacheMax = 10000
+
+// Total bytes of the objects below dir, sidecars and internal files excluded
+func dirSize(dir string) int64 {
+	dirSizeMu.Lock()
+	n, ok := dirSizes[dir]
+	gen := dirSizeGen
+	dirSizeMu.Unlock()
+	if ok {
+		return n
+	}
+
+	walkStorage(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if p != dir && (isReservedName(d.Name()) || isDirIndex(d.Name())) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				n += info.Size()
+			}
+		}
+		return nil
+	})
+
+	dirSizeMu.Lock()
+	if gen == dirSizeGen {
+		if len(dirSizes) >= dirSizeCacheMax {
+			dirSizes = map[string]int64{}
+		}
+		dirSizes[dir] = n
+	}
+	dirSizeMu.Unlock()
+	return n
+}
+
+// Forget cached sizes of every directory containing path
+func invalidateDirSizes(path string) {
+	dirSizeMu.Lock()
+	defer dirSizeMu.Unlock()
+	dirSizeGen++
+	stop := filepath.Clean(StorageDir)
+	dir := storageParent(path)
+	for {
+		delete(dirSizes, dir)
+		if dir == stop || dir == storageParent(dir) {
+			return
+		}
+		dir = storageParent(dir)
+	}
+}
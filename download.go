@@ -0,0 +1,455 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	DecompressOnDemand    = true                       // override with DECOMPRESS_ON_DEMAND
+	GzipStatic            = false                      // override with GZIP_STATIC, serve "name.gz" siblings to gzip clients
+	BrotliStatic          = false                      // override with BROTLI_STATIC, serve "name.br" siblings to br clients
+	MaxDownloadDuration   = time.Duration(0)           // override with MAX_DOWNLOAD_DURATION, 0 disables the cap
+	DownloadFlushInterval = 5 * time.Second            // override with DOWNLOAD_FLUSH_INTERVAL
+	DefaultContentType    = "application/octet-stream" // override with DEFAULT_CONTENT_TYPE, for files neither the extension nor sniffing identifies
+
+	// Cache-Control sent with file downloads, so CDNs and browsers know how
+	// long to keep them before revalidating; empty sends none. A prefix
+	// policy's cacheControl takes precedence over both.
+	CacheControl       = "" // override with CACHE_CONTROL, e.g. private, no-store
+	CacheControlPublic = "" // override with CACHE_CONTROL_PUBLIC, for public-read prefixes and objects
+)
+
+// Set Last-Modified from the object's modtime and an explicit Date, both in
+// RFC 1123 GMT form, so every response carrying an object agrees on format
+func setTimeHeaders(w http.ResponseWriter, modTime time.Time) {
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Date", now().UTC().Format(http.TimeFormat))
+}
+
+// Serve a stored file for GET/HEAD, with Range support via http.ServeContent.
+// Directories get a JSON listing instead.
+func downloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) < 2 {
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	serveObject(w, r, parts[1])
+}
+
+// Serve the object (or directory listing) at a storage-relative path
+func serveObject(w http.ResponseWriter, r *http.Request, relPath string) {
+	target, err := resolvePath(relPath)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if isDirIndex(filepath.Base(target)) {
+		freshDirIndex(storageParent(target))
+	}
+
+	var f *os.File
+	if ShareOpenFiles && r.Method == http.MethodGet && r.Header.Get("Range") == "" && !r.URL.Query().Has("checksum") {
+		var release func()
+		if f, release, err = openShared(target); err == nil {
+			defer release()
+		}
+	} else if f, err = os.Open(target); err == nil {
+		defer f.Close()
+	}
+	if err != nil {
+		if !os.IsNotExist(err) || !redirectAlias(w, r, relPath, target) {
+			defaultHandler(w, r)
+		}
+		return
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		defaultHandler(w, r)
+		return
+	}
+	// Listings and X-Accel-Redirect name the real path behind an alias
+	relPath = canonicalRel(relPath)
+	if !checkReadClaims(w, r, target, info.IsDir()) {
+		return
+	}
+	if r.URL.Query().Has("stat") {
+		statHandler(w, r, target, f, info)
+		return
+	}
+	if info.IsDir() {
+		listHandler(w, r, target, relPath)
+		return
+	}
+	if r.URL.Query().Has("checksum") {
+		checksumHandler(w, r, target, f, info)
+		return
+	}
+
+	meta, err := readMeta(target)
+	if err != nil {
+		httpError(w, r, "Failed to read metadata: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("X-Object-ACL", meta.acl())
+	if cc := cacheControlFor(storageRel(target), meta); cc != "" {
+		w.Header().Set("Cache-Control", cc)
+	}
+	if until, ok := meta.retainedUntil(); ok {
+		w.Header().Set("X-Object-Retain-Until", until.Format(time.RFC3339))
+	}
+	// ?download (or ?download=name) makes browsers save the file rather than display it
+	if r.URL.Query().Has("download") {
+		name := r.URL.Query().Get("download")
+		if name == "" {
+			name = info.Name()
+		}
+		w.Header().Set("Content-Disposition", attachmentDisposition(name))
+	}
+
+	// With GZIP_STATIC (BROTLI_STATIC) a precompressed "name.gz" ("name.br")
+	// next to the object is sent in its place to clients that accept the
+	// encoding, like nginx's gzip_static; Brotli first, as it is smaller
+	if meta.ContentEncoding == "" {
+		for _, s := range staticSiblings {
+			if !*s.enabled {
+				continue
+			}
+			sib, sibInfo, ok := openSibling(target, s.ext)
+			if !ok {
+				continue
+			}
+			w.Header().Set("Vary", "Accept-Encoding")
+			if !acceptsEncoding(r, s.encoding) {
+				sib.Close()
+				continue
+			}
+			defer sib.Close()
+			w.Header().Set("Content-Type", contentTypeFor(info.Name()))
+			f, info, target, relPath = sib, sibInfo, target+s.ext, relPath+s.ext
+			meta = &objectMeta{ContentEncoding: s.encoding}
+			break
+		}
+	}
+
+	// Advertise range support on every file response so clients know they can resume
+	w.Header().Set("Accept-Ranges", "bytes")
+	setTimeHeaders(w, info.ModTime())
+	// ServeContent uses the ETag for If-None-Match decisions
+	etag, err := objectETag(target, info)
+	if err == nil {
+		w.Header().Set("ETag", etag)
+	}
+	applyIfRange(r, etag, info.ModTime())
+
+	// Objects uploaded pre-compressed are served as stored to clients that
+	// accept the encoding, and optionally decoded for those that do not
+	enc := meta.ContentEncoding
+	decode := enc == "gzip" && !acceptsEncoding(r, "gzip") && DecompressOnDemand
+	if enc != "" {
+		w.Header().Set("Vary", "Accept-Encoding")
+		if !decode {
+			w.Header().Set("Content-Encoding", enc)
+		}
+	}
+
+	if r.Method == http.MethodGet {
+		observeDownload(info.Size())
+	}
+
+	// Behind nginx, hand the transfer (ranges included) to its internal
+	// location; only decoding on the fly still has to stream from here
+	if AccelRedirectPrefix != "" && !decode {
+		w.Header().Set("X-Accel-Redirect", accelRedirectURI(storageRel(target)))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	liftRequestDeadline(r)
+	w = streamingWriter(w)
+	// Read at offsets only, never through f's own position, which a shared
+	// handle cannot have
+	content := io.NewSectionReader(f, 0, info.Size())
+	if decode {
+		serveDecompressed(w, r, info, content)
+		return
+	}
+	// An empty file has no satisfiable byte range, and ServeContent would
+	// answer a suffix range ("bytes=-N") with a malformed "bytes 0--1/0"
+	// Content-Range. Serve the whole (empty) body with 200, which a server
+	// may always do in place of a range response.
+	if info.Size() == 0 {
+		r.Header.Del("Range")
+	}
+	applyDefaultContentType(w, info.Name(), content)
+	if enc != "" {
+		w = &encodedLengthWriter{ResponseWriter: w, size: info.Size()}
+	} else if ce := downloadEncoding(w, r, info.Name(), content); ce != "" {
+		cw := newCompressWriter(w, ce)
+		defer cw.Close()
+		w = cw
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), withContext(r.Context(), content))
+	noteCanceled(r, "download")
+}
+
+func cacheControlFor(rel string, meta *objectMeta) string {
+	policy := policyFor(rel)
+	switch {
+	case policy.CacheControl != nil:
+		return *policy.CacheControl
+	case policy.publicRead() || meta.ACL == aclPublicRead:
+		return CacheControlPublic
+	}
+	return CacheControl
+}
+
+// Content-Type by file extension, for bodies ServeContent cannot sniff
+func contentTypeFor(name string) string {
+	if ct := mime.TypeByExtension(filepath.Ext(name)); ct != "" {
+		return ct
+	}
+	return DefaultContentType
+}
+
+// ServeContent labels files it cannot identify by extension or by sniffing
+// application/octet-stream; give those DEFAULT_CONTENT_TYPE instead. The
+// same sniff is done here first, then f is rewound for ServeContent.
+func applyDefaultContentType(w http.ResponseWriter, name string, f io.ReadSeeker) {
+	if DefaultContentType == "application/octet-stream" || w.Header().Get("Content-Type") != "" ||
+		mime.TypeByExtension(filepath.Ext(name)) != "" {
+		return
+	}
+	var buf [512]byte
+	n, _ := io.ReadFull(f, buf[:])
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	if http.DetectContentType(buf[:n]) == "application/octet-stream" {
+		w.Header().Set("Content-Type", DefaultContentType)
+	}
+}
+
+// The regular file "target.gz", if there is one
+var staticSiblings = []struct {
+	enabled       *bool
+	encoding, ext string
+}{
+	{&BrotliStatic, "br", ".br"},
+	{&GzipStatic, "gzip", ".gz"},
+}
+
+func openSibling(target, ext string) (*os.File, os.FileInfo, bool) {
+	f, err := os.Open(target + ext)
+	if err != nil {
+		return nil, nil, false
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		f.Close()
+		return nil, nil, false
+	}
+	return f, info, true
+}
+
+// Stream a gzip-stored object decoded. The decoded length is unknown up
+// front, so Range is not supported on this path.
+func serveDecompressed(w http.ResponseWriter, r *http.Request, info os.FileInfo, f io.Reader) {
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		httpError(w, r, "Stored object is not valid gzip: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer zr.Close()
+
+	h := w.Header()
+	h.Set("Accept-Ranges", "none")
+	h.Del("ETag") // the ETag describes the stored (encoded) bytes
+	h.Set("Content-Type", contentTypeFor(info.Name()))
+	if r.Method == http.MethodHead {
+		return
+	}
+	// Send the headers before any body so net/http cannot add a
+	// Content-Length for short outputs that HEAD could never report
+	w.WriteHeader(http.StatusOK)
+	http.NewResponseController(w).Flush()
+	io.Copy(w, &ctxReader{r.Context(), zr})
+	noteCanceled(r, "download")
+}
+
+// Fills in the Content-Length ServeContent leaves out whenever
+// Content-Encoding is set. Without it a HEAD would carry no length while a
+// small GET gets one from net/http's buffering, and clients that plan ranged
+// GETs from a HEAD need the two to agree.
+type encodedLengthWriter struct {
+	http.ResponseWriter
+	size  int64
+	wrote bool
+}
+
+func (lw *encodedLengthWriter) WriteHeader(status int) {
+	if !lw.wrote {
+		lw.wrote = true
+		h := lw.Header()
+		if h.Get("Content-Length") == "" {
+			switch status {
+			case http.StatusOK:
+				h.Set("Content-Length", strconv.FormatInt(lw.size, 10))
+			case http.StatusPartialContent:
+				var start, end, total int64
+				if _, err := fmt.Sscanf(h.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total); err == nil {
+					h.Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+				}
+			}
+		}
+	}
+	lw.ResponseWriter.WriteHeader(status)
+}
+
+func (lw *encodedLengthWriter) Write(p []byte) (int, error) {
+	if !lw.wrote {
+		lw.WriteHeader(http.StatusOK)
+	}
+	return lw.ResponseWriter.Write(p)
+}
+
+func (lw *encodedLengthWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
+
+// Prepare w for a potentially very long transfer: WRITE_TIMEOUT is meant for
+// ordinary responses, so the write deadline is lifted (or replaced by
+// MAX_DOWNLOAD_DURATION) and data is flushed periodically so proxies see
+// progress. The server re-arms its own deadlines for the next request on
+// the connection.
+func streamingWriter(w http.ResponseWriter) http.ResponseWriter {
+	rc := http.NewResponseController(w)
+	var deadline time.Time
+	if MaxDownloadDuration > 0 {
+		deadline = now().Add(MaxDownloadDuration)
+	}
+	rc.SetWriteDeadline(deadline)
+	if DownloadFlushInterval <= 0 {
+		return w
+	}
+	return &flushWriter{ResponseWriter: w, rc: rc, last: now()}
+}
+
+// Flushes buffered response data at most every DownloadFlushInterval
+type flushWriter struct {
+	http.ResponseWriter
+	rc   *http.ResponseController
+	last time.Time
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.ResponseWriter.Write(p)
+	if err == nil && now().Sub(fw.last) >= DownloadFlushInterval {
+		fw.rc.Flush()
+		fw.last = now()
+	}
+	return n, err
+}
+
+func (fw *flushWriter) Unwrap() http.ResponseWriter {
+	return fw.ResponseWriter
+}
+
+// Resolve If-Range before ServeContent does: keep Range only while the
+// validator (an ETag or an HTTP date) still matches the object, otherwise
+// drop it so the client gets the full 200 and restarts cleanly. ETags are
+// compared strongly (RFC 9110 13.1.5): a weak one on either side never
+// matches, so with ETAG_MODE=weak only a Last-Modified date can keep Range.
+func applyIfRange(r *http.Request, etag string, modTime time.Time) {
+	ir := strings.TrimSpace(r.Header.Get("If-Range"))
+	if ir == "" {
+		return
+	}
+	r.Header.Del("If-Range")
+	if r.Header.Get("Range") == "" {
+		return
+	}
+	match := false
+	if strings.HasSuffix(ir, `"`) {
+		match = etag != "" && ir == etag && !strings.HasPrefix(etag, "W/")
+	} else if t, err := http.ParseTime(ir); err == nil {
+		match = modTime.UTC().Truncate(time.Second).Equal(t)
+	}
+	if !match {
+		r.Header.Del("Range")
+	}
+}
+
+// Whether the client's Accept-Encoding lists enc (or *) with a non-zero q
+func acceptsEncoding(r *http.Request, enc string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.TrimSpace(name)
+		if !strings.EqualFold(name, enc) && name != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Content-Disposition: attachment for name. Non-ASCII names get an RFC 5987
+// filename* that browsers decode as UTF-8, after a plain filename with the
+// other characters replaced for clients that only read that.
+func attachmentDisposition(name string) string {
+	var ascii, encoded strings.Builder
+	plain := true
+	for _, c := range name {
+		switch {
+		case c < 0x20 || c == 0x7f:
+			continue // never valid in a header
+		case c > 0x7e:
+			plain = false
+			ascii.WriteByte('_')
+		case c == '"' || c == '\\':
+			ascii.WriteByte('_')
+		default:
+			ascii.WriteRune(c)
+		}
+	}
+	v := `attachment; filename="` + ascii.String() + `"`
+	if plain {
+		return v
+	}
+	for _, b := range []byte(name) {
+		if b < 0x20 || b == 0x7f {
+			continue
+		}
+		// attr-char from RFC 5987: ALPHA / DIGIT / "!#$&+-.^_`|~"
+		if 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' || strings.IndexByte("!#$&+-.^_`|~", b) >= 0 {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return v + "; filename*=UTF-8''" + encoded.String()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// JSON error envelope. Code is a stable machine-readable identifier, Error a
+// human readable message; Limit/Usage/RetryAfter are set for limit errors so
+// clients can show actionable messages.
+type errorEnvelope struct {
+	Success    bool   `json:"success"`
+	Code       string `json:"code"`
+	Error      string `json:"error"`
+	Limit      int64  `json:"limit,omitempty"`
+	Usage      int64  `json:"usage,omitempty"`
+	RetryAfter int    `json:"retryAfter,omitempty"`
+}
+
+// Branded bodies for 404 and 403 answers, loaded from the files named by
+// ERROR_PAGE_404 and ERROR_PAGE_403. An HTML page goes to clients that
+// prefer text/html over JSON (browsers); a JSON page replaces the envelope
+// for clients that take JSON.
+var errorPages = map[int]*errorPage{}
+
+type errorPage struct {
+	body        []byte
+	contentType string
+}
+
+func loadErrorPage(status int, file string) error {
+	body, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	errorPages[status] = &errorPage{body: body, contentType: contentTypeFor(file)}
+	return nil
+}
+
+// Write an error in the format the client asked for: the JSON envelope when
+// Accept is absent or allows application/json (including */*), otherwise a
+// single text line. A configured error page takes the place of either.
+func writeError(w http.ResponseWriter, r *http.Request, status int, e errorEnvelope) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if page := errorPages[status]; page != nil {
+		isJSON := strings.HasPrefix(page.contentType, "application/json")
+		if isJSON && wantsJSON(r) || !isJSON && prefersHTML(r) {
+			w.Header().Set("Content-Type", page.contentType)
+			w.WriteHeader(status)
+			w.Write(page.body)
+			return
+		}
+	}
+	if !wantsJSON(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		fmt.Fprintln(w, e.Error)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// Error with a generic code for its status, for call sites without a more
+// specific one
+func httpError(w http.ResponseWriter, r *http.Request, msg string, status int) {
+	writeError(w, r, status, errorEnvelope{Code: statusCode(status), Error: msg})
+}
+
+func statusCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "bad_request"
+	case http.StatusUnauthorized:
+		return "unauthorized"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusMethodNotAllowed:
+		return "method_not_allowed"
+	case http.StatusConflict:
+		return "conflict"
+	case http.StatusPreconditionFailed:
+		return "precondition_failed"
+	case http.StatusRequestEntityTooLarge:
+		return "too_large"
+	case http.StatusInsufficientStorage:
+		return "quota_exceeded"
+	}
+	if status >= 500 {
+		return "internal_error"
+	}
+	return strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+}
+
+// Whether Accept ranks text/html above application/json, as browsers'
+// "text/html,...,*/*;q=0.8" does
+func prefersHTML(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return acceptQuality(accept, "text/html") > acceptQuality(accept, "application/json")
+}
+
+// q Accept gives the media type mt, from its most specific matching range
+func acceptQuality(accept, mt string) float64 {
+	major, _, _ := strings.Cut(mt, "/")
+	best, q := -1, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		rng, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		rng = strings.ToLower(strings.TrimSpace(rng))
+		specificity := 0
+		switch rng {
+		case mt:
+			specificity = 2
+		case major + "/*":
+			specificity = 1
+		case "*/*":
+		default:
+			continue
+		}
+		if specificity <= best {
+			continue
+		}
+		best, q = specificity, 1
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+	}
+	return q
+}
+
+// Whether Accept is absent or admits application/json with a non-zero q
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		mt = strings.ToLower(strings.TrimSpace(mt))
+		if mt != "application/json" && mt != "application/*" && mt != "*/*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ETagMode selects how object ETags are computed, override with ETAG_MODE:
+//   - "weak" (default): W/"<size>-<modtime>", free to compute; changes
+//     whenever the file is rewritten, even with identical content
+//   - "strong": the SHA-256 of the content, stable across identical
+//     rewrites at the cost of reading the whole file once per change
+var ETagMode = "weak"
+
+type etagEntry struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+// Strong ETags cached by path and invalidated when size or modtime change
+var (
+	etagMu    sync.Mutex
+	etagCache = map[string]etagEntry{}
+)
+
+const etagCacheMax = 10000
+
+func objectETag(path string, info os.FileInfo) (string, error) {
+	if ETagMode != "strong" {
+		return fmt.Sprintf(`W/"%x-%x"`, info.Size(), info.ModTime().UnixNano()), nil
+	}
+
+	etagMu.Lock()
+	e, ok := etagCache[path]
+	etagMu.Unlock()
+	if ok && e.size == info.Size() && e.modTime.Equal(info.ModTime()) {
+		return e.etag, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	etag := `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+
+	etagMu.Lock()
+	if len(etagCache) >= etagCacheMax {
+		etagCache = map[string]etagEntry{}
+	}
+	etagCache[path] = etagEntry{size: info.Size(), modTime: info.ModTime(), etag: etag}
+	etagMu.Unlock()
+	return etag, nil
+}
+
+// Evaluate an If-Match header against the current ETag ("" when the object
+// does not exist). Comparison ignores the W/ prefix so weak ETags remain
+// usable for compare-and-swap.
+func ifMatch(header, current string) bool {
+	if current == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(current, "W/") {
+			return true
+		}
+	}
+	return false
+}
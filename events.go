@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Change notifications for live file browsers. The storage primitives
+// publish an event after every successful create, overwrite, delete and
+// move, as does the optional watcher for external changes (watch.go);
+// GET /{token}/prefix/?events streams those below prefix.
+var (
+	eventBufferSize   = 256
+	eventPingInterval = 30 * time.Second
+)
+
+type storageEvent struct {
+	Type string    `json:"type"` // created, updated, deleted or moved
+	Path string    `json:"path"` // storage-relative
+	From string    `json:"from,omitempty"`
+	Size int64     `json:"size,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+type eventSubscriber struct {
+	dir string         // only events below this directory
+	re  *regexp.Regexp // and allowed by the token, when set
+	ch  chan storageEvent
+}
+
+var (
+	eventsMu    sync.Mutex
+	subscribers = map[*eventSubscriber]struct{}{}
+)
+
+func (s *eventSubscriber) wants(rel string) bool {
+	return within(storagePath(rel), s.dir) &&
+		(s.re == nil || pathAllowed(s.re, rel))
+}
+
+// Publish a change the server made to matching subscribers
+func publishEvent(typ, obj, from string, size int64) {
+	if isInternalPath(obj) {
+		return
+	}
+	noteOwnWrite(obj)
+	refreshDirIndexes(storageParent(obj))
+	ev := storageEvent{Type: typ, Path: storageRel(obj), Size: size, Time: now().UTC()}
+	if from != "" {
+		noteOwnWrite(from)
+		refreshDirIndexes(storageParent(from))
+		ev.From = storageRel(from)
+		if isInternalPath(from) {
+			ev.Type, ev.From = "created", "" // e.g. promoted out of quarantine
+		}
+	}
+	broadcastEvent(ev)
+}
+
+// Fan an event out to matching subscribers. A subscriber whose buffer is
+// full is dropped rather than blocking the write path; its stream then ends
+// with an "overflow" event so the client knows to resync.
+func broadcastEvent(ev storageEvent) {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	for s := range subscribers {
+		out := ev
+		if ev.From != "" {
+			// A move across the edge of what s may see is, to s, a create or delete
+			switch seesDst, seesSrc := s.wants(ev.Path), s.wants(ev.From); {
+			case seesDst && !seesSrc:
+				out.Type, out.From = "created", ""
+			case !seesDst && seesSrc:
+				out.Type, out.Path, out.From, out.Size = "deleted", ev.From, "", 0
+			}
+		}
+		if !s.wants(out.Path) {
+			continue
+		}
+		select {
+		case s.ch <- out:
+		default:
+			delete(subscribers, s)
+			close(s.ch)
+		}
+	}
+}
+
+func subscribe(dir string, re *regexp.Regexp) *eventSubscriber {
+	s := &eventSubscriber{dir: dir, re: re, ch: make(chan storageEvent, eventBufferSize)}
+	eventsMu.Lock()
+	subscribers[s] = struct{}{}
+	eventsMu.Unlock()
+	return s
+}
+
+func unsubscribe(s *eventSubscriber) {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	if _, ok := subscribers[s]; ok {
+		delete(subscribers, s)
+		close(s.ch)
+	}
+}
+
+// Server-Sent Events stream of changes below dir, until the client leaves
+func eventsHandler(w http.ResponseWriter, r *http.Request, dir, relPath string) {
+	liftRequestDeadline(r)
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{}) // the stream outlives WRITE_TIMEOUT
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no") // nginx must not buffer the stream
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, ": watching /%s\n\n", strings.TrimPrefix(relPath, "/"))
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	sub := subscribe(dir, tokenRegex(r))
+	defer unsubscribe(sub)
+	ping := time.NewTicker(eventPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case ev, ok := <-sub.ch:
+			if !ok {
+				fmt.Fprint(w, "event: overflow\ndata: {}\n\n")
+				rc.Flush()
+				return
+			}
+			data, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Replace the clock with one the test moves by hand
+func fakeClock(t *testing.T) *time.Time {
+	t.Helper()
+	cur := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+	prev := now
+	now = func() time.Time { return cur }
+	t.Cleanup(func() { now = prev })
+	return &cur
+}
+
+func TestShareLinkExpires(t *testing.T) {
+	clock := fakeClock(t)
+	srv := newTestServer(t)
+	base := srv.URL + "/" + testToken(t, "^/data/.*") + "/data/a.txt"
+	doRequest(t, http.MethodPut, base, "shared")
+
+	resp := doRequest(t, http.MethodPost, base+"?share&ttl=1h", "")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("share: status %d", resp.StatusCode)
+	}
+	var link struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&link); err != nil {
+		t.Fatal(err)
+	}
+
+	*clock = clock.Add(59 * time.Minute)
+	if resp := doRequest(t, http.MethodGet, srv.URL+link.URL, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("before expiry: status %d", resp.StatusCode)
+	}
+	*clock = clock.Add(time.Minute)
+	resp = doRequest(t, http.MethodGet, srv.URL+link.URL, "")
+	if resp.StatusCode != http.StatusGone {
+		t.Fatalf("at expiry: status %d", resp.StatusCode)
+	}
+	if env := decodeEnvelope(t, resp); env.Code != "share_expired" {
+		t.Fatalf("code %q", env.Code)
+	}
+}
+
+func TestRetentionEnds(t *testing.T) {
+	clock := fakeClock(t)
+	srv := newTestServer(t)
+	base := srv.URL + "/" + testToken(t, "^/data/.*") + "/data/a.txt"
+	doRequest(t, http.MethodPut, base, "kept")
+
+	until := clock.Add(24 * time.Hour).Format(time.RFC3339)
+	if resp := doRequest(t, http.MethodPut, base+"?retention="+until, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("retention: status %d", resp.StatusCode)
+	}
+	resp := doRequest(t, http.MethodDelete, base, "")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("delete under retention: status %d", resp.StatusCode)
+	}
+	if env := decodeEnvelope(t, resp); env.Code != "retention_locked" {
+		t.Fatalf("code %q", env.Code)
+	}
+
+	*clock = clock.Add(24 * time.Hour)
+	base = srv.URL + "/" + testToken(t, "^/data/.*") + "/data/a.txt" // the first one expired meanwhile
+	if resp := doRequest(t, http.MethodDelete, base, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("delete after retention: status %d", resp.StatusCode)
+	}
+}
+
+func TestTokenExpires(t *testing.T) {
+	clock := fakeClock(t)
+	srv := newTestServer(t)
+	url := srv.URL + "/" + testToken(t, "^/data/.*") + "/data/a.txt"
+
+	if resp := doRequest(t, http.MethodPut, url, "x"); resp.StatusCode >= 300 {
+		t.Fatalf("fresh token: status %d", resp.StatusCode)
+	}
+	*clock = clock.Add(time.Hour + time.Second)
+	resp := doRequest(t, http.MethodGet, url, "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expired token: status %d", resp.StatusCode)
+	}
+	if env := decodeEnvelope(t, resp); env.Code != "token_expired" {
+		t.Fatalf("code %q", env.Code)
+	}
+}
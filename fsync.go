@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FsyncPolicy decides how much an acknowledged upload survives a crash or
+// power loss, override with FSYNC_POLICY:
+//   - "never" (default): nothing is synced; the OS writes data back on its
+//     own schedule, so the last seconds of uploads can be lost or, on some
+//     filesystems, come back empty
+//   - "batch": each file's bytes are synced before it is renamed into
+//     place, and the directories holding new names are synced together
+//     every FsyncInterval; a crash can lose uploads from that window, but
+//     never leaves a torn or empty file
+//   - "always": the file and its directory are synced before the upload is
+//     acknowledged; nothing acknowledged is lost, at the cost of two
+//     fsyncs per upload
+var (
+	FsyncPolicy   = "never"     // override with FSYNC_POLICY
+	FsyncInterval = time.Second // override with FSYNC_INTERVAL, for batch
+)
+
+var (
+	fsyncMu      sync.Mutex
+	pendingDirs  = map[string]struct{}{}
+	fsyncStarted bool
+)
+
+// Sync a written file's contents unless the policy is never
+func syncFile(f storageFile) error {
+	if FsyncPolicy == "never" {
+		return nil
+	}
+	return f.Sync()
+}
+
+// Make a new directory entry for p durable, now or with the next batch
+func syncParent(p string) {
+	switch FsyncPolicy {
+	case "always":
+		if err := syncDir(filepath.Dir(p)); err != nil {
+			fmt.Printf("warning: failed to sync directory of %s: %v\n", storageRel(p), err)
+		}
+	case "batch":
+		fsyncMu.Lock()
+		pendingDirs[filepath.Dir(p)] = struct{}{}
+		if !fsyncStarted {
+			fsyncStarted = true
+			go fsyncLoop()
+		}
+		fsyncMu.Unlock()
+	}
+}
+
+func syncDir(dir string) error {
+	d, err := storageFS.OpenFile(dir, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func fsyncLoop() {
+	for range time.Tick(FsyncInterval) {
+		fsyncMu.Lock()
+		dirs := pendingDirs
+		pendingDirs = map[string]struct{}{}
+		fsyncMu.Unlock()
+		for dir := range dirs {
+			if err := syncDir(dir); err != nil && !os.IsNotExist(err) {
+				fmt.Printf("warning: failed to sync directory %s: %v\n", storageRel(dir), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Retried requests carrying the same Idempotency-Key get the recorded
+// response instead of being processed again. Keys are scoped to the token
+// and persisted to IdempotencyFile so they survive restarts: each record is
+// appended as one JSON line, and the file is rewritten without expired keys
+// at startup and by an hourly sweep.
+var (
+	IdempotencyTTL  = 24 * time.Hour      // override with IDEMPOTENCY_TTL
+	IdempotencyFile = ".idempotency.json" // override with IDEMPOTENCY_FILE
+)
+
+const idempotencyMaxBody = 64 << 10
+
+type idempotencyRecord struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Status  int               `json:"status"`
+	Header  map[string]string `json:"header,omitempty"`
+	Body    []byte            `json:"body"`
+	Expires time.Time         `json:"expires"`
+}
+
+// One line of IdempotencyFile
+type idempotencyEntry struct {
+	Key string `json:"key"`
+	idempotencyRecord
+}
+
+var (
+	idemMu       sync.Mutex
+	idemRecords  = map[string]*idempotencyRecord{}
+	idemInFlight = map[string]bool{}
+	idemLog      *os.File // append handle on IdempotencyFile, opened on first use
+)
+
+// Load persisted keys, dropping expired ones. Files written before keys were
+// appended hold a single JSON object mapping keys to records; they are read
+// too and rewritten in the line format.
+func loadIdempotencyKeys() {
+	f, err := os.Open(IdempotencyFile)
+	if err != nil {
+		return
+	}
+	now := now()
+	dec := json.NewDecoder(f)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			if err != io.EOF {
+				// A line cut short by a crash ends the log; keep what came before
+				fmt.Printf("warning: ignoring the rest of %s: %v\n", IdempotencyFile, err)
+			}
+			break
+		}
+		entry := idempotencyEntry{}
+		if json.Unmarshal(raw, &entry) == nil && entry.Key != "" {
+			if entry.Expires.After(now) {
+				idemRecords[entry.Key] = &entry.idempotencyRecord
+			} else {
+				delete(idemRecords, entry.Key)
+			}
+			continue
+		}
+		legacy := map[string]*idempotencyRecord{}
+		if err := json.Unmarshal(raw, &legacy); err != nil {
+			fmt.Printf("warning: ignoring unreadable entry in %s: %v\n", IdempotencyFile, err)
+			continue
+		}
+		for k, rec := range legacy {
+			if rec != nil && rec.Expires.After(now) {
+				idemRecords[k] = rec
+			}
+		}
+	}
+	f.Close()
+	idemMu.Lock()
+	compactIdempotencyKeys()
+	idemMu.Unlock()
+}
+
+// Append one record to the log; caller holds idemMu
+func appendIdempotencyKey(id string, rec *idempotencyRecord) {
+	line, err := json.Marshal(idempotencyEntry{Key: id, idempotencyRecord: *rec})
+	if err != nil {
+		return
+	}
+	if idemLog != nil && idemLog.Name() != IdempotencyFile {
+		idemLog.Close()
+		idemLog = nil
+	}
+	if idemLog == nil {
+		if idemLog, err = os.OpenFile(IdempotencyFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+			idemLog = nil
+			fmt.Printf("warning: failed to persist idempotency key: %v\n", err)
+			return
+		}
+	}
+	if _, err := idemLog.Write(append(line, '\n')); err != nil {
+		fmt.Printf("warning: failed to persist idempotency key: %v\n", err)
+	}
+}
+
+// Drop expired keys and rewrite the log with the live ones, atomically;
+// caller holds idemMu
+func compactIdempotencyKeys() {
+	now := now()
+	var buf bytes.Buffer
+	for k, rec := range idemRecords {
+		if !rec.Expires.After(now) {
+			delete(idemRecords, k)
+			continue
+		}
+		line, err := json.Marshal(idempotencyEntry{Key: k, idempotencyRecord: *rec})
+		if err != nil {
+			continue
+		}
+		buf.Write(append(line, '\n'))
+	}
+	tmp := filepath.Join(filepath.Dir(IdempotencyFile), "."+filepath.Base(IdempotencyFile)+".tmp")
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		fmt.Printf("warning: failed to persist idempotency keys: %v\n", err)
+		return
+	}
+	if err := os.Rename(tmp, IdempotencyFile); err != nil {
+		fmt.Printf("warning: failed to persist idempotency keys: %v\n", err)
+		os.Remove(tmp)
+		return
+	}
+	// Later appends go to the new file
+	if idemLog != nil {
+		idemLog.Close()
+		idemLog = nil
+	}
+}
+
+// Periodically forget keys past IdempotencyTTL
+func startIdempotencySweeper() {
+	go func() {
+		for {
+			time.Sleep(time.Hour)
+			idemMu.Lock()
+			compactIdempotencyKeys()
+			idemMu.Unlock()
+		}
+	}()
+}
+
+// Captures the status, a few headers and the body of a response for replay.
+// A body past idempotencyMaxBody is not kept at all, since replaying a cut
+// copy would hand the client a corrupt response.
+type recordingWriter struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	rw.status = status
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	if !rw.overflow && rw.body.Len()+len(p) > idempotencyMaxBody {
+		rw.overflow = true
+		rw.body.Reset()
+	}
+	if !rw.overflow {
+		rw.body.Write(p)
+	}
+	return rw.ResponseWriter.Write(p)
+}
+
+func (rw *recordingWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// Wrap a mutating handler with Idempotency-Key replay
+func idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+		if key == "" {
+			next(w, r)
+			return
+		}
+
+		// Scope keys to the credential so clients cannot collide with each other
+		token, objPath, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		sum := sha256.Sum256([]byte(token + "\x00" + key))
+		id := hex.EncodeToString(sum[:])
+
+		idemMu.Lock()
+		rec := idemRecords[id]
+		if rec != nil && !rec.Expires.After(now()) {
+			rec = nil
+		}
+		if rec == nil && idemInFlight[id] {
+			idemMu.Unlock()
+			writeError(w, r, http.StatusConflict, errorEnvelope{Code: "idempotency_in_progress", Error: "A request with this Idempotency-Key is still in progress"})
+			return
+		}
+		if rec == nil {
+			idemInFlight[id] = true
+		}
+		idemMu.Unlock()
+
+		if rec != nil {
+			if rec.Method != r.Method || rec.Path != objPath {
+				writeError(w, r, http.StatusUnprocessableEntity, errorEnvelope{Code: "idempotency_mismatch", Error: "Idempotency-Key was already used for a different request"})
+				return
+			}
+			for k, v := range rec.Header {
+				w.Header().Set(k, v)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(rec.Status)
+			w.Write(rec.Body)
+			return
+		}
+
+		rw := &recordingWriter{ResponseWriter: w}
+		next(rw, r)
+
+		idemMu.Lock()
+		defer idemMu.Unlock()
+		delete(idemInFlight, id)
+		// Only successful outcomes are remembered; failures may be retried for real
+		if rw.status < 200 || rw.status >= 300 {
+			return
+		}
+		if rw.overflow {
+			debugf("not recording Idempotency-Key response for %s: body over %d bytes\n", objPath, idempotencyMaxBody)
+			return
+		}
+		header := map[string]string{}
+		for _, k := range []string{"Content-Type", "ETag", "Last-Modified"} {
+			if v := w.Header().Get(k); v != "" {
+				header[k] = v
+			}
+		}
+		idemRecords[id] = &idempotencyRecord{
+			Method:  r.Method,
+			Path:    objPath,
+			Status:  rw.status,
+			Header:  header,
+			Body:    rw.body.Bytes(),
+			Expires: now().Add(IdempotencyTTL),
+		}
+		appendIdempotencyKey(id, idemRecords[id])
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func putWithKey(t *testing.T, url, key, body string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPut, url, strings.NewReader(body))
+	req.Header.Set("Idempotency-Key", key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func idempotencyLines(t *testing.T) []string {
+	t.Helper()
+	data, err := os.ReadFile(IdempotencyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func resetIdempotencyKeys(t *testing.T) {
+	t.Helper()
+	idemMu.Lock()
+	idemRecords = map[string]*idempotencyRecord{}
+	idemMu.Unlock()
+}
+
+func TestIdempotencyKeysAppendedAndReloaded(t *testing.T) {
+	srv := newTestServer(t)
+	resetIdempotencyKeys(t)
+	base := srv.URL + "/" + testToken(t, "^/data/.*")
+
+	putWithKey(t, base+"/data/a.txt", "k1", "one")
+	putWithKey(t, base+"/data/b.txt", "k2", "two")
+	if lines := idempotencyLines(t); len(lines) != 2 {
+		t.Fatalf("%d lines, want one per key: %q", len(lines), lines)
+	}
+
+	// After a restart the keys still replay
+	resetIdempotencyKeys(t)
+	loadIdempotencyKeys()
+	resp := putWithKey(t, base+"/data/a.txt", "k1", "changed")
+	if resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Fatal("key not replayed after reload")
+	}
+	if b, _ := os.ReadFile(StorageDir + "/data/a.txt"); string(b) != "one" {
+		t.Fatalf("replayed request ran again: %q", b)
+	}
+}
+
+func TestIdempotencySweepDropsExpiredKeys(t *testing.T) {
+	clock := fakeClock(t)
+	srv := newTestServer(t)
+	resetIdempotencyKeys(t)
+	// Tokens are minted per request, since the clock jumps past their lifetime
+	base := func() string { return srv.URL + "/" + testToken(t, "^/data/.*") }
+
+	putWithKey(t, base()+"/data/a.txt", "old", "one")
+	*clock = clock.Add(IdempotencyTTL - time.Minute)
+	putWithKey(t, base()+"/data/b.txt", "new", "two")
+	*clock = clock.Add(2 * time.Minute)
+
+	idemMu.Lock()
+	compactIdempotencyKeys()
+	n := len(idemRecords)
+	idemMu.Unlock()
+	if n != 1 {
+		t.Fatalf("%d keys in memory after the sweep, want 1", n)
+	}
+	lines := idempotencyLines(t)
+	if len(lines) != 1 || !strings.Contains(lines[0], `"path":"data/b.txt"`) {
+		t.Fatalf("log after the sweep: %q", lines)
+	}
+
+	// Appends after the rewrite land in the new file
+	*clock = clock.Add(time.Minute)
+	putWithKey(t, base()+"/data/c.txt", "newer", "three")
+	if lines := idempotencyLines(t); len(lines) != 2 {
+		t.Fatalf("log after another key: %q", lines)
+	}
+}
+
+func TestIdempotencyLoadsLegacyFile(t *testing.T) {
+	newTestServer(t)
+	resetIdempotencyKeys(t)
+	legacy := map[string]*idempotencyRecord{
+		"live":    {Method: http.MethodPut, Path: "data/a.txt", Status: 201, Expires: now().Add(time.Hour)},
+		"expired": {Method: http.MethodPut, Path: "data/b.txt", Status: 201, Expires: now().Add(-time.Hour)},
+	}
+	data, _ := json.Marshal(legacy)
+	os.WriteFile(IdempotencyFile, data, 0600)
+
+	loadIdempotencyKeys()
+	if rec := idemRecords["live"]; rec == nil || rec.Path != "data/a.txt" || len(idemRecords) != 1 {
+		t.Fatalf("records %v", idemRecords)
+	}
+	lines := idempotencyLines(t)
+	if len(lines) != 1 || !bytes.Contains([]byte(lines[0]), []byte(`"key":"live"`)) {
+		t.Fatalf("legacy file not rewritten as lines: %q", lines)
+	}
+}
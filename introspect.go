@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	IntrospectRateLimit = 30 // override with INTROSPECT_RATE_LIMIT, requests per minute per IP
+	introspectLimiter   *ipRateLimiter
+)
+
+type introspectResponse struct {
+	Valid  bool             `json:"valid"`
+	Error  string           `json:"error,omitempty"`
+	Claims *introspectClaim `json:"claims,omitempty"`
+}
+
+type introspectClaim struct {
+	Path       string     `json:"path"`
+	MaxUploads int        `json:"max_uploads,omitempty"`
+	MaxObjects int64      `json:"max_objects,omitempty"`
+	CanList    *bool      `json:"can_list,omitempty"`
+	CanRead    *bool      `json:"can_read,omitempty"`
+	Subject    string     `json:"sub,omitempty"`
+	ID         string     `json:"jti,omitempty"`
+	ExpiresAt  *time.Time `json:"exp,omitempty"`
+	NotBefore  *time.Time `json:"nbf,omitempty"`
+	IssuedAt   *time.Time `json:"iat,omitempty"`
+}
+
+func claimTime(t *jwt.NumericDate) *time.Time {
+	if t == nil {
+		return nil
+	}
+	return &t.Time
+}
+
+// Decode a caller-supplied token and report whether it is currently valid.
+// Only the claims already inside the token are echoed back; nothing about
+// the secret or stored objects is revealed.
+func introspectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil || strings.TrimSpace(req.Token) == "" {
+		httpError(w, r, `Expected JSON body {"token": "..."}`, http.StatusBadRequest)
+		return
+	}
+
+	resp := introspectResponse{Valid: true}
+	claims, err := parseClaims(req.Token)
+	if err != nil {
+		resp.Valid, resp.Error = false, err.Error()
+		// Still show what the token claims so the caller can see e.g. an expired exp
+		unverified := &Claims{}
+		if _, _, perr := jwt.NewParser().ParseUnverified(req.Token, unverified); perr == nil {
+			claims = unverified
+		}
+	} else if _, _, err := getTokenInfo(req.Token); err != nil {
+		resp.Valid, resp.Error = false, err.Error()
+	}
+
+	if claims != nil {
+		resp.Claims = &introspectClaim{
+			Path:       claims.Path,
+			MaxUploads: claims.MaxUploads,
+			MaxObjects: claims.MaxObjects,
+			CanList:    claims.CanList,
+			CanRead:    claims.CanRead,
+			Subject:    claims.Subject,
+			ID:         claims.ID,
+			ExpiresAt:  claimTime(claims.ExpiresAt),
+			NotBefore:  claimTime(claims.NotBefore),
+			IssuedAt:   claimTime(claims.IssuedAt),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type listEntry struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type"` // "file" or "dir"
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// JSON listing of a directory's direct children, sidecars and temp files excluded.
+// With ?tag=key:value it lists every object below the directory carrying that tag,
+// ?sync returns the recursive checksum manifest instead (see syncHandler) and
+// ?events streams changes below the directory (see eventsHandler).
+// Directory entries report size 0 unless ?sizes=true asks for recursive totals.
+// ?format=compact sends each entry as a [name, type, size, modTime] array.
+// Listings revalidate with If-None-Match, or If-Modified-Since against Last-Modified.
+func listHandler(w http.ResponseWriter, r *http.Request, dir, relPath string) {
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		listByTag(w, r, dir, relPath, tag)
+		return
+	}
+	if r.URL.Query().Has("events") {
+		eventsHandler(w, r, dir, relPath)
+		return
+	}
+	if r.URL.Query().Has("sync") {
+		syncHandler(w, r, dir, relPath)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "compact" {
+		httpError(w, r, "format must be compact", http.StatusBadRequest)
+		return
+	}
+	sizes := r.URL.Query().Get("sizes") == "true"
+	list, err := readListing(r.Context(), dir, sizes)
+	if err != nil {
+		httpError(w, r, "Failed to list: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Revalidated on every use, answered with 304 while nothing changed
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n", relPath, format)
+	for _, e := range list {
+		fmt.Fprintf(h, "%s\n%s\n%d\n%d\n", e.Name, e.Type, e.Size, e.ModTime.UnixNano())
+	}
+	etag := `W/"` + hex.EncodeToString(h.Sum(nil))[:32] + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	modTime := listingModTime(dir, list)
+	setTimeHeaders(w, modTime)
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if ifMatch(inm, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	} else if !sizes && !modifiedSince(r, modTime) {
+		// Recursive sizes change without any modtime here changing, so only
+		// the ETag can revalidate those
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if format == "compact" {
+		rows := make([][]any, len(list))
+		for i, e := range list {
+			rows[i] = []any{e.Name, e.Type, e.Size, e.ModTime}
+		}
+		writeListingJSON(w, r, map[string]any{"path": relPath, "fields": []string{"name", "type", "size", "modTime"}, "entries": rows})
+		return
+	}
+	writeListingJSON(w, r, map[string]any{"path": relPath, "entries": list})
+}
+
+// When the listing last changed: the latest modtime among its entries and
+// the directory itself, which moves when an entry is added or removed
+func listingModTime(dir string, list []listEntry) time.Time {
+	var latest time.Time
+	dirs := []string{dir}
+	if dir == filepath.Clean(StorageDir) {
+		dirs = append(dirs, StorageVolumes...)
+	}
+	for _, d := range dirs {
+		if info, err := os.Stat(d); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	for _, e := range list {
+		if e.ModTime.After(latest) {
+			latest = e.ModTime
+		}
+	}
+	return latest
+}
+
+// Whether the request's If-Modified-Since (absent or unparsable counts as
+// modified) is older than modTime, compared at HTTP-date precision
+func modifiedSince(r *http.Request, modTime time.Time) bool {
+	t, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modTime.IsZero() {
+		return true
+	}
+	return modTime.Truncate(time.Second).After(t)
+}
+
+// Listings past this size are compressed for clients that accept it
+const listingGzipMin = 1024
+
+// Send a listing as JSON, compressed when it is large and the client
+// accepts gzip (or br, with BROTLI)
+func writeListingJSON(w http.ResponseWriter, r *http.Request, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		httpError(w, r, "Failed to list: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data = append(data, '\n')
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Vary", "Accept-Encoding")
+	enc := negotiateEncoding(r, compressOffers()...)
+	if len(data) < listingGzipMin || enc == "" {
+		w.Write(data)
+		return
+	}
+	cw := newCompressWriter(w, enc)
+	cw.Write(data)
+	cw.Close()
+}
+
+// Direct children of dir sorted by name, sidecars and temp files excluded
+func readListing(ctx context.Context, dir string, sizes bool) ([]listEntry, error) {
+	entries, err := readStorageDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]listEntry, 0, len(entries))
+	for _, e := range entries {
+		if isReservedName(e.Name()) || isDirIndex(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		entry := listEntry{Name: e.Name(), Type: "file", Size: info.Size(), ModTime: info.ModTime()}
+		if e.IsDir() {
+			entry.Type, entry.Size = "dir", 0
+			if sizes {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+				entry.Size = dirSize(storageChild(dir, e.Name()))
+			}
+		}
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+func listByTag(w http.ResponseWriter, r *http.Request, dir, relPath, tag string) {
+	key, value, ok := strings.Cut(tag, ":")
+	if !ok || key == "" {
+		httpError(w, r, "tag must be key:value", http.StatusBadRequest)
+		return
+	}
+	objs, truncated, err := metaStore.FindByTag(dir, key, value)
+	if err != nil {
+		httpError(w, r, "Failed to list: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	re := tokenRegex(r)
+	list := make([]listEntry, 0, len(objs))
+	for _, obj := range objs {
+		if re != nil && !pathAllowed(re, storageRel(obj)) {
+			continue // matches the token could not fetch stay hidden
+		}
+		info, err := os.Stat(obj)
+		if err != nil {
+			continue
+		}
+		list = append(list, listEntry{Name: storageRelTo(dir, obj), Type: "file", Size: info.Size(), ModTime: info.ModTime()})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	resp := map[string]any{"path": relPath, "tag": tag, "entries": list}
+	if truncated {
+		resp["truncated"] = true
+	}
+	writeListingJSON(w, r, resp)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Per-path mutexes so check-then-act sequences (precondition checks,
+// write + metadata, delete + cleanup) on one object cannot interleave
+type pathLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+var (
+	locksMu sync.Mutex
+	locks   = map[string]*pathLock{}
+)
+
+var errWriteInProgress = errors.New("another write to this path is in progress")
+
+// Take a reference on path's lock, creating it on first use
+func acquirePathLock(path string) *pathLock {
+	locksMu.Lock()
+	defer locksMu.Unlock()
+	l := locks[path]
+	if l == nil {
+		l = &pathLock{}
+		locks[path] = l
+	}
+	l.refs++
+	return l
+}
+
+// Drop a reference taken by acquirePathLock; entries are dropped once unused
+func releasePathLock(path string, l *pathLock) {
+	locksMu.Lock()
+	defer locksMu.Unlock()
+	l.refs--
+	if l.refs == 0 {
+		delete(locks, path)
+	}
+}
+
+// Lock path, returning the unlock func
+func lockPath(path string) func() {
+	l := acquirePathLock(path)
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		releasePathLock(path, l)
+	}
+}
+
+// Like lockPath, but reports false at once instead of waiting while
+// another request holds path
+func tryLockPath(path string) (func(), bool) {
+	l := acquirePathLock(path)
+	if !l.mu.TryLock() {
+		releasePathLock(path, l)
+		return nil, false
+	}
+	return func() {
+		l.mu.Unlock()
+		releasePathLock(path, l)
+	}, true
+}
+
+// Lock several paths in a consistent order to avoid deadlocks
+func lockPaths(paths ...string) func() {
+	unlock, _ := lockPathsFor(nil, paths...)
+	return unlock
+}
+
+// Lock the paths a write request touches. By default this waits for other
+// writes to them to finish; a client sending "X-No-Wait: true" would rather
+// retry later, and gets errWriteInProgress instead of waiting.
+func lockPathsFor(r *http.Request, paths ...string) (func(), error) {
+	noWait := r != nil && strings.EqualFold(r.Header.Get("X-No-Wait"), "true")
+	sorted := append([]string(nil), paths...)
+	sort.Strings(sorted)
+	var unlocks []func()
+	unlockAll := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+	for i, p := range sorted {
+		if i > 0 && p == sorted[i-1] {
+			continue
+		}
+		if !noWait {
+			unlocks = append(unlocks, lockPath(p))
+			continue
+		}
+		unlock, ok := tryLockPath(p)
+		if !ok {
+			unlockAll()
+			return nil, errWriteInProgress
+		}
+		unlocks = append(unlocks, unlock)
+	}
+	return unlockAll, nil
+}
+
+func writeWriteInProgress(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusConflict, errorEnvelope{Code: "write_in_progress", Error: "Another write to this path is in progress, retry later"})
+}
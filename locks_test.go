@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBatchDeleteHonorsNoWait(t *testing.T) {
+	srv := newTestServer(t)
+	base := srv.URL + "/" + testToken(t, "^/data/.*")
+	doRequest(t, http.MethodPut, base+"/data/a.txt", "a")
+
+	unlock := lockPath(filepath.Join(StorageDir, "data", "a.txt"))
+	defer unlock()
+	req, _ := http.NewRequest(http.MethodPost, base+"/data/?delete", strings.NewReader(`{"paths": ["a.txt"]}`))
+	req.Header.Set("X-No-Wait", "true")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if codes := batchCodes(t, resp); len(codes) != 1 || codes[0] != "write_in_progress" {
+		t.Fatalf("codes %v", codes)
+	}
+}
+
+func TestMoveNotBlockedByUnrelatedPaths(t *testing.T) {
+	srv := newTestServer(t)
+	base := srv.URL + "/" + testToken(t, "^/data/.*")
+	doRequest(t, http.MethodPut, base+"/data/a.txt", "a")
+
+	// A write elsewhere holds its lock; this move touches other paths
+	unlock := lockPath(filepath.Join(StorageDir, "data", "busy.txt"))
+	defer unlock()
+	req, _ := http.NewRequest("MOVE", base+"/data/a.txt", nil)
+	req.Header.Set("Destination", "/"+testToken(t, "^/data/.*")+"/data/b.txt")
+	req.Header.Set("X-No-Wait", "true")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		t.Fatalf("MOVE: status %d", resp.StatusCode)
+	}
+
+	unlockDst := lockPath(filepath.Join(StorageDir, "data", "c.txt"))
+	defer unlockDst()
+	req, _ = http.NewRequest("MOVE", base+"/data/b.txt", nil)
+	req.Header.Set("Destination", "/"+testToken(t, "^/data/.*")+"/data/c.txt")
+	req.Header.Set("X-No-Wait", "true")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if env := decodeEnvelope(t, resp); resp.StatusCode != http.StatusConflict || env.Code != "write_in_progress" {
+		t.Fatalf("MOVE onto a locked path: status %d, code %q", resp.StatusCode, env.Code)
+	}
+}
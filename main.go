@@ -1,180 +1,744 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
+// Clock for everything time-dependent (token expiry, retention, share and
+// alias TTLs, request timing), replaceable so tests control time
+var now = time.Now
+
+// The compiled-in secret lets anyone mint tokens. Startup warns about it,
+// and refuses it when REQUIRE_SECRET is set.
+const defaultSecret = "aezakmi"
+
 var (
 	StorageDir = "./storage"
-	Secret     = []byte("aezakmi") // override with env if needed
+	Secret     = []byte(defaultSecret) // override with env if needed
+	DirMode    = os.FileMode(0755)     // override with DIR_MODE (octal)
+	FileMode   = os.FileMode(0666)     // override with FILE_MODE (octal), umask still applies
+
+	RootResponse    = []byte(`{"message":"OK"}` + "\n") // override with ROOT_RESPONSE (JSON)
+	ReadOnly        = false                             // override with READ_ONLY, refuses all writes
+	PathTemplate    = ""                                // override with PATH_TEMPLATE, e.g. ^/users/{sub}/
+	DeleteMissingOK = false                             // override with DELETE_MISSING_OK, DELETE of a missing file succeeds
+	Debug           = false                             // override with DEBUG, enables the per-request log lines
+	HideForbidden   = false                             // override with HIDE_FORBIDDEN, paths outside the token get 404 instead of 403
+	RequireSecret   = false                             // override with REQUIRE_SECRET, refuses to start with the built-in SECRET
+
+	// Server timeouts, 0 disables. Read/Write default to off so long streaming
+	// uploads and downloads are not cut off; the header timeout stops slowloris.
+	ReadHeaderTimeout = 10 * time.Second  // override with READ_HEADER_TIMEOUT
+	ReadTimeout       = time.Duration(0)  // override with READ_TIMEOUT
+	WriteTimeout      = time.Duration(0)  // override with WRITE_TIMEOUT
+	IdleTimeout       = 120 * time.Second // override with IDLE_TIMEOUT
+
+	// Tokens ride in the URL, so an abnormally long path is a useful signal
+	MaxHeaderBytes = 64 << 10 // override with MAX_HEADER_BYTES, includes the request line
+	MaxURILength   = 8192     // override with MAX_URI_LENGTH, longer paths get 414
+
+	// With a certificate the server speaks TLS and negotiates HTTP/2 itself.
+	// H2C allows HTTP/2 over cleartext too, for a trusted proxy in front.
+	TLSCert = ""    // override with TLS_CERT, PEM certificate chain
+	TLSKey  = ""    // override with TLS_KEY, PEM private key
+	H2C     = false // override with H2C
 )
 
 type Claims struct {
-	Path string `json:"path"`
+	Path       string `json:"path"`
+	MaxUploads int    `json:"max_uploads,omitempty"` // overrides MAX_UPLOADS_PER_TOKEN
+	MaxObjects int64  `json:"max_objects,omitempty"` // objects allowed below the token's path prefix
+
+	MaxFileBytes int64 `json:"max_file_bytes,omitempty"` // per-file size cap, applied on top of MAX_UPLOAD_BYTES
+
+	// Both allowed when absent. "can_read": false makes a catalog-only
+	// token that lists names but cannot fetch objects; "can_list": false
+	// fetches objects by name but cannot discover them.
+	CanList *bool `json:"can_list,omitempty"`
+	CanRead *bool `json:"can_read,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func getTokenInfo(tokenStr string) (*regexp.Regexp, error) {
+// Whether the claims allow listing directories; requests without a token
+// (public-read prefixes, share links) are decided elsewhere
+func (c *Claims) listAllowed() bool {
+	return c == nil || c.CanList == nil || *c.CanList
+}
+
+// Whether the claims allow reading object contents and metadata
+func (c *Claims) readAllowed() bool {
+	return c == nil || c.CanRead == nil || *c.CanRead
+}
+
+// Refuse a GET of target the token's can_list/can_read claims exclude,
+// reporting whether the request may go on. A generated index.json is the
+// directory's listing under another name, so it needs what listing needs.
+func checkReadClaims(w http.ResponseWriter, r *http.Request, target string, isDir bool) bool {
+	claims := tokenClaims(r)
+	if !isDir && isDirIndex(filepath.Base(target)) {
+		isDir = true
+		dir := "" // as GET dir/ names it
+		if rel := storageRel(storageParent(target)); rel != "." {
+			dir = rel + "/"
+		}
+		if re := tokenRegex(r); re != nil && !pathAllowed(re, dir) {
+			writePathForbidden(w, r)
+			return false
+		}
+	}
+	if isDir && !claims.listAllowed() {
+		writeError(w, r, http.StatusForbidden, errorEnvelope{Code: "list_not_allowed", Error: "Forbidden: token does not allow listing"})
+		return false
+	}
+	if !isDir && !claims.readAllowed() {
+		writeError(w, r, http.StatusForbidden, errorEnvelope{Code: "read_not_allowed", Error: "Forbidden: token does not allow reading objects"})
+		return false
+	}
+	return true
+}
+
+// Verify the token signature and standard claims (exp, nbf, ...)
+func parseClaims(tokenStr string) (*Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenStr, &Claims{}, func(token *jwt.Token) (interface{}, error) {
 		return Secret, nil
-	})
+	}, jwt.WithTimeFunc(now))
 	if err != nil {
 		return nil, err
 	}
 	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
-		re, err := regexp.Compile(claims.Path)
-		if err != nil {
-			return nil, err
-		}
-		return re, nil
+		return claims, nil
 	}
 	return nil, errors.New("invalid token claims")
 }
 
+func getTokenInfo(tokenStr string) (*Claims, *regexp.Regexp, error) {
+	claims, err := parseClaims(tokenStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	re, err := compilePathClaim(tokenPathPattern(claims))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errBadPathClaim, err)
+	}
+	return claims, re, nil
+}
+
+var errBadPathClaim = errors.New("invalid path claim")
+
+// Response for a token getTokenInfo rejected: 400 when it is not a usable
+// JWT at all, 401 when it is one but cannot be accepted (bad signature,
+// expired, not yet valid). A valid token that does not cover the path is
+// the caller's 403.
+func tokenError(err error) (int, errorEnvelope) {
+	switch {
+	case errors.Is(err, jwt.ErrTokenMalformed), errors.Is(err, errBadPathClaim):
+		return http.StatusBadRequest, errorEnvelope{Code: "malformed_token", Error: "Malformed token"}
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return http.StatusUnauthorized, errorEnvelope{Code: "token_expired", Error: "Token expired"}
+	}
+	return http.StatusUnauthorized, errorEnvelope{Code: "invalid_token", Error: "Invalid token"}
+}
+
+// Path regex a token grants. With PATH_TEMPLATE set, a token carrying a
+// subject gets the template with {sub} filled in (quoted, so it matches
+// literally); otherwise the explicit path claim is used.
+func tokenPathPattern(claims *Claims) string {
+	if PathTemplate == "" || claims.Subject == "" {
+		return claims.Path
+	}
+	sub := claims.Subject
+	if strings.Contains(sub, "/") || sub == "." || sub == ".." {
+		return `$^` // a subject that could escape its namespace grants nothing
+	}
+	return strings.ReplaceAll(PathTemplate, "{sub}", regexp.QuoteMeta(sub))
+}
+
+type tokenRegexKey struct{}
+type tokenClaimsKey struct{}
+
+// Path regex of the token that authorized the request, if any
+func tokenRegex(r *http.Request) *regexp.Regexp {
+	re, _ := r.Context().Value(tokenRegexKey{}).(*regexp.Regexp)
+	return re
+}
+
+// Claims of the token that authorized the request, if any
+func tokenClaims(r *http.Request) *Claims {
+	c, _ := r.Context().Value(tokenClaimsKey{}).(*Claims)
+	return c
+}
+
+// Whether a token's path regex grants the storage path rel. Every
+// authorization decision goes through here and sees only the object path,
+// "/" followed by what comes after the token segment, never the token
+// itself, so no claim can be written to match on credentials.
+func pathAllowed(re *regexp.Regexp, rel string) bool {
+	return re.MatchString("/" + strings.TrimPrefix(rel, "/"))
+}
+
 // Auth middleware to check token and path regex
 func authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		uri := r.Header.Get("X-Original-URI")
-		if uri == "" {
-			uri = r.URL.Path
+		// nginx auth_request subrequests describe the client's request in
+		// X-Original-URI and X-Original-Method. Everything below, auth and
+		// audit alike, looks only at that request, and a subrequest is only
+		// ever answered with the decision, never dispatched.
+		subrequest := r.Header.Get("X-Original-URI") != ""
+		if subrequest {
+			w = &subrequestWriter{ResponseWriter: w}
+		}
+		if n := len(r.Header.Get("X-Original-URI")); n > MaxURILength || len(r.URL.Path) > MaxURILength {
+			debugf("[authMiddleware] URI too long: %d bytes\n", max(n, len(r.URL.Path)))
+			writeError(w, r, http.StatusRequestURITooLong, errorEnvelope{Code: "uri_too_long", Error: "URI too long", Limit: int64(MaxURILength)})
+			return
+		}
+		if subrequest {
+			r = originalRequest(r)
+		}
+		uri := r.URL.Path
+		debugf("[authMiddleware] %s %s\n", r.Method, redactToken(uri))
+
+		// Public-read prefixes and public-read objects skip token parsing for
+		// reads; writes still need a token
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			if rel, ok := publicReadPath(uri); ok {
+				if subrequest {
+					authOKHandler(w, r, rel)
+					return
+				}
+				serveObject(w, r, rel)
+				return
+			}
 		}
-		// fmt.Printf("[authMiddleware] Method: %s, URI: %s, X-Original-URI: %s, URL.Path: %s\n", r.Method, uri, r.Header.Get("X-Original-URI"), r.URL.Path)
 
 		parts := strings.SplitN(strings.TrimPrefix(uri, "/"), "/", 2)
 		if len(parts) < 2 {
-			fmt.Println("[authMiddleware] Missing token in URI:", uri)
-			http.Error(w, "Missing token", http.StatusUnauthorized)
+			debugf("[authMiddleware] Missing token in URI: %s\n", redactToken(uri))
+			audit(r, "auth_failure", uri, http.StatusUnauthorized, "missing token")
+			httpError(w, r, "Missing token", http.StatusUnauthorized)
 			return
 		}
 		token := parts[0]
-		fullPath := "/" + parts[1]
-		// fmt.Printf("[authMiddleware] Token: %s, FullPath: %s\n", token, fullPath)
+		fullPath, err := sanitizePath("/" + parts[1])
+		if err == nil {
+			err = checkCanonicalPath(fullPath)
+		}
+		if err != nil {
+			status := http.StatusBadRequest
+			if subrequest {
+				status = authRequestStatus(status)
+			}
+			debugf("[authMiddleware] Bad path: %q %v\n", parts[1], err)
+			audit(r, "auth_failure", "/"+parts[1], status, err.Error())
+			httpError(w, r, err.Error(), status)
+			return
+		}
+		claims, re, err := getTokenInfo(token)
+		if err != nil {
+			status, env := tokenError(err)
+			if subrequest && status == http.StatusBadRequest {
+				status = http.StatusUnauthorized // auth_request treats anything else as an error
+			}
+			debugf("[authMiddleware] Invalid token: %s %v\n", fullPath, err)
+			audit(r, "auth_failure", fullPath, status, strings.ReplaceAll(env.Code, "_", " "))
+			writeError(w, r, status, env)
+			return
+		}
 
-		re, err := getTokenInfo(token)
-		if err != nil || re == nil {
-			fmt.Printf("[authMiddleware] Invalid token: %s %v\n", fullPath, err)
-			http.Error(w, "Forbidden: Invalid token", http.StatusForbidden)
+		// A ?cas upload names the directory its object is created in, and is
+		// authorized for that directory alone
+		if r.Method == http.MethodPost && r.URL.Query().Has("cas") && !strings.HasSuffix(fullPath, "/") {
+			fullPath += "/"
+		}
+		if !pathAllowed(re, fullPath) {
+			debugf("[authMiddleware] Path not allowed: %s (regex: %s)\n", fullPath, re.String())
+			r = r.WithContext(context.WithValue(r.Context(), tokenClaimsKey{}, claims))
+			if subrequest {
+				// auth_request only understands 401 and 403 as refusals
+				audit(r, "auth_failure", fullPath, http.StatusForbidden, "path not allowed")
+				httpError(w, r, "Forbidden: Path not allowed", http.StatusForbidden)
+				return
+			}
+			sw := &statusWriter{ResponseWriter: w}
+			writePathForbidden(sw, r)
+			audit(r, "auth_failure", fullPath, sw.status, "path not allowed")
 			return
 		}
 
-		if !re.MatchString(fullPath) {
-			fmt.Printf("[authMiddleware] Path not allowed: %s (regex: %s)\n", fullPath, re.String())
-			http.Error(w, "Forbidden: Path not allowed", http.StatusForbidden)
+		debugf("[authMiddleware] Auth OK %s\n", fullPath)
+		ctx := context.WithValue(r.Context(), tokenRegexKey{}, re)
+		r = r.WithContext(context.WithValue(ctx, tokenClaimsKey{}, claims))
+
+		// Read-only mode wins over whatever the token grants
+		if ReadOnly && isWriteMethod(r.Method) {
+			audit(r, auditEventName(r), fullPath, http.StatusForbidden, "read-only mode")
+			writeError(w, r, http.StatusForbidden, errorEnvelope{Code: "read_only", Error: "Forbidden: server is read-only"})
+			return
+		}
+		if isWriteMethod(r.Method) && isDirIndex(path.Base(fullPath)) {
+			writeError(w, r, http.StatusConflict, errorEnvelope{Code: "reserved_name", Error: errReservedName.Error()})
 			return
 		}
 
-		fmt.Println("[authMiddleware] Auth OK", fullPath)
+		// nginx auth_request subrequests only need the decision
+		if subrequest {
+			authOKHandler(w, r, parts[1])
+			return
+		}
 
-		// For PUT and DELETE, continue to the next handler
-		if r.Method == http.MethodPut || r.Method == http.MethodDelete {
+		if isUploadRequest(r) {
+			limit := uploadLimitFor(claims)
+			release, ok := acquireUpload(uploadKey(token, claims), limit)
+			if !ok {
+				debugf("[authMiddleware] Too many concurrent uploads: %s\n", fullPath)
+				audit(r, auditEventName(r), fullPath, http.StatusTooManyRequests, "too many concurrent uploads")
+				writeTooManyUploadsError(w, r, limit)
+				return
+			}
+			defer release()
+		}
+
+		// For PUT, POST, PATCH, DELETE, MOVE and MKCOL, continue to the next handler
+		if r.Method == http.MethodPut || r.Method == http.MethodPost || r.Method == http.MethodPatch || r.Method == http.MethodDelete || r.Method == "MOVE" || r.Method == "MKCOL" {
+			if !auditEnabled() {
+				next.ServeHTTP(w, r)
+				return
+			}
+			sw := &statusWriter{ResponseWriter: w}
+			next.ServeHTTP(sw, r)
+			audit(r, auditEventName(r), fullPath, sw.status, "")
+			return
+		}
+
+		// Direct GET/HEAD serves the file or listing
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		// For GET and others, call defaultHandler directly
 		defaultHandler(w, r)
 	})
 }
 
-// Default handler for unmatched routes
-func defaultHandler(w http.ResponseWriter, r *http.Request) {
+// Per-request log lines, off unless DEBUG is set
+func debugf(format string, args ...any) {
+	if Debug {
+		fmt.Printf(format, args...)
+	}
+}
+
+// Mask the token segment of a request path before logging it
+func redactToken(uri string) string {
+	if i := strings.Index(strings.TrimPrefix(uri, "/"), "/"); i >= 0 {
+		return "/***" + uri[i+1:]
+	}
+	return "/***"
+}
+
+// The client request an nginx auth_request subrequest stands for: the path
+// and query of X-Original-URI and the method in X-Original-Method (GET when
+// nginx does not send it)
+func originalRequest(r *http.Request) *http.Request {
+	orig := r.Clone(r.Context())
+	uri := r.Header.Get("X-Original-URI")
+	if u, err := url.ParseRequestURI(uri); err == nil {
+		orig.URL.Path, orig.URL.RawPath, orig.URL.RawQuery = u.Path, u.RawPath, u.RawQuery
+	} else {
+		orig.URL.Path, orig.URL.RawPath, orig.URL.RawQuery = uri, "", ""
+	}
+	orig.RequestURI = uri
+	orig.Method = http.MethodGet
+	if m := r.Header.Get("X-Original-Method"); m != "" {
+		orig.Method = strings.ToUpper(m)
+	}
+	return orig
+}
+
+// Methods that modify storage
+func isWriteMethod(method string) bool {
+	switch method {
+	case http.MethodPut, http.MethodPost, http.MethodDelete, http.MethodPatch, "MOVE", "COPY", "MKCOL":
+		return true
+	}
+	return false
+}
+
+// Auth decision for nginx auth_request subrequests. Allowed reads name
+// the file's internal location when ACCEL_REDIRECT_PREFIX is set: the
+// resolved object, after aliases and key normalization, not the request path.
+func authOKHandler(w http.ResponseWriter, r *http.Request, relPath string) {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		target, err := resolvePath(relPath)
+		if err != nil {
+			httpError(w, r, err.Error(), http.StatusForbidden) // auth_request only understands 401 and 403
+			return
+		}
+		info, err := os.Stat(target)
+		if !checkReadClaims(w, r, target, err == nil && info.IsDir()) {
+			return
+		}
+		if AccelRedirectPrefix != "" {
+			w.Header().Set("X-Accel-Redirect", accelRedirectURI(storageRel(target)))
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]any{"message": "OK"})
 }
 
+// Root and health probe, the only unauthenticated 200 besides /version
+func rootHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" && r.URL.Path != "/healthz" {
+		defaultHandler(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(RootResponse)
+}
+
+// Default handler for unmatched routes
+func defaultHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, r, http.StatusMethodNotAllowed, errorEnvelope{Code: "method_not_allowed", Error: "Method not allowed"})
+		return
+	}
+	writeError(w, r, http.StatusNotFound, errorEnvelope{Code: "not_found", Error: "Not found"})
+}
+
+// Refuse a path the token does not cover. With HIDE_FORBIDDEN the answer is
+// the 404 a missing object gets, so probing outside the token's scope
+// reveals nothing about what exists there.
+func writePathForbidden(w http.ResponseWriter, r *http.Request) {
+	if HideForbidden {
+		writeError(w, r, http.StatusNotFound, errorEnvelope{Code: "not_found", Error: "Not found"})
+		return
+	}
+	httpError(w, r, "Forbidden: Path not allowed", http.StatusForbidden)
+}
+
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPut {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
 	if len(parts) < 2 {
-		http.Error(w, "Invalid path", http.StatusBadRequest)
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
 		return
 	}
 	relPath := parts[1]
-	dest := filepath.Join(StorageDir, relPath)
+	if PathPlaceholders {
+		// The token must allow the generated path as well as the literal one
+		expanded, err := expandPlaceholders(r, relPath)
+		if err != nil {
+			httpError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if re := tokenRegex(r); re != nil && !pathAllowed(re, expanded) {
+			writePathForbidden(w, r)
+			return
+		}
+		relPath = expanded
+	}
+	dest, err := resolvePath(relPath)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if dest == filepath.Clean(StorageDir) {
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
+		return
+	}
 
-	// Create parent directories if not exist
-	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	unlock, err := lockPathsFor(r, dest)
 	if err != nil {
-		http.Error(w, "Failed to create directories: "+err.Error(), http.StatusInternalServerError)
+		writeWriteInProgress(w, r)
 		return
 	}
+	defer unlock()
+
+	// Create-only uploads: "If-None-Match: *" fails when the object exists.
+	// The path lock is held until the rename, so the check cannot go stale.
+	if noneMatch := r.Header.Get("If-None-Match"); noneMatch != "" {
+		current := ""
+		if info, err := os.Stat(dest); err == nil && !info.IsDir() {
+			current, _ = objectETag(dest, info)
+		}
+		if ifMatch(noneMatch, current) {
+			writeError(w, r, http.StatusPreconditionFailed, errorEnvelope{Code: "precondition_failed", Error: "Object already exists"})
+			return
+		}
+	}
 
-	// Create destination file
-	out, err := os.Create(dest)
+	if err := checkDirCapacity(dest); err != nil {
+		writeDirFullError(w, r, dest)
+		return
+	}
+	if err := checkKeyCase(dest, ""); err != nil {
+		writeKeyCaseError(w, r, err)
+		return
+	}
+	if err := checkRetention(dest); err != nil {
+		writeRetentionError(w, r, err)
+		return
+	}
+	objectsLeft, scope, err := checkObjectLimit(r, dest, "")
 	if err != nil {
-		http.Error(w, "Failed to create file: "+err.Error(), http.StatusInternalServerError)
+		writeObjectLimitError(w, r, scope)
 		return
 	}
-	defer out.Close()
 
-	// Stream request body to file
-	if _, err := io.Copy(out, r.Body); err != nil {
-		http.Error(w, "Failed to write file: "+err.Error(), http.StatusInternalServerError)
+	// With QUARANTINE the bytes go to the held copy; everything else about
+	// the upload is decided by dest
+	target := uploadTarget(dest)
+
+	// Refuse up front when the declared size cannot fit in the quota
+	oldSize := fileSize(target)
+	if remaining := quotaRemaining(oldSize); remaining >= 0 && r.ContentLength > remaining {
+		writeQuotaError(w, r)
 		return
 	}
 
-	fmt.Printf("uploaded %s\n", relPath)
+	policy := policyFor(storageRel(dest))
+	if ct := r.Header.Get("Content-Type"); !policy.allowsContentType(ct) {
+		writeContentTypeError(w, r, ct)
+		return
+	}
+	limit, byToken := fileLimitFor(tokenClaims(r), dest)
+
+	// Everything above is decided from headers alone. Refusing an oversized
+	// declared length here too means a client waiting on "Expect:
+	// 100-continue" gets the error instead of a 100 and never sends the body;
+	// net/http only sends the 100 once the body is first read.
+	if limit > 0 && r.ContentLength > limit {
+		writeFileTooLarge(w, r, "Failed to upload", limit, byToken)
+		return
+	}
+
+	body := io.Reader(r.Body)
+	if limit > 0 {
+		body = http.MaxBytesReader(w, r.Body, limit)
+	}
 
+	// Content-Encoding alone means "store these bytes as sent". With
+	// X-Decompress: true the body is decoded and the plain bytes are stored.
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	if encoding == "identity" {
+		encoding = ""
+	}
+	if strings.EqualFold(r.Header.Get("X-Decompress"), "true") {
+		if encoding != "gzip" {
+			httpError(w, r, "X-Decompress requires Content-Encoding: gzip", http.StatusBadRequest)
+			return
+		}
+		zr, err := gunzip(body)
+		if err != nil {
+			writeStorageError(w, r, "Failed to upload", err)
+			return
+		}
+		body = limitReader(zr, limit) // cap the decoded size too
+		encoding = ""
+	}
+	body = quotaLimit(body, oldSize)
+
+	// Clients streaming large bodies can ask for the server-side digest as a trailer
+	var digest hash.Hash
+	wantTrailer := strings.EqualFold(r.Header.Get("X-Checksum-Trailer"), "true")
+	if wantTrailer {
+		digest = sha256.New()
+		body = io.TeeReader(body, digest)
+	}
+
+	// Stream request body to file, creating parent directories if not exist.
+	// "X-Write-Mode: direct" opts out of the atomic temp-file-and-rename.
+	direct := strings.EqualFold(r.Header.Get("X-Write-Mode"), "direct")
+	write := writeObject
+	if direct {
+		write = writeObjectDirect
+	}
+	n, err := write(target, body)
+	if err != nil && direct {
+		// The previous content was truncated away along with the failed write
+		addUsage(-oldSize)
+		metaStore.Delete(target)
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		writeQuotaError(w, r)
+		return
+	}
+	if errors.Is(err, errTooLarge) {
+		writeFileTooLarge(w, r, "Failed to upload", limit, byToken)
+		return
+	}
+	if err != nil {
+		noteCanceled(r, "upload")
+		writeStorageError(w, r, "Failed to upload", err)
+		return
+	}
+	addUsage(n - oldSize)
+
+	// Bodies stored with their Content-Encoding keep it in metadata so
+	// downloads can label (or decode) them correctly
+	if encoding != "" || hasMeta(target) {
+		err := updateMeta(target, func(m *objectMeta) {
+			m.Path = storageRel(target)
+			m.ContentEncoding = encoding
+		})
+		if err != nil {
+			writeStorageError(w, r, "Failed to write metadata", err)
+			return
+		}
+	}
+
+	debugf("uploaded %s\n", relPath)
+
+	if objectsLeft >= 0 {
+		w.Header().Set("X-Objects-Remaining", strconv.FormatInt(objectsLeft, 10))
+	}
+	if info, err := os.Stat(target); err == nil {
+		setTimeHeaders(w, info.ModTime())
+		if etag, err := objectETag(target, info); err == nil {
+			w.Header().Set("ETag", etag)
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]any{"success": true, "path": relPath})
+	if wantTrailer {
+		w.Header().Set("Trailer", "X-Checksum-SHA256")
+	}
+	resp := map[string]any{"success": true, "path": storageRel(dest)}
+	if target != dest {
+		resp["quarantined"] = true
+	}
+	json.NewEncoder(w).Encode(resp)
+	if wantTrailer {
+		w.Header().Set("X-Checksum-SHA256", hex.EncodeToString(digest.Sum(nil)))
+	}
 }
 
 func deleteHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodDelete {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	// Extract token and path: /{token}/path/to/file
 	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
 	if len(parts) < 2 {
-		http.Error(w, "Invalid path", http.StatusBadRequest)
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
 		return
 	}
 	relPath := parts[1]
-	target := filepath.Join(StorageDir, relPath)
+	target, err := resolvePath(relPath)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if target == filepath.Clean(StorageDir) {
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
+		return
+	}
 
-	if _, err := os.Stat(target); os.IsNotExist(err) {
-		http.Error(w, "Not found", http.StatusNotFound)
+	unlock, err := lockPathsFor(r, target)
+	if err != nil {
+		writeWriteInProgress(w, r)
 		return
 	}
+	defer unlock()
 
-	// Delete the file
-	if err := os.Remove(target); err != nil {
-		http.Error(w, "Failed to delete: "+err.Error(), http.StatusInternalServerError)
+	info, err := os.Stat(target)
+
+	// Compare-and-delete: refuse when the object changed since the client saw it
+	if match := r.Header.Get("If-Match"); match != "" {
+		current := ""
+		if err == nil && !info.IsDir() {
+			current, _ = objectETag(target, info)
+		}
+		if !ifMatch(match, current) {
+			writeError(w, r, http.StatusPreconditionFailed, errorEnvelope{Code: "precondition_failed", Error: "If-Match does not match the current ETag"})
+			return
+		}
+	}
+
+	if os.IsNotExist(err) {
+		// Idempotent clients treat "already gone" as success; nothing to clean up
+		if DeleteMissingOK || strings.EqualFold(r.Header.Get("X-Idempotent"), "true") {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{"success": true, "deleted": false})
+			return
+		}
+		httpError(w, r, "Not found", http.StatusNotFound)
+		return
+	}
+	if err := checkRetention(target); err != nil {
+		writeRetentionError(w, r, err)
+		return
+	}
+
+	if err := deleteObject(target); err != nil {
+		writeStorageError(w, r, "Failed to delete", err)
 		return
 	}
 
-	// Remove empty parent directories up to storage root
-	dir := filepath.Dir(target)
-	stop := filepath.Clean(StorageDir)
-	for strings.HasPrefix(dir, stop) && dir != stop {
+	debugf("deleted %s\n", relPath)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"success": true, "deleted": true})
+}
+
+// Delete an object with its sidecars, then any directories left empty up to
+// the storage root. The caller holds the path lock.
+func deleteObject(target string) error {
+	if err := checkReservedName(target); err != nil {
+		return err
+	}
+	size := fileSize(target)
+	if err := os.Remove(target); err != nil {
+		return err
+	}
+	removeSidecars(target)
+	addUsage(-size)
+	noteDirEntry(target, -1)
+	invalidateDirSizes(target)
+	removeEmptyParents(filepath.Dir(target))
+	publishEvent("deleted", target, "", 0)
+	return nil
+}
+
+func removeEmptyParents(dir string) {
+	for insideStorage(dir) {
 		files, err := os.ReadDir(dir)
-		if err != nil || len(files) > 0 {
+		if err != nil || len(files) > 1 || len(files) == 1 && !isDirIndex(files[0].Name()) {
 			break
 		}
+		noteOwnWrite(dir)
+		if len(files) == 1 {
+			os.Remove(filepath.Join(dir, files[0].Name())) // the index of nothing
+		}
 		os.Remove(dir)
+		invalidateDirCounts(dir)
 		dir = filepath.Dir(dir)
 	}
-
-	fmt.Printf("deleted %s\n", relPath)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]any{"success": true})
 }
 
 func main() {
@@ -186,6 +750,15 @@ func main() {
 		Secret = []byte(s)
 	}
 
+	// Client subcommands print only their own output
+	if len(os.Args) > 1 && cliCommands[os.Args[1]] != nil {
+		if errs := loadConfig(); len(errs) > 0 {
+			fmt.Fprintln(os.Stderr, errs)
+			os.Exit(1)
+		}
+		os.Exit(runCLI(os.Args[1], os.Args[2:]))
+	}
+
 	// Log the secret with ***
 	secretLen := len(Secret)
 	if secretLen > 0 {
@@ -195,26 +768,234 @@ func main() {
 		fmt.Println("No SECRET loaded!")
 	}
 
+	// Report every problem before touching storage or serving anything
+	errs := loadConfig()
+	if !ReadOnly {
+		errs = append(errs, checkStorageWritable()...)
+	}
+	if len(errs) > 0 {
+		fmt.Fprintln(os.Stderr, errs)
+		os.Exit(1)
+	}
+	if ConfigDump {
+		dumpConfig()
+	}
+	if string(Secret) == defaultSecret {
+		fmt.Println("*** WARNING: SECRET is the built-in default, anyone can mint tokens for this server. Set SECRET; REQUIRE_SECRET=true refuses to start without one ***")
+	}
+
+	// objectstorage migrate-metadata: index existing sidecars into METADATA_DB
+	if len(os.Args) > 1 && os.Args[1] == "migrate-metadata" {
+		if err := migrateMetadata(); err != nil {
+			fmt.Fprintf(os.Stderr, "Migration failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if TmpDir != "" {
+		if err := os.MkdirAll(TmpDir, DirMode); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create TMP_DIR: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := initVolumes(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create STORAGE_VOLUMES: %v\n", err)
+		os.Exit(1)
+	}
+	if err := initAudit(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open AUDIT_LOG: %v\n", err)
+		os.Exit(1)
+	}
+	if err := loadPrefixConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := initMetadataStore(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	initStorageUsage()
+	if err := checkDirIndexNames(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if MetricsEnabled {
+		initSizeMetrics()
+	}
+	if WatchStorage {
+		if err := startWatcher(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to watch the storage directory: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	loadIdempotencyKeys()
+	startIdempotencySweeper()
+	loadAliases()
+	loadShares()
+	startPartSweeper()
+	if Quarantine {
+		startQuarantineSweeper()
+	}
+	initVersionInfo()
+	fmt.Printf("Using DIR_MODE %04o, FILE_MODE %04o\n", DirMode, FileMode)
+	fmt.Printf("Using %s metadata store\n", MetadataStoreKind)
+	if ReadOnly {
+		fmt.Println("*** READ-ONLY mode: PUT, POST, DELETE, PATCH, MOVE, COPY and MKCOL are refused with 403 ***")
+	}
+
+	handler := buildHandler()
+	srv := &http.Server{
+		Addr:              ":8000",
+		Handler:           handler,
+		ReadHeaderTimeout: ReadHeaderTimeout,
+		ReadTimeout:       ReadTimeout,
+		WriteTimeout:      WriteTimeout,
+		IdleTimeout:       IdleTimeout,
+		MaxHeaderBytes:    MaxHeaderBytes,
+	}
+
+	var err error
+	if TLSCert != "" {
+		fmt.Println("Server listening on :8000 (TLS)")
+		err = srv.ListenAndServeTLS(TLSCert, TLSKey)
+	} else {
+		fmt.Println("Server listening on :8000")
+		err = srv.ListenAndServe()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Server failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// The full request handler, routes and middleware, for the configuration
+// already loaded
+func buildHandler() http.Handler {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		contextBody(r)
+		minRateBody(w, r)
+		if isUploadRequest(r) {
+			liftRequestDeadline(r)
+		}
 		if strings.HasPrefix(r.URL.Path, "/") {
+			q := r.URL.Query()
+			if isMkdirRequest(r) {
+				mkdirHandler(w, r)
+				return
+			}
+			if r.Method == http.MethodPut && q.Has("uploadId") {
+				uploadPartHandler(w, r)
+				return
+			}
+			if r.Method == http.MethodPut && q.Has("acl") {
+				aclHandler(w, r)
+				return
+			}
+			if r.Method == http.MethodPut && q.Has("tags") {
+				tagsHandler(w, r)
+				return
+			}
+			if r.Method == http.MethodPut && q.Has("retention") {
+				retentionHandler(w, r)
+				return
+			}
 			if r.Method == http.MethodPut {
-				uploadHandler(w, r)
+				idempotent(uploadHandler)(w, r)
+				return
+			}
+			if r.Method == http.MethodPost && q.Has("uploads") {
+				createPartUploadHandler(w, r)
+				return
+			}
+			if r.Method == http.MethodPost && q.Has("uploadId") {
+				idempotent(completePartUploadHandler)(w, r)
+				return
+			}
+			if r.Method == http.MethodPost && q.Has("cas") {
+				idempotent(casUploadHandler)(w, r)
+				return
+			}
+			if r.Method == http.MethodPost && q.Has("share") {
+				shareHandler(w, r)
+				return
+			}
+			if r.Method == http.MethodPost && q.Has("delete") {
+				batchDeleteHandler(w, r)
+				return
+			}
+			if r.Method == http.MethodPost && q.Has("import") {
+				idempotent(tarImportHandler)(w, r)
+				return
+			}
+			if r.Method == http.MethodPost && isMultipart(r) {
+				idempotent(multipartUploadHandler)(w, r)
+				return
+			}
+			if r.Method == http.MethodPatch && q.Has("truncate") {
+				truncateHandler(w, r)
+				return
+			}
+			if r.Method == http.MethodDelete && q.Has("uploadId") {
+				abortPartUploadHandler(w, r)
 				return
 			}
 			if r.Method == http.MethodDelete {
 				deleteHandler(w, r)
 				return
 			}
+			if r.Method == "MOVE" {
+				moveHandler(w, r)
+				return
+			}
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				downloadHandler(w, r)
+				return
+			}
 		}
 		defaultHandler(w, r)
 	})
 
-	fmt.Println("Server listening on :8000")
-	err := http.ListenAndServe(":8000", authMiddleware(mux))
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Server failed: %v\n", err)
-		os.Exit(1)
+	// Unauthenticated endpoints, everything else goes through the token check
+	root := http.NewServeMux()
+	root.HandleFunc("/healthz", rootHandler)
+	root.HandleFunc("/version", versionHandler)
+	root.HandleFunc("/readyz", readyzHandler)
+	if AdminSecret != "" {
+		root.HandleFunc("/admin/drain", requireAdmin(drainHandler(true)))
+		root.HandleFunc("/admin/undrain", requireAdmin(drainHandler(false)))
+		root.HandleFunc("/admin/promote", requireAdmin(promoteHandler))
+		root.HandleFunc("/admin/quarantine", requireAdmin(quarantineListHandler))
+		root.HandleFunc("/admin/compact", requireAdmin(compactHandler))
+		root.HandleFunc("/admin/shares", requireAdmin(adminSharesHandler))
+		root.HandleFunc("/admin/shares/", requireAdmin(adminSharesHandler))
+	}
+	if MetricsEnabled {
+		root.Handle("/metrics", promhttp.Handler())
+	}
+	if UIEnabled {
+		root.HandleFunc("/ui", uiHandler)
+		root.HandleFunc("/ui/", uiHandler)
+	}
+	root.HandleFunc("/s/", sharedDownloadHandler)
+	introspectLimiter = newIPRateLimiter(IntrospectRateLimit, time.Minute)
+	root.Handle("/token/introspect", rateLimit(introspectLimiter, http.HandlerFunc(introspectHandler)))
+	authed := authMiddleware(mux)
+	root.HandleFunc("/auth", authDecisionHandler(authed))
+	root.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			rootHandler(w, r)
+			return
+		}
+		authed.ServeHTTP(w, r)
+	})
+
+	handler := timeRequests(cors(boundRequests(root)))
+	if H2C {
+		handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: IdleTimeout})
 	}
+	return handler
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Start the full handler on a fresh storage directory
+func newTestServer(t testing.TB) *httptest.Server {
+	t.Helper()
+	StorageDir = t.TempDir()
+	state := t.TempDir()
+	IdempotencyFile = filepath.Join(state, "idempotency.json")
+	AliasFile = filepath.Join(state, "aliases.json")
+	ShareFile = filepath.Join(state, "shares.json")
+	Secret = []byte("test-secret")
+	metaStore = sidecarStore{}
+	initStorageUsage()
+	srv := httptest.NewServer(buildHandler())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func testToken(t testing.TB, pathRegex string) string {
+	t.Helper()
+	tok, err := mintToken(Claims{Path: pathRegex}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok
+}
+
+func doRequest(t *testing.T, method, url, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func decodeEnvelope(t *testing.T, resp *http.Response) errorEnvelope {
+	t.Helper()
+	var env errorEnvelope
+	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
+		t.Fatalf("error body is not a JSON envelope: %v", err)
+	}
+	return env
+}
+
+func TestPutGetDelete(t *testing.T) {
+	srv := newTestServer(t)
+	base := srv.URL + "/" + testToken(t, "^/data/.*") + "/data/a.txt"
+
+	if resp := doRequest(t, http.MethodPut, base, "hello"); resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT: status %d", resp.StatusCode)
+	}
+	if b, err := os.ReadFile(filepath.Join(StorageDir, "data", "a.txt")); err != nil || string(b) != "hello" {
+		t.Fatalf("stored %q, %v", b, err)
+	}
+
+	resp := doRequest(t, http.MethodGet, base, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET: status %d", resp.StatusCode)
+	}
+	if got := readBody(t, resp); got != "hello" {
+		t.Fatalf("GET body %q", got)
+	}
+
+	if resp := doRequest(t, http.MethodDelete, base, ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("DELETE: status %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, http.MethodGet, base, ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET after DELETE: status %d", resp.StatusCode)
+	}
+}
+
+func TestTokenPathRegexEnforced(t *testing.T) {
+	srv := newTestServer(t)
+	tok := testToken(t, "^/data/a/.*")
+
+	resp := doRequest(t, http.MethodPut, srv.URL+"/"+tok+"/data/b/x.txt", "nope")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("PUT outside the token: status %d", resp.StatusCode)
+	}
+	if env := decodeEnvelope(t, resp); env.Code != "forbidden" {
+		t.Fatalf("code %q", env.Code)
+	}
+	if _, err := os.Stat(filepath.Join(StorageDir, "data", "b", "x.txt")); !os.IsNotExist(err) {
+		t.Fatalf("file outside the token was written: %v", err)
+	}
+
+	if resp := doRequest(t, http.MethodPut, srv.URL+"/"+tok+"/data/a/x.txt", "yes"); resp.StatusCode >= 300 {
+		t.Fatalf("PUT inside the token: status %d", resp.StatusCode)
+	}
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	srv := newTestServer(t)
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/not-a-token/data/a.txt", "")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("malformed token: status %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	env := decodeEnvelope(t, resp)
+	if env.Success || env.Code != "malformed_token" || env.Error == "" {
+		t.Fatalf("envelope %+v", env)
+	}
+
+	// Signed with another secret
+	Secret = []byte("rotated")
+	forged := testToken(t, "^/data/.*")
+	Secret = []byte("test-secret")
+	resp = doRequest(t, http.MethodGet, srv.URL+"/"+forged+"/data/a.txt", "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("bad signature: status %d", resp.StatusCode)
+	}
+	if env := decodeEnvelope(t, resp); env.Code != "invalid_token" {
+		t.Fatalf("code %q", env.Code)
+	}
+
+	resp = doRequest(t, http.MethodGet, srv.URL+"/"+testToken(t, "^/data/.*")+"/data/missing.txt", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("missing object: status %d", resp.StatusCode)
+	}
+	if env := decodeEnvelope(t, resp); env.Code != "not_found" {
+		t.Fatalf("code %q", env.Code)
+	}
+}
+
+func TestAuthRequestRefusalsAre403(t *testing.T) {
+	srv := newTestServer(t)
+	tok := testToken(t, "^/data/.*")
+	doRequest(t, http.MethodPut, srv.URL+"/"+tok+"/data/a.txt", "a")
+	for uri, want := range map[string]int{
+		"/" + tok + "/data/a.txt":                           http.StatusOK,
+		"/" + tok + "/data/../etc/passwd":                   http.StatusForbidden,
+		"/" + tok + "/data//a.txt":                          http.StatusForbidden,
+		"/" + tok + "/data/a%01.txt":                        http.StatusForbidden,
+		"/" + tok + "/other/a.txt":                          http.StatusForbidden,
+		"/not-a-token/data/a.txt":                           http.StatusUnauthorized,
+		"/" + tok + "/" + strings.Repeat("x", MaxURILength): http.StatusForbidden,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/auth-check", nil)
+		req.Header.Set("X-Original-URI", uri)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%.60s: status %d, want %d", uri, resp.StatusCode, want)
+		}
+	}
+}
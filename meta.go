@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Sidecars live next to their object and travel with it on move/delete:
+//   - <name>.meta.json        objectMeta for the object (sidecar metadata store)
+//   - .versions/<name>/       previous versions of the object
+const (
+	metaSuffix  = ".meta.json"
+	versionsDir = ".versions"
+)
+
+// Per-object metadata stored in the .meta.json sidecar
+type objectMeta struct {
+	Path            string            `json:"path"` // object path relative to StorageDir
+	Tags            map[string]string `json:"tags,omitempty"`
+	ContentEncoding string            `json:"contentEncoding,omitempty"` // encoding the stored bytes are in, e.g. gzip
+	Checksums       *checksumCache    `json:"checksums,omitempty"`       // digests from ?checksum=
+	ACL             string            `json:"acl,omitempty"`             // "public-read" or empty for private
+	RetainUntil     string            `json:"retainUntil,omitempty"`     // RFC 3339; no overwrite, move or delete before then
+}
+
+func metaPath(obj string) string {
+	return obj + metaSuffix
+}
+
+func versionsPath(obj string) string {
+	return filepath.Join(filepath.Dir(obj), versionsDir, filepath.Base(obj))
+}
+
+// Whether a path segment names a sidecar or internal file clients may not address
+func isReservedName(seg string) bool {
+	return seg == versionsDir || seg == partsDir || seg == quarantineDir || seg == dirMarker || strings.HasSuffix(seg, metaSuffix) ||
+		(strings.HasPrefix(seg, ".upload-") && strings.HasSuffix(seg, ".tmp"))
+}
+
+// Whether an absolute path lies in internal storage (staged parts, versions, ...)
+func isInternalPath(p string) bool {
+	for _, seg := range strings.Split(storageRel(p), "/") {
+		if isReservedName(seg) {
+			return true
+		}
+	}
+	return false
+}
+
+// Where object metadata is kept. The object bytes always stay on disk;
+// only the metadata lookups go through the store.
+type MetadataStore interface {
+	// Get returns the object's metadata, empty when it has none
+	Get(obj string) (*objectMeta, error)
+	Put(obj string, m *objectMeta) error
+	Has(obj string) bool
+	Delete(obj string) error
+	// Move re-keys metadata after the object was renamed from src to dst
+	Move(src, dst string) error
+	// FindByTag lists objects under dir whose tag key equals value;
+	// truncated reports that the search stopped at MaxWalkDepth
+	FindByTag(dir, key, value string) (objs []string, truncated bool, err error)
+}
+
+var (
+	MetadataStoreKind = "sidecar"     // override with METADATA_STORE (sidecar|sqlite)
+	MetadataDB        = "metadata.db" // override with METADATA_DB, used by the sqlite store
+
+	metaStore MetadataStore = sidecarStore{}
+)
+
+// Select the metadata store; called once at startup
+func initMetadataStore() error {
+	switch MetadataStoreKind {
+	case "sidecar":
+		metaStore = sidecarStore{}
+	case "sqlite":
+		s, err := openSQLiteStore(MetadataDB)
+		if err != nil {
+			return err
+		}
+		metaStore = s
+	default:
+		return fmt.Errorf("invalid METADATA_STORE %q: expected sidecar or sqlite", MetadataStoreKind)
+	}
+	return nil
+}
+
+func readMeta(obj string) (*objectMeta, error) {
+	return metaStore.Get(obj)
+}
+
+func writeMeta(obj string, m *objectMeta) error {
+	return metaStore.Put(obj, m)
+}
+
+// Read-modify-write an object's metadata
+func updateMeta(obj string, fn func(m *objectMeta)) error {
+	m, err := readMeta(obj)
+	if err != nil {
+		return err
+	}
+	fn(m)
+	return writeMeta(obj, m)
+}
+
+func hasMeta(obj string) bool {
+	return metaStore.Has(obj)
+}
+
+// Remove an object's metadata and versions, ignoring ones that do not exist
+func removeSidecars(obj string) {
+	metaStore.Delete(obj)
+	os.RemoveAll(versionsPath(obj))
+	os.Remove(filepath.Dir(versionsPath(obj))) // only succeeds once .versions is empty
+}
+
+// Default store: a .meta.json file next to each object
+type sidecarStore struct{}
+
+func (sidecarStore) Get(obj string) (*objectMeta, error) {
+	m := &objectMeta{}
+	data, err := os.ReadFile(metaPath(obj))
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Atomically replace the sidecar
+func (sidecarStore) Put(obj string, m *objectMeta) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp, err := createTemp(filepath.Dir(obj))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), metaPath(obj))
+}
+
+func (sidecarStore) Has(obj string) bool {
+	_, err := os.Stat(metaPath(obj))
+	return err == nil
+}
+
+func (sidecarStore) Delete(obj string) error {
+	err := os.Remove(metaPath(obj))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Carry the sidecar along and keep its self-reference pointing at dst
+func (s sidecarStore) Move(src, dst string) error {
+	if !s.Has(src) {
+		return nil
+	}
+	if err := renamePath(metaPath(src), metaPath(dst)); err != nil {
+		return err
+	}
+	err := updateSidecarPath(s, dst)
+	if err != nil {
+		renamePath(metaPath(dst), metaPath(src))
+	}
+	return err
+}
+
+func updateSidecarPath(s sidecarStore, obj string) error {
+	m, err := s.Get(obj)
+	if err != nil {
+		return err
+	}
+	m.Path = storageRel(obj)
+	return s.Put(obj, m)
+}
+
+// Walk the tree reading every sidecar; the sqlite store answers from an index
+func (s sidecarStore) FindByTag(dir, key, value string) ([]string, bool, error) {
+	var found []string
+	truncated, err := walkStorage(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if p != dir && (d.Name() == versionsDir || d.Name() == partsDir || d.Name() == quarantineDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		obj, ok := strings.CutSuffix(p, metaSuffix)
+		if !ok {
+			return nil
+		}
+		if m, err := s.Get(obj); err == nil && m.Tags[key] == value {
+			if _, err := os.Stat(obj); err == nil {
+				found = append(found, obj)
+			}
+		}
+		return nil
+	})
+	return found, truncated, err
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// Metadata kept in a SQLite database keyed by path relative to StorageDir,
+// with tags in their own indexed table so tag queries skip the tree walk
+type sqliteStore struct {
+	db *sql.DB
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS objects (
+	path             TEXT PRIMARY KEY,
+	content_encoding TEXT NOT NULL DEFAULT '',
+	checksums        TEXT NOT NULL DEFAULT '',
+	acl              TEXT NOT NULL DEFAULT '',
+	retain_until     TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS tags (
+	path  TEXT NOT NULL,
+	key   TEXT NOT NULL,
+	value TEXT NOT NULL,
+	PRIMARY KEY (path, key)
+);
+CREATE INDEX IF NOT EXISTS tags_key_value ON tags (key, value);
+`
+
+func openSQLiteStore(file string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", file)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1) // one writer; avoids SQLITE_BUSY between pooled connections
+	if _, err := db.Exec("PRAGMA journal_mode=WAL;" + sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	// Databases created before the checksums, acl and retain_until columns existed
+	for _, col := range []string{"checksums", "acl", "retain_until"} {
+		if _, err := db.Exec("ALTER TABLE objects ADD COLUMN " + col + " TEXT NOT NULL DEFAULT ''"); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			db.Close()
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) Get(obj string) (*objectMeta, error) {
+	rel := storageRel(obj)
+	m := &objectMeta{}
+	var checksums string
+	err := s.db.QueryRow("SELECT content_encoding, checksums, acl, retain_until FROM objects WHERE path = ?", rel).Scan(&m.ContentEncoding, &checksums, &m.ACL, &m.RetainUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.Path = rel
+	if checksums != "" {
+		m.Checksums = &checksumCache{}
+		if err := json.Unmarshal([]byte(checksums), m.Checksums); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := s.db.Query("SELECT key, value FROM tags WHERE path = ?", rel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k, v string
+		if err := rows.Scan(&k, &v); err != nil {
+			return nil, err
+		}
+		if m.Tags == nil {
+			m.Tags = map[string]string{}
+		}
+		m.Tags[k] = v
+	}
+	return m, rows.Err()
+}
+
+func (s *sqliteStore) Put(obj string, m *objectMeta) error {
+	rel := storageRel(obj)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	checksums := ""
+	if m.Checksums != nil {
+		data, err := json.Marshal(m.Checksums)
+		if err != nil {
+			return err
+		}
+		checksums = string(data)
+	}
+	if _, err := tx.Exec("INSERT INTO objects (path, content_encoding, checksums, acl, retain_until) VALUES (?, ?, ?, ?, ?) ON CONFLICT (path) DO UPDATE SET content_encoding = excluded.content_encoding, checksums = excluded.checksums, acl = excluded.acl, retain_until = excluded.retain_until", rel, m.ContentEncoding, checksums, m.ACL, m.RetainUntil); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM tags WHERE path = ?", rel); err != nil {
+		return err
+	}
+	for k, v := range m.Tags {
+		if _, err := tx.Exec("INSERT INTO tags (path, key, value) VALUES (?, ?, ?)", rel, k, v); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Has(obj string) bool {
+	var one int
+	return s.db.QueryRow("SELECT 1 FROM objects WHERE path = ?", storageRel(obj)).Scan(&one) == nil
+}
+
+func (s *sqliteStore) Delete(obj string) error {
+	rel := storageRel(obj)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM tags WHERE path = ?", rel); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM objects WHERE path = ?", rel); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Move(src, dst string) error {
+	from, to := storageRel(src), storageRel(dst)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, q := range []string{
+		"DELETE FROM tags WHERE path = ?2",
+		"DELETE FROM objects WHERE path = ?2",
+		"UPDATE objects SET path = ?2 WHERE path = ?1",
+		"UPDATE tags SET path = ?2 WHERE path = ?1",
+	} {
+		if _, err := tx.Exec(q, from, to); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) FindByTag(dir, key, value string) ([]string, bool, error) {
+	prefix := ""
+	if rel := storageRel(dir); rel != "." && rel != "" {
+		prefix = rel + "/"
+	}
+	rows, err := s.db.Query("SELECT path FROM tags WHERE key = ? AND value = ? AND substr(path, 1, length(?)) = ? ORDER BY path", key, value, prefix, prefix)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	var found []string
+	for rows.Next() {
+		var rel string
+		if err := rows.Scan(&rel); err != nil {
+			return nil, false, err
+		}
+		obj := storagePath(rel)
+		if _, err := os.Stat(obj); err == nil {
+			found = append(found, obj)
+		}
+	}
+	return found, false, rows.Err()
+}
+
+// Build (or refresh) the SQLite metadata database from existing .meta.json
+// sidecars. Sidecars are left in place so the sidecar store keeps working.
+func migrateMetadata() error {
+	store, err := openSQLiteStore(MetadataDB)
+	if err != nil {
+		return err
+	}
+	defer store.db.Close()
+
+	var migrated, skipped int
+	truncated, err := walkStorage(filepath.Clean(StorageDir), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == versionsDir || d.Name() == partsDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		obj, ok := strings.CutSuffix(p, metaSuffix)
+		if !ok {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		m := &objectMeta{}
+		if _, statErr := os.Stat(obj); statErr != nil || json.Unmarshal(data, m) != nil {
+			fmt.Printf("skipping %s: orphaned or unreadable sidecar\n", p)
+			skipped++
+			return nil
+		}
+		if err := store.Put(obj, m); err != nil {
+			return err
+		}
+		migrated++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if truncated {
+		fmt.Printf("warning: directories deeper than MAX_WALK_DEPTH (%d) were not migrated\n", MaxWalkDepth)
+	}
+	fmt.Printf("migrated %d sidecars into %s (%d skipped)\n", migrated, MetadataDB, skipped)
+	return nil
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var MetricsEnabled = true // override with METRICS_ENABLED, serves /metrics
+
+var transfersCanceled = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "objectstorage_transfers_canceled_total",
+	Help: "Uploads and downloads aborted because the client disconnected.",
+}, []string{"direction"})
+
+func init() {
+	prometheus.MustRegister(transfersCanceled)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Empty file marking a directory created by MKCOL or a trailing-slash PUT.
+// Compaction and the cleanup after a delete only remove empty directories,
+// so a marked one stays until it is removed out of band.
+const dirMarker = ".dir.keep"
+
+// Whether the request asks to create a directory: WebDAV MKCOL, or a PUT
+// to a path ending in "/"
+func isMkdirRequest(r *http.Request) bool {
+	return r.Method == "MKCOL" || (r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/"))
+}
+
+// Create an empty directory (and any missing parents) with DirMode.
+// Returns 201 when created, 200 when it already exists and 409 when the
+// path, or one of its parents, is a file.
+func mkdirHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) < 2 {
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	relPath := strings.TrimSuffix(parts[1], "/")
+	dir, err := resolvePath(relPath)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if dir == filepath.Clean(StorageDir) {
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	unlock := lockPath(dir)
+	defer unlock()
+
+	info, err := os.Stat(dir)
+	if err == nil && !info.IsDir() {
+		httpError(w, r, "A file exists at this path", http.StatusConflict)
+		return
+	}
+	created := err != nil
+	if created {
+		if err := checkDirCapacity(dir); err != nil {
+			writeDirFullError(w, r, dir)
+			return
+		}
+		if err := checkKeyCase(dir, ""); err != nil {
+			writeKeyCaseError(w, r, err)
+			return
+		}
+		if err := ensureDir(dir); err != nil {
+			if errors.Is(err, syscall.ENOTDIR) || errors.Is(err, syscall.EEXIST) {
+				httpError(w, r, "A parent of this path is a file", http.StatusConflict)
+				return
+			}
+			writeStorageError(w, r, "Failed to create directory", err)
+			return
+		}
+		refreshDirIndexes(dir)
+		debugf("created directory %s\n", relPath)
+	}
+	// Also when it existed: a directory a client asked for is kept from now on
+	if err := markExplicitDir(dir); err != nil {
+		writeStorageError(w, r, "Failed to create directory", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(map[string]any{"success": true, "path": relPath + "/", "created": created})
+}
+
+func markExplicitDir(dir string) error {
+	f, err := os.OpenFile(filepath.Join(dir, dirMarker), os.O_CREATE|os.O_WRONLY, FileMode)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// MOVE /{token}/src with "Destination: /{token}/dst" (a path or full URL, as in
+// WebDAV). The destination must also be allowed by the token's path regex.
+// "Overwrite: F" refuses to replace an existing destination.
+func moveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "MOVE" {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) < 2 {
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	srcRel := parts[1]
+
+	dstURL, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || dstURL.Path == "" {
+		httpError(w, r, "Missing or invalid Destination header", http.StatusBadRequest)
+		return
+	}
+	dstParts := strings.SplitN(strings.TrimPrefix(dstURL.Path, "/"), "/", 2)
+	if len(dstParts) < 2 || dstParts[0] != parts[0] {
+		httpError(w, r, "Destination must be under the same token", http.StatusBadRequest)
+		return
+	}
+	dstRel, err := sanitizePath(dstParts[1])
+	if err == nil {
+		err = checkCanonicalPath("/" + dstRel)
+	}
+	if err != nil {
+		httpError(w, r, "Invalid Destination: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	src, err := resolvePath(srcRel)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dst, err := resolvePath(dstRel)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	root := filepath.Clean(StorageDir)
+	if src == root || dst == root || src == dst {
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	if re := tokenRegex(r); re != nil && !pathAllowed(re, dstRel) {
+		writePathForbidden(w, r)
+		return
+	}
+
+	// The per-path locks cover both objects and their sidecars, so moves of
+	// unrelated paths run in parallel
+	unlock, err := lockPathsFor(r, src, dst)
+	if err != nil {
+		writeWriteInProgress(w, r)
+		return
+	}
+	defer unlock()
+
+	info, err := os.Stat(src)
+	if os.IsNotExist(err) {
+		httpError(w, r, "Not found", http.StatusNotFound)
+		return
+	}
+	if err == nil && info.IsDir() {
+		httpError(w, r, "Moving directories is not supported", http.StatusBadRequest)
+		return
+	}
+	if _, err := os.Stat(dst); err == nil && strings.EqualFold(r.Header.Get("Overwrite"), "F") {
+		httpError(w, r, "Destination exists", http.StatusPreconditionFailed)
+		return
+	}
+	if err := checkDirCapacity(dst); err != nil {
+		writeDirFullError(w, r, dst)
+		return
+	}
+	if err := checkKeyCase(dst, src); err != nil {
+		writeKeyCaseError(w, r, err)
+		return
+	}
+	if err := checkRetention(src); err != nil {
+		writeRetentionError(w, r, err)
+		return
+	}
+	if err := checkRetention(dst); err != nil {
+		writeRetentionError(w, r, err)
+		return
+	}
+	if _, scope, err := checkObjectLimit(r, dst, src); err != nil {
+		writeObjectLimitError(w, r, scope)
+		return
+	}
+
+	if err := moveObject(src, dst); err != nil {
+		writeStorageError(w, r, "Failed to move", err)
+		return
+	}
+	removeEmptyParents(filepath.Dir(src))
+	keepAlias := strings.EqualFold(r.Header.Get("X-Keep-Alias"), "true")
+	aliasExpires := noteMoveAlias(storageRel(src), storageRel(dst), keepAlias)
+
+	debugf("moved %s -> %s\n", srcRel, dstRel)
+	resp := map[string]any{"success": true, "path": dstRel}
+	if keepAlias {
+		resp["aliasExpires"] = aliasExpires.UTC().Format(time.RFC3339)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+type renameStep struct{ from, to string }
+
+// Relocate an object together with its metadata and versions sidecars.
+// Each rename is undone if a later one fails, so the object and its
+// sidecars never end up split across the old and new locations.
+func moveObject(src, dst string) error {
+	if err := checkReservedName(src); err != nil {
+		return err
+	}
+	if err := checkReservedName(dst); err != nil {
+		return err
+	}
+	if err := ensureDir(filepath.Dir(dst)); err != nil {
+		return err
+	}
+
+	// Drop sidecars an overwritten destination leaves behind
+	_, statErr := os.Stat(dst)
+	if statErr == nil {
+		removeSidecars(dst)
+	}
+
+	steps := []renameStep{{src, dst}}
+	if _, err := os.Stat(versionsPath(src)); err == nil {
+		if err := os.MkdirAll(filepath.Dir(versionsPath(dst)), DirMode); err != nil {
+			return err
+		}
+		steps = append(steps, renameStep{versionsPath(src), versionsPath(dst)})
+	}
+
+	for i, s := range steps {
+		if err := renamePath(s.from, s.to); err != nil {
+			undoRenames(steps[:i])
+			return err
+		}
+	}
+	if err := metaStore.Move(src, dst); err != nil {
+		undoRenames(steps)
+		return errors.New("failed to move metadata: " + err.Error())
+	}
+	os.Remove(filepath.Dir(versionsPath(src))) // drop .versions once empty
+	noteDirEntry(src, -1)
+	if statErr != nil {
+		noteDirEntry(dst, 1)
+	}
+	invalidateDirSizes(src)
+	invalidateDirSizes(dst)
+	publishEvent("moved", dst, src, fileSize(dst))
+	return nil
+}
+
+// Undo completed renames, last first
+func undoRenames(steps []renameStep) {
+	for j := len(steps) - 1; j >= 0; j-- {
+		renamePath(steps[j].to, steps[j].from)
+	}
+}
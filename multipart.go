@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var errPartName = errors.New("filename must be a relative path without '.', '..' or backslashes")
+
+// Whether the request carries a multipart/form-data body
+func isMultipart(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// Stream every file part of a multipart/form-data POST into the directory
+// named by the URL path, e.g. POST /{token}/photos/ with a part named
+// "a.jpg" stores photos/a.jpg. Each file is checked against the token's
+// path regex and the upload size limit individually.
+func multipartUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) < 2 {
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	prefix := parts[1]
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		httpError(w, r, "Invalid multipart body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	re := tokenRegex(r)
+
+	results := []batchResult{}
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if len(results) == 0 {
+				httpError(w, r, "Invalid multipart body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			// Files already stored stay stored; report where the body broke
+			res := batchResult{}
+			res.fail("bad_request", "Invalid multipart body: "+err.Error())
+			results = append(results, res)
+			break
+		}
+		// Plain form fields carry no file
+		name := part.FileName()
+		if name == "" {
+			part.Close()
+			continue
+		}
+
+		res := storePart(r, part, prefix, name, re)
+		part.Close()
+		results = append(results, res)
+	}
+
+	if len(results) == 0 {
+		httpError(w, r, "No files in multipart body", http.StatusBadRequest)
+		return
+	}
+
+	writeBatchResults(w, results)
+}
+
+// Store one file part, reporting the outcome instead of failing the request.
+// The guards run under the destination's lock, so a concurrent write cannot
+// slip in between the checks and the write.
+func storePart(r *http.Request, part *multipart.Part, prefix, name string, re *regexp.Regexp) batchResult {
+	if err := checkPartName(name); err != nil {
+		res := batchResult{Field: part.FormName(), Path: name}
+		res.fail("invalid_path", err.Error())
+		return res
+	}
+	relPath := strings.TrimPrefix(path.Join("/", prefix, name), "/")
+	res := batchResult{Field: part.FormName(), Path: relPath}
+
+	dest, err := resolvePath(relPath)
+	if err != nil {
+		res.fail("invalid_path", err.Error())
+		return res
+	}
+	if re != nil && !pathAllowed(re, relPath) {
+		res.failForbidden()
+		return res
+	}
+	if ct := part.Header.Get("Content-Type"); !policyFor(storageRel(dest)).allowsContentType(ct) {
+		res.fail("unsupported_content_type", fmt.Sprintf("Content-Type %q is not allowed here", ct))
+		return res
+	}
+
+	unlock, err := lockPathsFor(r, dest)
+	if err != nil {
+		res.failErr(err)
+		return res
+	}
+	defer unlock()
+	if checkDirCapacity(dest) != nil {
+		res.failErr(errDirFull)
+		return res
+	}
+	if checkKeyCase(dest, "") != nil {
+		res.failErr(errKeyCase)
+		return res
+	}
+	if checkRetention(dest) != nil {
+		res.failErr(errRetained)
+		return res
+	}
+	if objectLimitErr(r, dest) != nil {
+		res.failErr(errObjectLimit)
+		return res
+	}
+	oldSize := fileSize(uploadTarget(dest))
+	limit, byToken := fileLimitFor(tokenClaims(r), dest)
+	n, err := writeObject(uploadTarget(dest), quotaLimit(limitReader(part, limit), oldSize))
+	if errors.Is(err, errTooLarge) {
+		err = fileLimitError(byToken)
+	}
+	if err != nil {
+		noteCanceled(r, "upload")
+		res.failErr(err)
+		return res
+	}
+	addUsage(n - oldSize)
+	debugf("uploaded %s\n", relPath)
+	res.Success, res.Size = true, n
+	return res
+}
+
+// A part's filename must name a file inside the URL directory: path.Join
+// would resolve "..", absolute names or backslash separators elsewhere
+func checkPartName(name string) error {
+	if strings.HasPrefix(name, "/") || strings.Contains(name, "\\") || checkCanonicalPath("/"+name) != nil {
+		return errPartName
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMultipartRejectsEscapingFilenames(t *testing.T) {
+	srv := newTestServer(t)
+	base := srv.URL + "/" + testToken(t, "^/data/.*")
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	for _, name := range []string{"..", `..\other\x.txt`, "ok.txt"} {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", `form-data; name="f"; filename="`+name+`"`)
+		part, _ := mw.CreatePart(h)
+		part.Write([]byte("x"))
+	}
+	mw.Close()
+	req, _ := http.NewRequest(http.MethodPost, base+"/data/up/", &form)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	codes := batchCodes(t, resp)
+	if len(codes) != 3 || codes[0] != "invalid_path" || codes[1] != "invalid_path" || codes[2] != "" {
+		t.Fatalf("codes %v", codes)
+	}
+	if _, err := os.Stat(filepath.Join(StorageDir, "data", "up", "ok.txt")); err != nil {
+		t.Fatalf("plain name not stored: %v", err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(StorageDir, "data"))
+	if len(entries) != 1 {
+		t.Fatalf("files outside the target directory: %v", entries)
+	}
+}
+
+func TestCheckPartName(t *testing.T) {
+	for name, ok := range map[string]bool{
+		"a.txt":     true,
+		"sub/a.txt": true,
+		"..":        false,
+		"../x":      false,
+		"a/../b":    false,
+		"/etc/x":    false,
+		`a\b`:       false,
+		"a//b":      false,
+		"./a":       false,
+	} {
+		if err := checkPartName(name); (err == nil) != ok {
+			t.Errorf("checkPartName(%q) = %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Object-count limits guard against clients creating millions of tiny
+// files. A token's "max_objects" claim caps the objects below the fixed
+// prefix of its path regex (the whole store when the regex has none), and
+// a prefix's "maxObjects" policy caps the objects below that prefix.
+// Counts are walked once per scope, then adjusted as objects come and go.
+var (
+	objCountMu  sync.Mutex
+	objCounts   = map[string]int64{}
+	objCountGen uint64 // bumped on every adjustment so a racing walk is not cached
+
+	errObjectLimit = errors.New("object count limit reached")
+)
+
+// Objects below dir, sidecars and internal files excluded
+func objectCount(dir string) int64 {
+	objCountMu.Lock()
+	n, ok := objCounts[dir]
+	gen := objCountGen
+	objCountMu.Unlock()
+	if ok {
+		return n
+	}
+
+	walkStorage(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if p != dir && (isReservedName(d.Name()) || isDirIndex(d.Name())) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			n++
+		}
+		return nil
+	})
+
+	objCountMu.Lock()
+	if gen == objCountGen {
+		objCounts[dir] = n
+	}
+	objCountMu.Unlock()
+	return n
+}
+
+// Adjust the cached counts of every scope containing obj
+func noteObjectCount(obj string, delta int64) {
+	if isInternalPath(obj) {
+		return // staged parts and other internal files are not objects
+	}
+	objCountMu.Lock()
+	defer objCountMu.Unlock()
+	objCountGen++
+	stop := filepath.Clean(StorageDir)
+	dir := storageParent(obj)
+	for {
+		if n, ok := objCounts[dir]; ok {
+			objCounts[dir] = n + delta
+		}
+		if dir == stop || dir == storageParent(dir) {
+			return
+		}
+		dir = storageParent(dir)
+	}
+}
+
+// Forget cached counts of every scope containing path
+func invalidateObjectCounts(path string) {
+	objCountMu.Lock()
+	defer objCountMu.Unlock()
+	objCountGen++
+	stop := filepath.Clean(StorageDir)
+	dir := storageParent(path)
+	for {
+		delete(objCounts, dir)
+		if dir == stop || dir == storageParent(dir) {
+			return
+		}
+		dir = storageParent(dir)
+	}
+}
+
+type objectScope struct {
+	dir   string
+	limit int64
+}
+
+// Directory holding everything an anchored path regex can match, from its
+// literal prefix: "^/users/bob/.*" scopes to users/bob
+func regexScopeDir(re *regexp.Regexp) string {
+	root := filepath.Clean(StorageDir)
+	expr := re.String()
+	if !strings.HasPrefix(expr, "^") {
+		return root
+	}
+	unanchored, err := regexp.Compile(expr[1:])
+	if err != nil {
+		return root
+	}
+	prefix, _ := unanchored.LiteralPrefix()
+	i := strings.LastIndex(prefix, "/")
+	if i <= 0 {
+		return root
+	}
+	dir, err := resolvePath(prefix[:i])
+	if err != nil {
+		return root
+	}
+	return dir
+}
+
+// Object-count limits that apply to creating dest
+func objectScopes(r *http.Request, dest string) []objectScope {
+	var scopes []objectScope
+	if c, re := tokenClaims(r), tokenRegex(r); c != nil && c.MaxObjects > 0 && re != nil {
+		scopes = append(scopes, objectScope{regexScopeDir(re), c.MaxObjects})
+	}
+	if p := policyFor(storageRel(dest)); p.MaxObjects != nil && *p.MaxObjects > 0 {
+		dir, err := resolvePath(p.maxObjectsPrefix)
+		if err == nil {
+			scopes = append(scopes, objectScope{dir, *p.MaxObjects})
+		}
+	}
+	return scopes
+}
+
+func within(path, dir string) bool {
+	return dir == filepath.Clean(StorageDir) || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// Refuse a new object at dest when a scope containing it is full. from is
+// the source of a move (empty otherwise); scopes already holding it do not
+// grow. Returns the tightest allowance left once dest exists, -1 when no
+// limit applies, and the exceeded scope on errObjectLimit.
+func checkObjectLimit(r *http.Request, dest, from string) (int64, objectScope, error) {
+	remaining := int64(-1)
+	if _, err := os.Stat(dest); err == nil {
+		return remaining, objectScope{}, nil // overwrites do not add objects
+	}
+	for _, s := range objectScopes(r, dest) {
+		if !within(dest, s.dir) || (from != "" && within(from, s.dir)) {
+			continue
+		}
+		n := objectCount(s.dir)
+		if n >= s.limit {
+			return 0, s, errObjectLimit
+		}
+		if left := s.limit - n - 1; remaining < 0 || left < remaining {
+			remaining = left
+		}
+	}
+	return remaining, objectScope{}, nil
+}
+
+func objectLimitErr(r *http.Request, dest string) error {
+	_, _, err := checkObjectLimit(r, dest, "")
+	return err
+}
+
+func writeObjectLimitError(w http.ResponseWriter, r *http.Request, s objectScope) {
+	writeError(w, r, http.StatusInsufficientStorage, errorEnvelope{
+		Code:  "object_limit_exceeded",
+		Error: "Object count limit reached, delete objects before creating new ones",
+		Limit: s.limit,
+		Usage: objectCount(s.dir),
+	})
+}
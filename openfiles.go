@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// With SHARE_OPEN_FILES, full-object GETs of a file another download is
+// already sending reuse its open handle instead of opening the file again,
+// so a popular object hit by many clients at once costs one open. Every
+// reader reads at its own offset (pread), so sharing is invisible to them.
+// Ranged requests, checksums and sibling files still open their own.
+var ShareOpenFiles = false // override with SHARE_OPEN_FILES
+
+var sharedOpens = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "objectstorage_shared_opens_total",
+	Help: "Downloads served from a file handle another download already had open.",
+})
+
+func init() {
+	prometheus.MustRegister(sharedOpens)
+}
+
+type sharedFile struct {
+	f    *os.File
+	info os.FileInfo
+	refs int
+}
+
+var (
+	sharedMu    sync.Mutex
+	sharedFiles = map[string]*sharedFile{}
+)
+
+// Open target for reading with ReadAt only, sharing a handle still held by
+// other readers while it refers to the unchanged file now at target (an
+// upload renames a new file into place, so the old handle keeps the old
+// bytes). release closes the handle once the last reader is done with it.
+func openShared(target string) (f *os.File, release func(), err error) {
+	sharedMu.Lock()
+	s := sharedFiles[target]
+	sharedMu.Unlock()
+	if s != nil {
+		if info, err := os.Stat(target); err == nil && os.SameFile(info, s.info) && info.ModTime().Equal(s.info.ModTime()) && info.Size() == s.info.Size() {
+			sharedMu.Lock()
+			if sharedFiles[target] == s { // not released meanwhile
+				s.refs++
+				sharedMu.Unlock()
+				sharedOpens.Inc()
+				return s.f, func() { releaseShared(target, s) }, nil
+			}
+			sharedMu.Unlock()
+		}
+	}
+
+	f, err = os.Open(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	// A replaced entry lives on until its own readers release it
+	s = &sharedFile{f: f, info: info, refs: 1}
+	sharedMu.Lock()
+	sharedFiles[target] = s
+	sharedMu.Unlock()
+	return f, func() { releaseShared(target, s) }, nil
+}
+
+func releaseShared(target string, s *sharedFile) {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	if s.refs--; s.refs > 0 {
+		return
+	}
+	if sharedFiles[target] == s {
+		delete(sharedFiles, target)
+	}
+	s.f.Close()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func sharedOpenCount(t testing.TB) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := sharedOpens.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestOpenSharedReusesHandle(t *testing.T) {
+	StorageDir = t.TempDir()
+	metaStore = sidecarStore{}
+	target := filepath.Join(StorageDir, "a.txt")
+	if err := os.WriteFile(target, []byte("one"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f1, release1, err := openShared(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, release2, err := openShared(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f1 != f2 {
+		t.Fatal("concurrent readers of an unchanged file got separate handles")
+	}
+
+	// A replaced file gets a handle of its own; the old one keeps the old bytes
+	if _, err := writeObject(target, strings.NewReader("two")); err != nil {
+		t.Fatal(err)
+	}
+	f3, release3, err := openShared(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f3 == f1 {
+		t.Fatal("a replaced file reused the old handle")
+	}
+	old := make([]byte, 3)
+	if _, err := f1.ReadAt(old, 0); err != nil || string(old) != "one" {
+		t.Fatalf("old handle reads %q, %v", old, err)
+	}
+
+	release1()
+	release2()
+	release3()
+	sharedMu.Lock()
+	left := len(sharedFiles)
+	sharedMu.Unlock()
+	if left != 0 {
+		t.Fatalf("%d handles still open after every release", left)
+	}
+}
+
+// Many clients fetching the same object at once. With SHARE_OPEN_FILES the
+// shared-opens/op metric shows how many of the downloads reused a handle.
+func BenchmarkConcurrentFullDownloads(b *testing.B) {
+	for _, shared := range []bool{false, true} {
+		name := "separate"
+		if shared {
+			name = "shared"
+		}
+		b.Run(name, func(b *testing.B) {
+			prev := ShareOpenFiles
+			ShareOpenFiles = shared
+			b.Cleanup(func() { ShareOpenFiles = prev })
+			srv := newTestServer(b)
+			url := srv.URL + "/" + testToken(b, "^/data/.*") + "/data/big.bin"
+			body := bytes.Repeat([]byte("x"), 4<<20)
+			if err := os.MkdirAll(filepath.Join(StorageDir, "data"), 0755); err != nil {
+				b.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(StorageDir, "data", "big.bin"), body, 0644); err != nil {
+				b.Fatal(err)
+			}
+
+			before := sharedOpenCount(b)
+			var mu sync.Mutex
+			var failed error
+			b.SetBytes(int64(len(body)))
+			b.SetParallelism(8) // clients, per CPU
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					resp, err := http.Get(url)
+					if err == nil {
+						_, err = io.Copy(io.Discard, resp.Body)
+						resp.Body.Close()
+					}
+					if err != nil {
+						mu.Lock()
+						failed = err
+						mu.Unlock()
+					}
+				}
+			})
+			b.StopTimer()
+			if failed != nil {
+				b.Fatal(failed)
+			}
+			b.ReportMetric((sharedOpenCount(b)-before)/float64(b.N), "shared-opens/op")
+		})
+	}
+}
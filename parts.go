@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3-style multipart uploads for large objects:
+//
+//	POST   /{token}/path?uploads                     start, returns an uploadId
+//	PUT    /{token}/path?uploadId=ID&partNumber=N    upload part N (1-based), in any order or in parallel
+//	POST   /{token}/path?uploadId=ID                 assemble parts 1..N into the object
+//	DELETE /{token}/path?uploadId=ID                 abort and discard the parts
+//
+// Parts are staged under StorageDir/.parts/<uploadId>/<n> and sessions not
+// completed within PartUploadTTL are removed by the sweeper.
+var (
+	PartUploadTTL = 24 * time.Hour // override with PART_UPLOAD_TTL
+	maxPartNumber = 10000
+)
+
+const partsDir = ".parts"
+
+type partSession struct {
+	Path    string    `json:"path"`
+	Created time.Time `json:"created"`
+}
+
+func partsRoot() string {
+	return filepath.Join(StorageDir, partsDir)
+}
+
+// Resolve the session directory for an upload id, rejecting ids that are not plain hex
+func sessionDir(id string) (string, error) {
+	if id == "" || strings.Trim(id, "0123456789abcdef") != "" {
+		return "", errors.New("invalid uploadId")
+	}
+	return filepath.Join(partsRoot(), id), nil
+}
+
+// Load the session for an upload id and check it belongs to relPath
+func loadSession(id, relPath string) (string, *partSession, int, error) {
+	dir, err := sessionDir(id)
+	if err != nil {
+		return "", nil, http.StatusBadRequest, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "session.json"))
+	if err != nil {
+		return "", nil, http.StatusNotFound, errors.New("upload not found")
+	}
+	sess := &partSession{}
+	if err := json.Unmarshal(data, sess); err != nil {
+		return "", nil, http.StatusInternalServerError, err
+	}
+	if sess.Path != relPath {
+		return "", nil, http.StatusBadRequest, errors.New("uploadId belongs to a different path")
+	}
+	return dir, sess, 0, nil
+}
+
+// Object path a part-upload request targets, shared by all four operations
+func partRequestPath(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) < 2 {
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
+		return "", "", false
+	}
+	dest, err := resolvePath(parts[1])
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return "", "", false
+	}
+	if dest == filepath.Clean(StorageDir) {
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
+		return "", "", false
+	}
+	return parts[1], dest, true
+}
+
+func createPartUploadHandler(w http.ResponseWriter, r *http.Request) {
+	relPath, dest, ok := partRequestPath(w, r)
+	if !ok {
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); !policyFor(storageRel(dest)).allowsContentType(ct) {
+		writeContentTypeError(w, r, ct)
+		return
+	}
+
+	id, err := randomID()
+	if err != nil {
+		writeStorageError(w, r, "Failed to start upload", err)
+		return
+	}
+
+	dir, _ := sessionDir(id)
+	if err := os.MkdirAll(dir, DirMode); err != nil {
+		writeStorageError(w, r, "Failed to start upload", err)
+		return
+	}
+	data, _ := json.Marshal(partSession{Path: relPath, Created: now()})
+	if err := os.WriteFile(filepath.Join(dir, "session.json"), data, FileMode); err != nil {
+		os.RemoveAll(dir)
+		writeStorageError(w, r, "Failed to start upload", err)
+		return
+	}
+
+	debugf("started part upload %s for %s\n", id, relPath)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"uploadId": id, "path": relPath})
+}
+
+func uploadPartHandler(w http.ResponseWriter, r *http.Request) {
+	relPath, dest, ok := partRequestPath(w, r)
+	if !ok {
+		return
+	}
+	dir, _, status, err := loadSession(r.URL.Query().Get("uploadId"), relPath)
+	if err != nil {
+		httpError(w, r, err.Error(), status)
+		return
+	}
+	n, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || n < 1 || n > maxPartNumber {
+		httpError(w, r, fmt.Sprintf("partNumber must be between 1 and %d", maxPartNumber), http.StatusBadRequest)
+		return
+	}
+
+	limit, byToken := fileLimitFor(tokenClaims(r), dest)
+	if limit > 0 && r.ContentLength > limit {
+		writeFileTooLarge(w, r, "Failed to upload part", limit, byToken)
+		return
+	}
+	// Staged parts take up storage until they are assembled or discarded,
+	// so they count against the quota like any other upload
+	part := filepath.Join(dir, strconv.Itoa(n))
+	// The lock keeps a retried part from racing the first attempt between
+	// reading the old size and recording the new one
+	unlock, err := lockPathsFor(r, part)
+	if err != nil {
+		writeWriteInProgress(w, r)
+		return
+	}
+	defer unlock()
+	oldSize := fileSize(part)
+	if remaining := quotaRemaining(oldSize); remaining >= 0 && r.ContentLength > remaining {
+		writeQuotaError(w, r)
+		return
+	}
+	body := io.Reader(r.Body)
+	if limit > 0 {
+		body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	size, err := writeObject(part, quotaLimit(body, oldSize))
+	if errors.Is(err, errQuotaExceeded) {
+		writeQuotaError(w, r)
+		return
+	}
+	if errors.Is(err, errTooLarge) {
+		writeFileTooLarge(w, r, "Failed to upload part", limit, byToken)
+		return
+	}
+	if err != nil {
+		noteCanceled(r, "upload")
+		writeStorageError(w, r, "Failed to upload part", err)
+		return
+	}
+	addUsage(size - oldSize)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"success": true, "partNumber": n, "size": size})
+}
+
+// Part numbers staged for a session, in ascending order
+func listParts(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var nums []int
+	for _, e := range entries {
+		if n, err := strconv.Atoi(e.Name()); err == nil && !e.IsDir() {
+			nums = append(nums, n)
+		}
+	}
+	sort.Ints(nums)
+	return nums, nil
+}
+
+// Bytes staged in a session directory, counted in storage usage until the
+// session is removed
+func stagedBytes(dir string) int64 {
+	var n int64
+	nums, _ := listParts(dir)
+	for _, num := range nums {
+		n += fileSize(filepath.Join(dir, strconv.Itoa(num)))
+	}
+	return n
+}
+
+// Remove a session directory and release the storage its parts held. The
+// parts are locked, so an upload to one of them finishes, and is counted,
+// before it is released.
+func removeSession(dir string) error {
+	nums, _ := listParts(dir)
+	parts := make([]string, len(nums))
+	for i, num := range nums {
+		parts[i] = filepath.Join(dir, strconv.Itoa(num))
+	}
+	unlock := lockPaths(parts...)
+	defer unlock()
+	staged := stagedBytes(dir)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	addUsage(-staged)
+	return nil
+}
+
+// Concatenate parts 1..N into the final object. An optional JSON body
+// {"parts": [1, 2, 3]} asserts exactly which parts the client sent.
+func completePartUploadHandler(w http.ResponseWriter, r *http.Request) {
+	relPath, dest, ok := partRequestPath(w, r)
+	if !ok {
+		return
+	}
+	dir, _, status, err := loadSession(r.URL.Query().Get("uploadId"), relPath)
+	if err != nil {
+		httpError(w, r, err.Error(), status)
+		return
+	}
+
+	nums, err := listParts(dir)
+	if err != nil {
+		httpError(w, r, "Failed to read parts: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(nums) == 0 {
+		httpError(w, r, "No parts uploaded", http.StatusBadRequest)
+		return
+	}
+	for i, n := range nums {
+		if n != i+1 {
+			httpError(w, r, fmt.Sprintf("Missing part %d", i+1), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var req struct {
+		Parts []int `json:"parts"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		httpError(w, r, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Parts != nil {
+		if len(req.Parts) != len(nums) {
+			httpError(w, r, fmt.Sprintf("Expected %d parts, %d uploaded", len(req.Parts), len(nums)), http.StatusBadRequest)
+			return
+		}
+		for i, n := range req.Parts {
+			if n != i+1 {
+				httpError(w, r, "Parts must be listed in ascending order starting at 1", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	files := make([]io.Reader, 0, len(nums))
+	for _, n := range nums {
+		f, err := os.Open(filepath.Join(dir, strconv.Itoa(n)))
+		if err != nil {
+			httpError(w, r, "Failed to read parts: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+
+	unlock, err := lockPathsFor(r, dest)
+	if err != nil {
+		writeWriteInProgress(w, r)
+		return
+	}
+	defer unlock()
+
+	if err := checkDirCapacity(dest); err != nil {
+		writeDirFullError(w, r, dest)
+		return
+	}
+	if err := checkKeyCase(dest, ""); err != nil {
+		writeKeyCaseError(w, r, err)
+		return
+	}
+	if err := checkRetention(dest); err != nil {
+		writeRetentionError(w, r, err)
+		return
+	}
+	if _, scope, err := checkObjectLimit(r, dest, ""); err != nil {
+		writeObjectLimitError(w, r, scope)
+		return
+	}
+
+	// The parts are freed once the object is assembled, so their bytes are
+	// not counted twice while both exist
+	oldSize := fileSize(uploadTarget(dest))
+	limit, byToken := fileLimitFor(tokenClaims(r), dest)
+	size, err := writeObject(uploadTarget(dest), quotaLimit(limitReader(io.MultiReader(files...), limit), oldSize+stagedBytes(dir)))
+	if errors.Is(err, errQuotaExceeded) {
+		writeQuotaError(w, r)
+		return
+	}
+	if errors.Is(err, errTooLarge) {
+		writeFileTooLarge(w, r, "Failed to assemble", limit, byToken)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, r, "Failed to assemble", err)
+		return
+	}
+	addUsage(size - oldSize)
+	removeSession(dir)
+
+	debugf("uploaded %s (%d parts)\n", relPath, len(nums))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"success": true, "path": storageRel(dest), "size": size, "parts": len(nums)})
+}
+
+func abortPartUploadHandler(w http.ResponseWriter, r *http.Request) {
+	relPath, _, ok := partRequestPath(w, r)
+	if !ok {
+		return
+	}
+	dir, _, status, err := loadSession(r.URL.Query().Get("uploadId"), relPath)
+	if err != nil {
+		httpError(w, r, err.Error(), status)
+		return
+	}
+	if err := removeSession(dir); err != nil {
+		httpError(w, r, "Failed to abort: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"success": true})
+}
+
+// Periodically remove part-upload sessions older than PartUploadTTL
+func startPartSweeper() {
+	go func() {
+		for {
+			sweepPartUploads(now().Add(-PartUploadTTL))
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func sweepPartUploads(cutoff time.Time) {
+	entries, err := os.ReadDir(partsRoot())
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		dir := filepath.Join(partsRoot(), e.Name())
+		data, err := os.ReadFile(filepath.Join(dir, "session.json"))
+		sess := partSession{}
+		if err == nil {
+			json.Unmarshal(data, &sess)
+		} else if info, err := e.Info(); err == nil {
+			sess.Created = info.ModTime()
+		}
+		if sess.Created.Before(cutoff) {
+			removeSession(dir)
+			fmt.Printf("swept abandoned part upload %s\n", e.Name())
+		}
+	}
+}
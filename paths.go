@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	MaxPathDepth     = 64    // override with MAX_PATH_DEPTH
+	MaxNameLength    = 255   // override with MAX_NAME_LENGTH, in bytes per path segment
+	NormalizeUnicode = false // override with NORMALIZE_UNICODE=true to NFC-normalize paths
+)
+
+// KeyCase selects how keys differing only in case are treated, override
+// with KEY_CASE:
+//   - "sensitive" (default): distinct keys, as on Linux filesystems
+//   - "lower": keys are lowercased before they reach the disk
+//   - "reject": creating a key that differs only in case from an existing
+//     one fails with 409, so a macOS or Windows host cannot merge them
+var KeyCase = "sensitive"
+
+// PathAliases makes several URL prefixes name one storage directory, e.g.
+// "cdn=static" serves static/logo.png as cdn/logo.png too, with nothing
+// duplicated on disk. Aliases are resolved before anything touches
+// storage, so listings, metadata and policies see the real path, while
+// tokens are still matched against the prefix the URL uses.
+var PathAliases = map[string]string{} // override with PATH_ALIASES, e.g. "cdn=static,assets=static" (comma separated)
+
+// The storage path a clean, slash-separated path names once the longest
+// alias prefix it starts with is replaced by its target
+func canonicalPath(clean string) string {
+	best := ""
+	for alias := range PathAliases {
+		if len(alias) > len(best) && (clean == alias || strings.HasPrefix(clean, alias+"/")) {
+			best = alias
+		}
+	}
+	if best == "" {
+		return clean
+	}
+	return PathAliases[best] + strings.TrimPrefix(clean, best)
+}
+
+var (
+	errControlChars  = errors.New("path contains control characters")
+	errAmbiguousPath = errors.New("path contains empty, '.' or '..' segments")
+	errKeyCase       = errors.New("key differs only in case from an existing key")
+)
+
+// canonicalPath for a request-relative path, keeping a directory URL's
+// trailing slash, in the case it is stored in
+func canonicalRel(relPath string) string {
+	if KeyCase == "lower" {
+		relPath = strings.ToLower(relPath)
+	}
+	if len(PathAliases) == 0 {
+		return relPath
+	}
+	c := canonicalPath(strings.Trim(relPath, "/"))
+	if c != "" && strings.HasSuffix(relPath, "/") {
+		c += "/"
+	}
+	return c
+}
+
+// Reject request paths that path.Clean would rewrite ("//a", "/a/./b",
+// "/a/../b"), so the path the token regex sees is exactly the one resolved
+// on disk. A single trailing slash is kept for directory URLs.
+func checkCanonicalPath(p string) error {
+	trimmed := strings.TrimSuffix(p, "/")
+	if trimmed != "" && path.Clean(trimmed) != trimmed {
+		return errAmbiguousPath
+	}
+	return nil
+}
+
+// Reject control characters (NUL, newlines, ...) and optionally NFC-normalize
+// so differently composed spellings of the same name map to one object.
+// KEY_CASE=lower is applied later, by resolvePath: the token's path regex is
+// matched against the key as the client spelled it.
+func sanitizePath(p string) (string, error) {
+	if strings.IndexFunc(p, unicode.IsControl) >= 0 {
+		return "", errControlChars
+	}
+	if NormalizeUnicode {
+		p = norm.NFC.String(p)
+	}
+	return p, nil
+}
+
+// With KEY_CASE=reject, refuse creating dest when it or one of its missing
+// parents differs only in case from an entry already on disk. Names are
+// compared by listing each directory, since a case-insensitive filesystem
+// would report the other spelling as existing. except (a move's source) is
+// not treated as a collision.
+func checkKeyCase(dest, except string) error {
+	if KeyCase != "reject" {
+		return nil
+	}
+	rel := storageRel(dest)
+	if rel == "" || rel == "." {
+		return nil
+	}
+	dir := filepath.Clean(StorageDir)
+	for _, seg := range strings.Split(rel, "/") {
+		names, err := readDirNames(dir)
+		if err != nil {
+			return nil // dir does not exist yet, nothing below it can collide
+		}
+		exact := false
+		for _, name := range names {
+			if name == seg {
+				exact = true
+			} else if strings.EqualFold(name, seg) && storageChild(dir, name) != except {
+				return fmt.Errorf("%w: %s", errKeyCase, storageRel(storageChild(dir, name)))
+			}
+		}
+		if !exact {
+			return nil
+		}
+		dir = storageChild(dir, seg)
+	}
+	return nil
+}
+
+func readDirNames(dir string) ([]string, error) {
+	if len(StorageVolumes) > 0 && dir == filepath.Clean(StorageDir) {
+		entries, err := readStorageDir(dir)
+		names := make([]string, len(entries))
+		for i, e := range entries {
+			names[i] = e.Name()
+		}
+		return names, err
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+func writeKeyCaseError(w http.ResponseWriter, r *http.Request, err error) {
+	writeError(w, r, http.StatusConflict, errorEnvelope{Code: "key_case_conflict", Error: err.Error()})
+}
+
+// Resolve a request-relative path to its location under StorageDir.
+// The path is cleaned against a virtual root so ".." can never climb out
+// of StorageDir, and its depth and segment lengths are bounded.
+func resolvePath(relPath string) (string, error) {
+	relPath, err := sanitizePath(relPath)
+	if err != nil {
+		return "", err
+	}
+	if KeyCase == "lower" {
+		relPath = strings.ToLower(relPath)
+	}
+	clean := canonicalPath(strings.TrimPrefix(path.Clean("/"+relPath), "/"))
+	if clean == "" {
+		return filepath.Clean(StorageDir), nil
+	}
+
+	segments := strings.Split(clean, "/")
+	if len(segments) > MaxPathDepth {
+		return "", fmt.Errorf("path too deep: %d segments exceeds limit of %d", len(segments), MaxPathDepth)
+	}
+	for _, seg := range segments {
+		if len(seg) > MaxNameLength {
+			return "", fmt.Errorf("path segment too long: %d bytes exceeds limit of %d", len(seg), MaxNameLength)
+		}
+		if isReservedName(seg) {
+			return "", fmt.Errorf("path segment %q is reserved", seg)
+		}
+	}
+
+	return storagePath(clean), nil
+}
+
+// Inverse of resolvePath: the slash-separated path of abs relative to StorageDir
+func storageRel(abs string) string {
+	for _, v := range StorageVolumes {
+		if abs == v || strings.HasPrefix(abs, v+string(filepath.Separator)) {
+			rel, _ := filepath.Rel(v, abs)
+			return filepath.ToSlash(rel)
+		}
+	}
+	rel, err := filepath.Rel(StorageDir, abs)
+	if err != nil {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyCaseLowerMatchesTokenAsSent(t *testing.T) {
+	prev := KeyCase
+	KeyCase = "lower"
+	t.Cleanup(func() { KeyCase = prev })
+	srv := newTestServer(t)
+
+	upper := srv.URL + "/" + testToken(t, "^/Photos/.*")
+	if resp := doRequest(t, http.MethodPut, upper+"/Photos/A.txt", "a"); resp.StatusCode >= 300 {
+		t.Fatalf("PUT allowed by the regex as sent: status %d", resp.StatusCode)
+	}
+	if b, err := os.ReadFile(filepath.Join(StorageDir, "photos", "a.txt")); err != nil || string(b) != "a" {
+		t.Fatalf("not stored under the lowercased key: %q, %v", b, err)
+	}
+	if got := readBody(t, doRequest(t, http.MethodGet, upper+"/Photos/A.txt", "")); got != "a" {
+		t.Fatalf("GET body %q", got)
+	}
+
+	// A lowercase regex does not cover an uppercase request path
+	lower := srv.URL + "/" + testToken(t, "^/photos/.*")
+	if resp := doRequest(t, http.MethodPut, lower+"/Photos/B.txt", "b"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("PUT outside the regex as sent: status %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, http.MethodGet, lower+"/photos/a.txt", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET of the stored key: status %d", resp.StatusCode)
+	}
+}
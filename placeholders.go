@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// With PATH_PLACEHOLDERS, a PUT path may contain placeholders the server
+// fills in before storing, so clients can upload under a unique name
+// without agreeing on one: {uuid} (random UUID v4), {date} (UTC, YYYY-MM-DD)
+// and {sub} (the token's subject). The response reports the resulting path.
+var PathPlaceholders = false // override with PATH_PLACEHOLDERS
+
+var errNoSubject = errors.New("{sub} needs a token with a subject that is a single path segment")
+
+func expandPlaceholders(r *http.Request, relPath string) (string, error) {
+	if !strings.Contains(relPath, "{") {
+		return relPath, nil
+	}
+	if strings.Contains(relPath, "{sub}") {
+		claims := tokenClaims(r)
+		if claims == nil || claims.Subject == "" || strings.Contains(claims.Subject, "/") ||
+			claims.Subject == "." || claims.Subject == ".." {
+			return "", errNoSubject
+		}
+		relPath = strings.ReplaceAll(relPath, "{sub}", claims.Subject)
+	}
+	relPath = strings.ReplaceAll(relPath, "{date}", now().UTC().Format("2006-01-02"))
+	for strings.Contains(relPath, "{uuid}") {
+		id, err := newUUID()
+		if err != nil {
+			return "", err
+		}
+		relPath = strings.Replace(relPath, "{uuid}", id, 1)
+	}
+	return relPath, nil
+}
+
+// Random (version 4) UUID
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+var (
+	PrefixConfig       = ""         // override with PREFIX_CONFIG, JSON file of per-prefix policies
+	PublicReadPrefixes = []string{} // override with PUBLIC_READ_PREFIXES (comma separated)
+)
+
+// Overrides for objects below one path prefix. Unset fields are inherited
+// from shorter matching prefixes, then the global configuration.
+type prefixPolicy struct {
+	MaxUploadBytes      *int64   `json:"maxUploadBytes,omitempty"`      // 0 means unlimited
+	AllowedContentTypes []string `json:"allowedContentTypes,omitempty"` // e.g. "image/png" or "image/*"
+	PublicRead          *bool    `json:"publicRead,omitempty"`          // GET/HEAD without a token
+	MaxObjects          *int64   `json:"maxObjects,omitempty"`          // objects allowed below the prefix, 0 means unlimited
+	CacheControl        *string  `json:"cacheControl,omitempty"`        // Cache-Control for downloads, "" sends none
+
+	maxObjectsPrefix string // the prefix MaxObjects was taken from
+}
+
+type prefixRule struct {
+	prefix string // storage-relative, no leading or trailing slash ("" is the root)
+	policy prefixPolicy
+}
+
+// Longest prefix first
+var prefixRules []prefixRule
+
+// Load PREFIX_CONFIG, a JSON object mapping prefixes to policies:
+//
+//	{"public": {"maxUploadBytes": 1073741824, "publicRead": true},
+//	 "public/avatars": {"allowedContentTypes": ["image/*"]}}
+//
+// PUBLIC_READ_PREFIXES marks further prefixes publicRead.
+func loadPrefixConfig() error {
+	raw := map[string]prefixPolicy{}
+	if PrefixConfig != "" {
+		data, err := os.ReadFile(PrefixConfig)
+		if err != nil {
+			return fmt.Errorf("PREFIX_CONFIG: %w", err)
+		}
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return fmt.Errorf("PREFIX_CONFIG %s: %w", PrefixConfig, err)
+		}
+	}
+	public := true
+	for _, prefix := range PublicReadPrefixes {
+		if strings.Trim(prefix, "/") == "" {
+			return fmt.Errorf("PUBLIC_READ_PREFIXES: the root cannot be public, token URLs would stop working")
+		}
+		p := raw[prefix]
+		p.PublicRead = &public
+		raw[prefix] = p
+	}
+
+	for prefix, p := range raw {
+		if p.publicRead() && strings.Trim(prefix, "/") == "" {
+			return fmt.Errorf("PREFIX_CONFIG %s: the root cannot be publicRead, token URLs would stop working", PrefixConfig)
+		}
+		if p.MaxUploadBytes != nil && *p.MaxUploadBytes < 0 {
+			return fmt.Errorf("PREFIX_CONFIG %s: %q: maxUploadBytes must not be negative", PrefixConfig, prefix)
+		}
+		if p.MaxObjects != nil && *p.MaxObjects < 0 {
+			return fmt.Errorf("PREFIX_CONFIG %s: %q: maxObjects must not be negative", PrefixConfig, prefix)
+		}
+		prefixRules = append(prefixRules, prefixRule{prefix: strings.Trim(prefix, "/"), policy: p})
+	}
+	sort.Slice(prefixRules, func(i, j int) bool { return len(prefixRules[i].prefix) > len(prefixRules[j].prefix) })
+	for _, rule := range prefixRules {
+		if rule.policy.publicRead() {
+			fmt.Printf("Public read access (no token) under /%s/\n", rule.prefix)
+		}
+	}
+	return nil
+}
+
+// Effective policy for a storage-relative object path. Each setting comes
+// from the most specific (longest) matching prefix that sets it; prefixes
+// match whole path segments, so "pub" does not cover "public/x".
+func policyFor(rel string) prefixPolicy {
+	rel = strings.Trim(rel, "/")
+	var p prefixPolicy
+	for _, rule := range prefixRules {
+		if rule.prefix != "" && rel != rule.prefix && !strings.HasPrefix(rel, rule.prefix+"/") {
+			continue
+		}
+		if p.MaxUploadBytes == nil {
+			p.MaxUploadBytes = rule.policy.MaxUploadBytes
+		}
+		if p.AllowedContentTypes == nil {
+			p.AllowedContentTypes = rule.policy.AllowedContentTypes
+		}
+		if p.PublicRead == nil {
+			p.PublicRead = rule.policy.PublicRead
+		}
+		if p.CacheControl == nil {
+			p.CacheControl = rule.policy.CacheControl
+		}
+		if p.MaxObjects == nil && rule.policy.MaxObjects != nil {
+			p.MaxObjects, p.maxObjectsPrefix = rule.policy.MaxObjects, rule.prefix
+		}
+	}
+	return p
+}
+
+func (p prefixPolicy) publicRead() bool {
+	return p.PublicRead != nil && *p.PublicRead
+}
+
+// Storage-relative path of a tokenless GET/HEAD URL under a publicRead
+// prefix or of a public-read object. The first segment is a real directory
+// here, not a token.
+func publicReadPath(uri string) (string, bool) {
+	p, err := sanitizePath(uri)
+	if err != nil || checkCanonicalPath(p) != nil {
+		return "", false
+	}
+	rel := strings.TrimPrefix(p, "/")
+	target, err := resolvePath(rel)
+	if err != nil || !(policyFor(storageRel(target)).publicRead() || objectPublicRead(target)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// Upload size cap for objects under this policy, 0 meaning unlimited
+func (p prefixPolicy) uploadLimit() int64 {
+	if p.MaxUploadBytes != nil {
+		return *p.MaxUploadBytes
+	}
+	return MaxUploadBytes
+}
+
+// Whether a declared Content-Type may be stored, "type/*" covering a whole type
+func (p prefixPolicy) allowsContentType(contentType string) bool {
+	if len(p.AllowedContentTypes) == 0 {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range p.AllowedContentTypes {
+		allowed = strings.ToLower(allowed)
+		if allowed == mt || (strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mt, strings.TrimSuffix(allowed, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeContentTypeError(w http.ResponseWriter, r *http.Request, contentType string) {
+	writeError(w, r, http.StatusUnsupportedMediaType, errorEnvelope{Code: "unsupported_content_type", Error: fmt.Sprintf("Content-Type %q is not allowed here", contentType)})
+}
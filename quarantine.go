@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// With QUARANTINE, uploads are held under StorageDir/.quarantine/<path>
+// instead of going live: GET and listings do not see them until an admin
+// promotes them with POST /admin/promote?path=<path>. Items not promoted
+// within QuarantineTTL are removed by the sweeper. Every check an upload
+// goes through (token, policy, quota, limits) is still made against the
+// live path it is headed for.
+var (
+	Quarantine    = false              // override with QUARANTINE
+	QuarantineTTL = 7 * 24 * time.Hour // override with QUARANTINE_TTL
+)
+
+const quarantineDir = ".quarantine"
+
+func quarantineRoot() string {
+	return filepath.Join(StorageDir, quarantineDir)
+}
+
+// Where an upload bound for dest is written
+func uploadTarget(dest string) string {
+	if !Quarantine {
+		return dest
+	}
+	return filepath.Join(quarantineRoot(), filepath.FromSlash(storageRel(dest)))
+}
+
+// POST /admin/promote?path=<path> moves a quarantined upload into place,
+// replacing what is there unless it is under retention
+func promoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	relPath := strings.TrimPrefix(r.URL.Query().Get("path"), "/")
+	dst, err := resolvePath(relPath)
+	if err != nil || dst == filepath.Clean(StorageDir) {
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	src := filepath.Join(quarantineRoot(), filepath.FromSlash(storageRel(dst)))
+
+	unlock := lockPaths(src, dst)
+	defer unlock()
+	if info, err := os.Stat(src); err != nil || info.IsDir() {
+		httpError(w, r, "Not found in quarantine", http.StatusNotFound)
+		return
+	}
+	if info, err := os.Stat(dst); err == nil && info.IsDir() {
+		httpError(w, r, "A directory exists at this path", http.StatusConflict)
+		return
+	}
+	if err := checkRetention(dst); err != nil {
+		writeRetentionError(w, r, err)
+		return
+	}
+	oldSize := fileSize(dst)
+	if err := moveObject(src, dst); err != nil {
+		writeStorageError(w, r, "Failed to promote", err)
+		return
+	}
+	addUsage(-oldSize)
+	removeEmptyParents(filepath.Dir(src))
+
+	fmt.Printf("[admin] promoted %s by %s\n", storageRel(dst), clientIP(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"success": true, "path": storageRel(dst)})
+}
+
+type quarantinedItem struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Uploaded time.Time `json:"uploaded"`
+	Expires  time.Time `json:"expires"`
+}
+
+// GET /admin/quarantine lists the uploads awaiting review
+func quarantineListHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	items := []quarantinedItem{}
+	walkQuarantine(func(p string, info fs.FileInfo) {
+		rel, _ := filepath.Rel(quarantineRoot(), p)
+		items = append(items, quarantinedItem{
+			Path:     filepath.ToSlash(rel),
+			Size:     info.Size(),
+			Uploaded: info.ModTime().UTC(),
+			Expires:  info.ModTime().Add(QuarantineTTL).UTC(),
+		})
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"files": items})
+}
+
+// Visit every quarantined object, skipping sidecars and temp files
+func walkQuarantine(fn func(p string, info fs.FileInfo)) {
+	filepath.WalkDir(quarantineRoot(), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if isReservedName(d.Name()) && p != quarantineRoot() {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				fn(p, info)
+			}
+		}
+		return nil
+	})
+}
+
+// Periodically remove quarantined uploads older than QuarantineTTL
+func startQuarantineSweeper() {
+	go func() {
+		for {
+			sweepQuarantine(now().Add(-QuarantineTTL))
+			time.Sleep(min(time.Hour, QuarantineTTL))
+		}
+	}()
+}
+
+func sweepQuarantine(cutoff time.Time) {
+	var expired []string
+	walkQuarantine(func(p string, info fs.FileInfo) {
+		if info.ModTime().Before(cutoff) {
+			expired = append(expired, p)
+		}
+	})
+	for _, p := range expired {
+		unlock := lockPath(p)
+		if info, err := os.Stat(p); err == nil && info.ModTime().Before(cutoff) && deleteObject(p) == nil {
+			rel, _ := filepath.Rel(quarantineRoot(), p)
+			fmt.Printf("expired quarantined upload %s\n", filepath.ToSlash(rel))
+		}
+		unlock()
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// Limits are reported with distinct statuses:
+//   - 429 Too Many Requests for rate limits; transient, sent with Retry-After
+//   - 507 Insufficient Storage when the storage quota is used up; retrying
+//     will not help until data is deleted
+var StorageQuotaBytes int64 = 0 // override with STORAGE_QUOTA_BYTES, 0 means unlimited
+
+var (
+	storageUsed      atomic.Int64
+	errQuotaExceeded = errors.New("storage quota exceeded")
+)
+
+// Seed usage at startup with what writes add to it later: objects and
+// staged parts. Sidecars, versions, quarantined files, generated indexes and
+// temp files are not counted, here or when they are written.
+func initStorageUsage() {
+	var total int64
+	walkStorage(filepath.Clean(StorageDir), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if d.Name() == partsDir {
+				sessions, _ := os.ReadDir(path)
+				for _, s := range sessions {
+					total += stagedBytes(filepath.Join(path, s.Name()))
+				}
+				return filepath.SkipDir
+			}
+			if isReservedName(d.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() && !isReservedName(d.Name()) && !isDirIndex(d.Name()) {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	storageUsed.Store(total)
+}
+
+// Adjust tracked usage after an object is written or removed
+func addUsage(delta int64) {
+	storageUsed.Add(delta)
+}
+
+func fileSize(path string) int64 {
+	if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+		return info.Size()
+	}
+	return 0
+}
+
+// Bytes still available to an upload replacing an object of oldSize, or -1 without a quota
+func quotaRemaining(oldSize int64) int64 {
+	if StorageQuotaBytes <= 0 {
+		return -1
+	}
+	remaining := StorageQuotaBytes - storageUsed.Load() + oldSize
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// Reader that fails with errQuotaExceeded once it has produced more than
+// limit bytes. At the end of the body the budget is checked again against
+// current usage: without a Content-Length nothing could be refused up
+// front, and concurrent uploads may have used up the rest meanwhile. The
+// error reaches the writer before the object is committed, so a refused
+// upload leaves nothing behind.
+type quotaReader struct {
+	r       io.Reader
+	limit   int64
+	oldSize int64
+	read    int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	q.read += int64(n)
+	if q.read > q.limit {
+		return n, errQuotaExceeded
+	}
+	if err == io.EOF && q.read > quotaRemaining(q.oldSize) {
+		return n, errQuotaExceeded
+	}
+	return n, err
+}
+
+// Wrap an upload body so it cannot push usage past the quota
+func quotaLimit(r io.Reader, oldSize int64) io.Reader {
+	remaining := quotaRemaining(oldSize)
+	if remaining < 0 {
+		return r
+	}
+	return &quotaReader{r: r, limit: remaining, oldSize: oldSize}
+}
+
+func writeQuotaError(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusInsufficientStorage, errorEnvelope{
+		Code:  "quota_exceeded",
+		Error: "Storage quota exceeded, delete data before uploading more",
+		Limit: StorageQuotaBytes,
+		Usage: storageUsed.Load(),
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func startPartUpload(t *testing.T, url string) string {
+	t.Helper()
+	resp := doRequest(t, http.MethodPost, url+"?uploads", "")
+	var body struct {
+		UploadID string `json:"uploadId"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.UploadID == "" {
+		t.Fatalf("POST ?uploads: status %d, %v", resp.StatusCode, err)
+	}
+	return body.UploadID
+}
+
+func TestStorageUsageMatchesStartupCount(t *testing.T) {
+	withDirectoryIndex(t)
+	srv := newTestServer(t)
+	base := srv.URL + "/" + testToken(t, "^/data/.*")
+
+	doRequest(t, http.MethodPut, base+"/data/a.txt", "hello")
+	doRequest(t, http.MethodPut, base+"/data/a.txt?tags", `{"color": "blue"}`)
+	doRequest(t, "MKCOL", base+"/data/dir", "")
+	id := startPartUpload(t, base+"/data/big.bin")
+	doRequest(t, http.MethodPut, base+"/data/big.bin?uploadId="+id+"&partNumber=1", "0123456789")
+	doRequest(t, http.MethodGet, base+"/data/index.json", "")
+	for _, internal := range []string{"data/a.txt" + metaSuffix, "data/index.json"} {
+		if _, err := os.Stat(filepath.Join(StorageDir, internal)); err != nil {
+			t.Fatalf("setup: %v", err)
+		}
+	}
+
+	if got := storageUsed.Load(); got != 15 {
+		t.Fatalf("usage %d, want 15 (object and staged part)", got)
+	}
+	initStorageUsage()
+	if got := storageUsed.Load(); got != 15 {
+		t.Fatalf("usage counted at startup %d, want 15", got)
+	}
+}
+
+func TestConcurrentPartRetriesKeepUsage(t *testing.T) {
+	srv := newTestServer(t)
+	base := srv.URL + "/" + testToken(t, "^/data/.*")
+	id := startPartUpload(t, base+"/data/big.bin")
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 16; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			url := fmt.Sprintf("%s/data/big.bin?uploadId=%s&partNumber=1", base, id)
+			req, _ := http.NewRequest(http.MethodPut, url, strings.NewReader(strings.Repeat("x", n*100)))
+			if resp, err := http.DefaultClient.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var staged int64
+	filepath.Walk(partsRoot(), func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.Name() == "1" {
+			staged = info.Size()
+		}
+		return nil
+	})
+	if got := storageUsed.Load(); got != staged {
+		t.Fatalf("usage %d after concurrent retries, staged part holds %d", got, staged)
+	}
+
+	doRequest(t, http.MethodDelete, base+"/data/big.bin?uploadId="+id, "")
+	if got := storageUsed.Load(); got != 0 {
+		t.Fatalf("usage %d after abort", got)
+	}
+}
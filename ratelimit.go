@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fixed-window request limiter keyed by client IP
+type ipRateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	start  time.Time
+	counts map[string]int
+}
+
+func newIPRateLimiter(limit int, window time.Duration) *ipRateLimiter {
+	return &ipRateLimiter{limit: limit, window: window, start: now(), counts: map[string]int{}}
+}
+
+// Count a request for ip, returning how long to wait if it is over the limit
+func (l *ipRateLimiter) allow(ip string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := now()
+	if now.Sub(l.start) >= l.window {
+		l.start = now
+		l.counts = map[string]int{}
+	}
+	if l.counts[ip] >= l.limit {
+		return false, l.window - now.Sub(l.start)
+	}
+	l.counts[ip]++
+	return true, 0
+}
+
+// Client address, trusting X-Real-IP / X-Forwarded-For only from a local proxy
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		if real := r.Header.Get("X-Real-IP"); real != "" {
+			return real
+		}
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			first, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	return host
+}
+
+// Middleware rejecting clients over the limit with 429 and Retry-After
+func rateLimit(l *ipRateLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, wait := l.allow(clientIP(r))
+		if !ok {
+			retry := int(wait.Seconds()) + 1
+			w.Header().Set("Retry-After", strconv.Itoa(retry))
+			writeError(w, r, http.StatusTooManyRequests, errorEnvelope{
+				Code:       "rate_limited",
+				Error:      "Too many requests, retry later",
+				Limit:      int64(l.limit),
+				Usage:      int64(l.limit),
+				RetryAfter: retry,
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// With SLOW_REQUEST_THRESHOLD set, requests that take longer are logged,
+// one line each, so latency outliers stand out without a full access log.
+// Every request is timed into the duration histogram either way.
+var SlowRequestThreshold time.Duration // override with SLOW_REQUEST_THRESHOLD, 0 disables
+
+var requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "objectstorage_request_duration_seconds",
+	Help:    "Time from receiving a request to the handler returning, by method and status class.",
+	Buckets: []float64{.005, .025, .1, .5, 1, 5, 30, 120},
+}, []string{"method", "code"})
+
+func init() {
+	prometheus.MustRegister(requestDuration)
+}
+
+func timeRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		elapsed := now().Sub(start)
+
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		requestDuration.WithLabelValues(metricMethod(r.Method), strconv.Itoa(status/100)+"xx").Observe(elapsed.Seconds())
+		if SlowRequestThreshold > 0 && elapsed >= SlowRequestThreshold {
+			fmt.Printf("slow request: %s %s %d %s from %s\n", r.Method, logPath(r), status,
+				elapsed.Round(time.Millisecond), clientIP(r))
+		}
+	})
+}
+
+// Keep the method label bounded against made-up methods
+func metricMethod(m string) string {
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPost, http.MethodDelete,
+		http.MethodOptions, http.MethodPatch, "MOVE", "COPY", "MKCOL":
+		return m
+	}
+	return "other"
+}
+
+// Request path for logs, with the token masked when the first segment is a JWT
+func logPath(r *http.Request) string {
+	p := r.URL.Path
+	first, _, _ := strings.Cut(strings.TrimPrefix(p, "/"), "/")
+	if strings.Count(first, ".") == 2 {
+		return redactToken(p)
+	}
+	return p
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run fn with stdout captured
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := os.Stdout
+	os.Stdout = w
+	fn()
+	os.Stdout = prev
+	w.Close()
+	out, _ := io.ReadAll(r)
+	return string(out)
+}
+
+func TestSlowRequestLogging(t *testing.T) {
+	clock := fakeClock(t)
+	prev := SlowRequestThreshold
+	SlowRequestThreshold = time.Second
+	t.Cleanup(func() { SlowRequestThreshold = prev })
+
+	var took time.Duration
+	h := timeRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*clock = clock.Add(took)
+	}))
+
+	took = 10 * time.Millisecond
+	out := captureStdout(t, func() { h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/fast", nil)) })
+	if out != "" {
+		t.Fatalf("fast request logged: %q", out)
+	}
+
+	took = 2 * time.Second
+	out = captureStdout(t, func() { h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil)) })
+	if !strings.Contains(out, "slow request: GET /slow 200 2s") {
+		t.Fatalf("slow request not logged: %q", out)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errRetained = errors.New("object is under retention")
+
+// PUT /{token}/path?retention=<RFC 3339 time> makes an existing object
+// immutable until that time (WORM): overwrites, moves and deletes are then
+// refused with 403 whatever the token grants. A retention can be extended
+// but never shortened or removed.
+func retentionHandler(w http.ResponseWriter, r *http.Request) {
+	until, err := time.Parse(time.RFC3339, r.URL.Query().Get("retention"))
+	if err != nil {
+		httpError(w, r, "retention must be an RFC 3339 time like 2030-01-01T00:00:00Z", http.StatusBadRequest)
+		return
+	}
+	until = until.UTC()
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) < 2 {
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	relPath := parts[1]
+	target, err := resolvePath(relPath)
+	if err != nil || target == filepath.Clean(StorageDir) {
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	unlock, err := lockPathsFor(r, target)
+	if err != nil {
+		writeWriteInProgress(w, r)
+		return
+	}
+	defer unlock()
+	info, err := os.Stat(target)
+	if err != nil {
+		httpError(w, r, "Not found", http.StatusNotFound)
+		return
+	}
+	if info.IsDir() {
+		httpError(w, r, "Retention can only be set on files", http.StatusBadRequest)
+		return
+	}
+	if current, ok := retainedUntil(target); ok && until.Before(current) {
+		writeError(w, r, http.StatusForbidden, errorEnvelope{
+			Code:  "retention_locked",
+			Error: "Retention can only be extended, it runs until " + current.Format(time.RFC3339),
+		})
+		return
+	}
+	err = updateMeta(target, func(m *objectMeta) {
+		m.Path = storageRel(target)
+		m.RetainUntil = until.Format(time.RFC3339)
+	})
+	if err != nil {
+		writeStorageError(w, r, "Failed to write metadata", err)
+		return
+	}
+
+	debugf("retention %s until %s\n", relPath, until.Format(time.RFC3339))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"success": true, "path": relPath, "retainUntil": until.Format(time.RFC3339)})
+}
+
+// End of the object's retention, when it is still running
+func retainedUntil(target string) (time.Time, bool) {
+	if !hasMeta(target) {
+		return time.Time{}, false
+	}
+	meta, err := readMeta(target)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return meta.retainedUntil()
+}
+
+func (m *objectMeta) retainedUntil() (time.Time, bool) {
+	until, err := time.Parse(time.RFC3339, m.RetainUntil)
+	if err != nil || !now().Before(until) {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// Refuse replacing or removing target while it is under retention
+func checkRetention(target string) error {
+	if until, ok := retainedUntil(target); ok {
+		return fmt.Errorf("%w until %s", errRetained, until.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func writeRetentionError(w http.ResponseWriter, r *http.Request, err error) {
+	writeError(w, r, http.StatusForbidden, errorEnvelope{Code: "retention_locked", Error: err.Error()})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// POST /{token}/path?share (optionally &ttl=1h) hands out /s/<slug>, a
+// link that downloads that one file without a token until it expires.
+// Expired links answer 410 for shareGoneFor, then 404 like revoked ones.
+// With ADMIN_SECRET set, GET /admin/shares lists the links and
+// DELETE /admin/shares/<slug> revokes one. Links are persisted to ShareFile.
+var (
+	ShareTTL    = 24 * time.Hour      // override with SHARE_TTL, for links created without ?ttl
+	ShareMaxTTL = 30 * 24 * time.Hour // override with SHARE_MAX_TTL
+	ShareFile   = ".shares.json"      // override with SHARE_FILE
+)
+
+const shareGoneFor = 7 * 24 * time.Hour
+
+type shareLink struct {
+	Path    string    `json:"path"` // storage-relative
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+var (
+	shareMu sync.Mutex
+	shares  = map[string]*shareLink{} // by slug
+)
+
+// Load persisted share links
+func loadShares() {
+	data, err := os.ReadFile(ShareFile)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &shares); err != nil {
+		fmt.Printf("warning: ignoring unreadable %s: %v\n", ShareFile, err)
+		shares = map[string]*shareLink{}
+	}
+}
+
+// Persist share links atomically, dropping those long gone; caller holds shareMu
+func saveShares() {
+	cutoff := now().Add(-shareGoneFor)
+	for slug, s := range shares {
+		if s.Expires.Before(cutoff) {
+			delete(shares, slug)
+		}
+	}
+	data, err := json.Marshal(shares)
+	if err != nil {
+		return
+	}
+	tmp := filepath.Join(filepath.Dir(ShareFile), "."+filepath.Base(ShareFile)+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		fmt.Printf("warning: failed to persist share links: %v\n", err)
+		return
+	}
+	os.Rename(tmp, ShareFile)
+}
+
+// Unguessable, since the slug alone grants access
+func newShareSlug() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+func shareHandler(w http.ResponseWriter, r *http.Request) {
+	ttl := ShareTTL
+	if s := r.URL.Query().Get("ttl"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 || d > ShareMaxTTL {
+			httpError(w, r, fmt.Sprintf("ttl must be a positive duration up to %s", ShareMaxTTL), http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) < 2 {
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	target, err := resolvePath(parts[1])
+	if err != nil || target == filepath.Clean(StorageDir) {
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		httpError(w, r, "Not found", http.StatusNotFound)
+		return
+	}
+	if info.IsDir() {
+		httpError(w, r, "Only files can be shared", http.StatusBadRequest)
+		return
+	}
+	if !checkReadClaims(w, r, target, false) {
+		return // a link would hand out what the token cannot read
+	}
+	slug, err := newShareSlug()
+	if err != nil {
+		httpError(w, r, "Failed to create share link: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := now().UTC()
+	link := &shareLink{Path: storageRel(target), Created: now, Expires: now.Add(ttl)}
+	shareMu.Lock()
+	shares[slug] = link
+	saveShares()
+	shareMu.Unlock()
+
+	debugf("shared %s as %s until %s\n", link.Path, slug, link.Expires.Format(time.RFC3339))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{"success": true, "slug": slug, "url": "/s/" + slug, "path": link.Path, "expires": link.Expires})
+}
+
+// GET/HEAD /s/<slug>: the shared file, as a token holder would get it
+func sharedDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	shareMu.Lock()
+	link, ok := shares[strings.TrimPrefix(r.URL.Path, "/s/")]
+	shareMu.Unlock()
+	if !ok {
+		defaultHandler(w, r)
+		return
+	}
+	if !now().Before(link.Expires) {
+		writeError(w, r, http.StatusGone, errorEnvelope{Code: "share_expired", Error: "Share link expired"})
+		return
+	}
+	target := storagePath(link.Path)
+	if info, err := os.Stat(target); err != nil || info.IsDir() {
+		defaultHandler(w, r)
+		return
+	}
+	serveObject(w, r, link.Path)
+}
+
+// GET /admin/shares lists unexpired links; DELETE /admin/shares/<slug> revokes one
+func adminSharesHandler(w http.ResponseWriter, r *http.Request) {
+	if slug, ok := strings.CutPrefix(r.URL.Path, "/admin/shares/"); ok {
+		if r.Method != http.MethodDelete {
+			httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		shareMu.Lock()
+		link, found := shares[slug]
+		if found {
+			delete(shares, slug)
+			saveShares()
+		}
+		shareMu.Unlock()
+		if !found {
+			httpError(w, r, "No such share link", http.StatusNotFound)
+			return
+		}
+		fmt.Printf("[admin] revoked share link to %s, by %s\n", link.Path, clientIP(r))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"success": true, "slug": slug, "revoked": true})
+		return
+	}
+	if r.Method != http.MethodGet {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	type entry struct {
+		Slug string `json:"slug"`
+		shareLink
+	}
+	now := now()
+	list := []entry{}
+	shareMu.Lock()
+	for slug, link := range shares {
+		if now.Before(link.Expires) {
+			list = append(list, entry{slug, *link})
+		}
+	}
+	shareMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Expires.Before(list[j].Expires) })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"shares": list})
+}
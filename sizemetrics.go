@@ -0,0 +1,56 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Workload shape for capacity planning: how large the objects written and
+// fetched are, and how many objects and bytes are stored. The stored totals
+// come from the startup scan of the quota and object-count tracking, kept
+// current as objects come and go, so a scrape never walks the tree.
+var SizeBuckets = []float64{1 << 10, 16 << 10, 256 << 10, 4 << 20, 64 << 20, 1 << 30, 16 << 30} // override with METRICS_SIZE_BUCKETS, in bytes
+
+var uploadSizes, downloadSizes prometheus.Histogram
+
+// Register the size metrics once SizeBuckets is final, warming the object
+// count so the first scrape does not pay for the walk
+func initSizeMetrics() {
+	uploadSizes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "objectstorage_upload_size_bytes",
+		Help:    "Size of each object written by an upload.",
+		Buckets: SizeBuckets,
+	})
+	downloadSizes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "objectstorage_download_size_bytes",
+		Help:    "Size of each object fetched with GET.",
+		Buckets: SizeBuckets,
+	})
+	storedObjects := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "objectstorage_stored_objects",
+		Help: "Objects currently stored, sidecars and internal files excluded.",
+	}, func() float64 { return float64(objectCount(filepath.Clean(StorageDir))) })
+	storedBytes := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "objectstorage_stored_bytes",
+		Help: "Bytes currently stored, as counted against STORAGE_QUOTA_BYTES.",
+	}, func() float64 { return float64(storageUsed.Load()) })
+	prometheus.MustRegister(uploadSizes, downloadSizes, storedObjects, storedBytes)
+	objectCount(filepath.Clean(StorageDir))
+}
+
+// Record a finished write of n bytes to dest; staged parts are counted
+// once, as the object they are assembled into
+func observeUpload(dest string, n int64) {
+	if uploadSizes == nil || strings.HasPrefix(dest, partsRoot()+string(filepath.Separator)) {
+		return
+	}
+	uploadSizes.Observe(float64(n))
+}
+
+func observeDownload(size int64) {
+	if downloadSizes != nil {
+		downloadSizes.Observe(float64(size))
+	}
+}
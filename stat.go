@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// GET /{token}/path?stat: what a file browser shows about an object, as
+// JSON in one call instead of headers from a HEAD. Everything comes from the
+// file's inode and its metadata; checksums are those already computed with
+// ?checksum= (null until then), so stat never reads the whole object.
+func statHandler(w http.ResponseWriter, r *http.Request, target string, f *os.File, info os.FileInfo) {
+	resp := map[string]any{
+		"path":    storageRel(target),
+		"modTime": info.ModTime().UTC(),
+	}
+	if info.IsDir() {
+		resp["type"] = "dir"
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	meta, err := readMeta(target)
+	if err != nil {
+		httpError(w, r, "Failed to read metadata: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp["type"] = "file"
+	resp["size"] = info.Size()
+	resp["contentType"] = sniffContentType(info, f)
+	if meta.ContentEncoding != "" {
+		resp["contentEncoding"] = meta.ContentEncoding
+	}
+	if etag, err := objectETag(target, info); err == nil {
+		resp["etag"] = etag
+	}
+	var sums map[string]string
+	if c := meta.Checksums; c != nil && c.Size == info.Size() && c.ModTime.Equal(info.ModTime()) {
+		sums = c.Sums
+	}
+	resp["checksums"] = sums
+	tags := meta.Tags
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	resp["tags"] = tags
+	resp["acl"] = meta.acl()
+	if until, ok := meta.retainedUntil(); ok {
+		resp["retainUntil"] = until
+	}
+	resp["versions"] = versionCount(target)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// The Content-Type a download of the file is sent with: by extension, else
+// sniffed from its first bytes like ServeContent does
+func sniffContentType(info os.FileInfo, f io.ReaderAt) string {
+	if ct := mime.TypeByExtension(filepath.Ext(info.Name())); ct != "" {
+		return ct
+	}
+	var buf [512]byte
+	n, _ := f.ReadAt(buf[:], 0)
+	if ct := http.DetectContentType(buf[:n]); ct != "application/octet-stream" {
+		return ct
+	}
+	return DefaultContentType
+}
+
+// Number of earlier versions kept in the object's .versions sidecar
+func versionCount(target string) int {
+	entries, err := os.ReadDir(versionsPath(target))
+	if err != nil {
+		return 0
+	}
+	return len(entries)
+}
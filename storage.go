@@ -0,0 +1,365 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+)
+
+var (
+	MaxUploadBytes int64 = 0  // override with MAX_UPLOAD_BYTES, 0 means unlimited
+	TmpDir               = "" // override with TMP_DIR, defaults to the destination's directory
+)
+
+var (
+	errTooLarge = errors.New("file too large")
+	errBadGzip  = errors.New("invalid or truncated gzip body")
+)
+
+// Random hex identifier for temp files and upload sessions
+func randomID() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// The file operations object writes go through: creating, syncing and
+// renaming. Tests swap storageFS to count syncs and inject failures.
+type fileSystem interface {
+	OpenFile(name string, flag int, perm os.FileMode) (storageFile, error)
+	Rename(oldpath, newpath string) error
+}
+
+type storageFile interface {
+	io.ReadWriteSeeker
+	io.Closer
+	Name() string
+	Sync() error
+}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (storageFile, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+var storageFS fileSystem = osFS{}
+
+// Create a uniquely named temp file in dir, honoring FileMode and the umask
+func createTemp(dir string) (storageFile, error) {
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Join(dir, ".upload-"+id+".tmp")
+	return storageFS.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, FileMode)
+}
+
+// Stream src into dest atomically: the bytes go to a temp file which is
+// renamed over dest only once fully written, so readers never see a partial
+// object and a failed upload leaves the previous version untouched.
+func writeObject(dest string, src io.Reader) (int64, error) {
+	if err := checkReservedName(dest); err != nil {
+		return 0, err
+	}
+	if err := ensureDir(filepath.Dir(dest)); err != nil {
+		return 0, fmt.Errorf("failed to create directories: %w", err)
+	}
+
+	dir := TmpDir
+	if dir == "" {
+		dir = filepath.Dir(dest)
+	}
+	tmp, err := createTemp(dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	n, err := io.Copy(tmp, src)
+	if err == nil {
+		err = syncFile(tmp)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return n, copyError(err)
+	}
+	if err := validateUpload(dest, tmp.Name(), n); err != nil {
+		return n, err
+	}
+
+	_, statErr := os.Stat(dest)
+	if err := commitTemp(tmp.Name(), dest); err != nil {
+		return n, fmt.Errorf("failed to write file: %w", err)
+	}
+	syncParent(dest)
+	if statErr != nil {
+		noteDirEntry(dest, 1)
+	}
+	invalidateDirSizes(dest)
+	observeUpload(dest, n)
+	publishEvent(changeType(statErr), dest, "", n)
+	return n, nil
+}
+
+// Write src straight into dest, truncating it first, with no temp file or
+// rename. Faster on slow filesystems, but readers can see a partially
+// written file and a failed or interrupted upload loses the previous
+// content; the partial file is removed on error.
+func writeObjectDirect(dest string, src io.Reader) (int64, error) {
+	if err := checkReservedName(dest); err != nil {
+		return 0, err
+	}
+	if err := ensureDir(filepath.Dir(dest)); err != nil {
+		return 0, fmt.Errorf("failed to create directories: %w", err)
+	}
+	_, statErr := os.Stat(dest)
+	f, err := storageFS.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, FileMode)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create file: %w", err)
+	}
+	n, err := io.Copy(f, src)
+	if err == nil {
+		err = syncFile(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = validateUpload(dest, dest, n)
+	}
+	if statErr != nil && err == nil {
+		noteDirEntry(dest, 1)
+	}
+	invalidateDirSizes(dest)
+	if err != nil {
+		os.Remove(dest)
+		if statErr == nil {
+			noteDirEntry(dest, -1)
+			publishEvent("deleted", dest, "", 0)
+		}
+		return n, copyError(err)
+	}
+	if statErr != nil {
+		syncParent(dest)
+	}
+	observeUpload(dest, n)
+	publishEvent(changeType(statErr), dest, "", n)
+	return n, nil
+}
+
+// Event type for a write, from whether dest existed beforehand
+func changeType(statErr error) string {
+	if statErr != nil {
+		return "created"
+	}
+	return "updated"
+}
+
+// Map an error from copying an upload body to the sentinel errors
+func copyError(err error) error {
+	var maxErr *http.MaxBytesError
+	if errors.Is(err, errTooLarge) || errors.As(err, &maxErr) {
+		return errTooLarge
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		return errQuotaExceeded
+	}
+	if errors.Is(err, errSlowUpload) {
+		return errSlowUpload
+	}
+	if errors.Is(err, errUploadRejected) {
+		return err
+	}
+	return fmt.Errorf("failed to write file: %w", err)
+}
+
+// MkdirAll with DirMode, dropping cached entry counts when directories are created
+func ensureDir(dir string) error {
+	if info, err := os.Stat(dir); err == nil && info.IsDir() {
+		return nil
+	}
+	if err := os.MkdirAll(dir, DirMode); err != nil {
+		return err
+	}
+	invalidateDirCounts(dir)
+	return nil
+}
+
+// Move a finished temp file into place. When TMP_DIR is on another
+// filesystem the rename fails with EXDEV, so copy next to dest first and
+// rename from there to keep the final step atomic.
+func commitTemp(tmpName, dest string) error {
+	err := storageFS.Rename(tmpName, dest)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	fmt.Printf("warning: TMP_DIR is on a different filesystem than %s, falling back to copy\n", dest)
+
+	src, err := storageFS.OpenFile(tmpName, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	local, err := createTemp(filepath.Dir(dest))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(local.Name())
+
+	_, err = io.Copy(local, src)
+	if err == nil {
+		err = syncFile(local)
+	}
+	if cerr := local.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return storageFS.Rename(local.Name(), dest)
+}
+
+// Reader that fails with errTooLarge once more than limit bytes are read
+type limitedReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func limitReader(r io.Reader, limit int64) io.Reader {
+	if limit <= 0 {
+		return r
+	}
+	return &limitedReader{r: r, limit: limit}
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		return n, errTooLarge
+	}
+	return n, err
+}
+
+// Decodes a gzip request body, tagging corrupt or truncated streams with
+// errBadGzip. The trailing CRC-32 and length are verified at EOF.
+type gunzipReader struct {
+	zr *gzip.Reader
+}
+
+func gunzip(r io.Reader) (io.Reader, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, badGzip(err)
+	}
+	return &gunzipReader{zr}, nil
+}
+
+func (g *gunzipReader) Read(p []byte) (int, error) {
+	n, err := g.zr.Read(p)
+	return n, badGzip(err)
+}
+
+func badGzip(err error) error {
+	var corrupt flate.CorruptInputError
+	if errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &corrupt) {
+		return fmt.Errorf("%w: %v", errBadGzip, err)
+	}
+	return err
+}
+
+// Map a writeObject error to the response status
+func writeErrorStatus(err error) int {
+	if errors.Is(err, errTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	if errors.Is(err, errBadGzip) {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		return http.StatusInsufficientStorage
+	}
+	if errors.Is(err, errSlowUpload) {
+		return http.StatusRequestTimeout
+	}
+	if errors.Is(err, errUploadRejected) {
+		return http.StatusUnprocessableEntity
+	}
+	if errors.Is(err, errReservedName) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// When the storage directory goes read-only (EROFS) or loses write
+// permission (EACCES), writes answer 503 storage_unwritable instead of a
+// generic 500 and /readyz reports not ready until a probe write succeeds
+// again, so a failing disk shows up where operators look first.
+var storageUnwritable atomic.Bool
+
+// Whether a write failed because storage is unwritable, entering that
+// state if so
+func noteUnwritable(err error) bool {
+	if !errors.Is(err, syscall.EROFS) && !errors.Is(err, syscall.EACCES) {
+		return false
+	}
+	if !storageUnwritable.Swap(true) {
+		fmt.Printf("warning: *** STORAGE IS NOT WRITABLE (%v), /readyz reports not ready until it is ***\n", err)
+	}
+	return true
+}
+
+// Answer a failed storage write, prefix naming the operation
+func writeStorageError(w http.ResponseWriter, r *http.Request, prefix string, err error) {
+	if errors.Is(err, errUploadRejected) {
+		writeError(w, r, http.StatusUnprocessableEntity, errorEnvelope{Code: "upload_rejected", Error: prefix + ": " + err.Error()})
+		return
+	}
+	if errors.Is(err, errReservedName) {
+		writeError(w, r, http.StatusConflict, errorEnvelope{Code: "reserved_name", Error: prefix + ": " + err.Error()})
+		return
+	}
+	if !noteUnwritable(err) {
+		httpError(w, r, prefix+": "+err.Error(), writeErrorStatus(err))
+		return
+	}
+	writeError(w, r, http.StatusServiceUnavailable, errorEnvelope{Code: "storage_unwritable", Error: prefix + ": storage is not writable"})
+}
+
+// Whether every storage root accepts writes, tested with a temp file in
+// each; clears the unwritable state once they do
+func probeWritable() bool {
+	for _, dir := range append([]string{StorageDir}, StorageVolumes...) {
+		f, err := createTemp(dir)
+		if err != nil {
+			return false
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
+	if storageUnwritable.Swap(false) {
+		fmt.Println("Storage is writable again")
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// Wraps the real filesystem, counting syncs and failing on request
+type faultFS struct {
+	osFS
+	syncs      int
+	failAfter  int64 // fail writes to temp files past this many bytes, 0 never
+	exdevFrom  string
+	exdevCount int
+}
+
+type faultFile struct {
+	storageFile
+	fs      *faultFS
+	written int64
+}
+
+var errInjected = errors.New("injected write failure")
+
+func (f *faultFS) OpenFile(name string, flag int, perm os.FileMode) (storageFile, error) {
+	file, err := f.osFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{storageFile: file, fs: f}, nil
+}
+
+func (f *faultFS) Rename(oldpath, newpath string) error {
+	if f.exdevFrom != "" && filepath.Dir(oldpath) == f.exdevFrom {
+		f.exdevCount++
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	return f.osFS.Rename(oldpath, newpath)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if f.fs.failAfter > 0 && f.written+int64(len(p)) > f.fs.failAfter {
+		n, _ := f.storageFile.Write(p[:f.fs.failAfter-f.written])
+		f.written += int64(n)
+		return n, errInjected
+	}
+	n, err := f.storageFile.Write(p)
+	f.written += int64(n)
+	return n, err
+}
+
+func (f *faultFile) Sync() error {
+	f.fs.syncs++
+	return f.storageFile.Sync()
+}
+
+func useFaultFS(t *testing.T) *faultFS {
+	t.Helper()
+	StorageDir = t.TempDir()
+	metaStore = sidecarStore{}
+	fsys := &faultFS{}
+	prev, prevPolicy, prevTmp := storageFS, FsyncPolicy, TmpDir
+	storageFS = fsys
+	t.Cleanup(func() { storageFS, FsyncPolicy, TmpDir = prev, prevPolicy, prevTmp })
+	return fsys
+}
+
+// Names left in dir that look like temp files
+func leftoverTemps(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".upload-") {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+func TestWriteObjectPartialWriteKeepsPrevious(t *testing.T) {
+	fsys := useFaultFS(t)
+	dest := filepath.Join(StorageDir, "a.txt")
+	if err := os.WriteFile(dest, []byte("previous"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys.failAfter = 3
+	if _, err := writeObject(dest, strings.NewReader("replacement")); !errors.Is(err, errInjected) {
+		t.Fatalf("writeObject error %v, want the injected failure", err)
+	}
+	if b, _ := os.ReadFile(dest); string(b) != "previous" {
+		t.Fatalf("dest holds %q after a failed write", b)
+	}
+	if left := leftoverTemps(t, StorageDir); len(left) != 0 {
+		t.Fatalf("temp files left behind: %v", left)
+	}
+}
+
+func TestWriteObjectCrossDeviceFallback(t *testing.T) {
+	fsys := useFaultFS(t)
+	TmpDir = t.TempDir()
+	fsys.exdevFrom = TmpDir
+	dest := filepath.Join(StorageDir, "a.txt")
+
+	n, err := writeObject(dest, strings.NewReader("hello"))
+	if err != nil || n != 5 {
+		t.Fatalf("writeObject = %d, %v", n, err)
+	}
+	if fsys.exdevCount != 1 {
+		t.Fatalf("cross-device renames %d, want 1", fsys.exdevCount)
+	}
+	if b, _ := os.ReadFile(dest); string(b) != "hello" {
+		t.Fatalf("dest holds %q", b)
+	}
+	if left := leftoverTemps(t, TmpDir); len(left) != 0 {
+		t.Fatalf("temp files left in TMP_DIR: %v", left)
+	}
+	if left := leftoverTemps(t, StorageDir); len(left) != 0 {
+		t.Fatalf("temp files left next to dest: %v", left)
+	}
+}
+
+func TestFsyncPolicySyncCount(t *testing.T) {
+	for _, tc := range []struct {
+		policy string
+		syncs  int
+	}{
+		{"never", 0},
+		{"batch", 1},  // the file; its directory joins the next batch
+		{"always", 2}, // the file and its directory
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			fsys := useFaultFS(t)
+			FsyncPolicy = tc.policy
+			if _, err := writeObject(filepath.Join(StorageDir, "a.txt"), strings.NewReader("hello")); err != nil {
+				t.Fatal(err)
+			}
+			if fsys.syncs != tc.syncs {
+				t.Fatalf("%d syncs, want %d", fsys.syncs, tc.syncs)
+			}
+		})
+	}
+}
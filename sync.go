@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	syncPageSize    = 1000
+	maxSyncPageSize = 10000
+)
+
+var errSyncPageFull = errors.New("sync page full")
+
+type syncEntry struct {
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"modTime"`
+	Checksum string    `json:"checksum"`
+	target   string
+}
+
+// GET /{token}/prefix/?sync (or ?sync=md5, sha1; sha256 by default) returns
+// every object below prefix that the token covers as path -> size, modtime
+// and checksum, so a backup client can diff against its local copy. Pages hold up to ?limit
+// entries; pass the returned "next" as ?after to fetch the following page.
+// Checksums come from the metadata cache and are only hashed when stale.
+// The ETag covers paths, sizes and modtimes, so If-None-Match answers an
+// unchanged page with 304 without touching the checksums.
+func syncHandler(w http.ResponseWriter, r *http.Request, dir, relPath string) {
+	q := r.URL.Query()
+	algo := q.Get("sync")
+	if algo == "" {
+		algo = "sha256"
+	}
+	if _, ok := checksumAlgorithms[algo]; !ok {
+		httpError(w, r, "sync must be md5, sha1 or sha256", http.StatusBadRequest)
+		return
+	}
+	limit := syncPageSize
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxSyncPageSize {
+			httpError(w, r, fmt.Sprintf("limit must be between 1 and %d", maxSyncPageSize), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	after := q.Get("after")
+	re := tokenRegex(r)
+
+	files := map[string]*syncEntry{}
+	var order []string
+	next := ""
+	truncated, err := walkStorage(dir, func(p string, d fs.DirEntry, err error) error {
+		if cerr := r.Context().Err(); cerr != nil {
+			return cerr
+		}
+		if err != nil || p == dir {
+			return nil
+		}
+		if isReservedName(d.Name()) || isDirIndex(d.Name()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		rel := storageRelTo(dir, p)
+		// Skip what earlier pages covered, whole subtrees at a time
+		if after != "" && !walksAfter(rel, after) {
+			if d.IsDir() && !strings.HasPrefix(after, rel+"/") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		// Only what the token could fetch by name, like the event stream
+		if !d.Type().IsRegular() || (re != nil && !pathAllowed(re, storageRel(p))) {
+			return nil
+		}
+		if len(order) == limit {
+			next = order[len(order)-1]
+			return errSyncPageFull
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files[rel] = &syncEntry{Size: info.Size(), ModTime: info.ModTime(), target: p}
+		order = append(order, rel)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errSyncPageFull) {
+		httpError(w, r, "Failed to list: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%d\n", algo, after, limit)
+	for _, rel := range order {
+		e := files[rel]
+		fmt.Fprintf(h, "%s\n%d\n%d\n", rel, e.Size, e.ModTime.UnixNano())
+	}
+	etag := `W/"` + hex.EncodeToString(h.Sum(nil))[:32] + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if inm := r.Header.Get("If-None-Match"); inm != "" && ifMatch(inm, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	for _, rel := range order {
+		e := files[rel]
+		info, err := os.Stat(e.target)
+		if err != nil {
+			delete(files, rel) // removed since the walk
+			continue
+		}
+		e.Size, e.ModTime = info.Size(), info.ModTime()
+		if e.Checksum, err = objectChecksum(r.Context(), e.target, info, algo, nil); err != nil {
+			httpError(w, r, "Failed to checksum: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	resp := map[string]any{"path": relPath, "algorithm": algo, "files": files}
+	if next != "" {
+		resp["next"] = next
+	}
+	if truncated {
+		resp["truncated"] = true
+	}
+	writeListingJSON(w, r, resp)
+}
+
+// Whether a comes after b in WalkDir order, which compares path segments
+// rather than whole strings ("a/b" is walked before "a-c")
+func walksAfter(a, b string) bool {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] > bs[i]
+		}
+	}
+	return len(as) > len(bs)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestSyncHidesPathsOutsideToken(t *testing.T) {
+	srv := newTestServer(t)
+	admin := testToken(t, "^/data/.*")
+	for _, p := range []string{"data/a/one.txt", "data/a/deep/two.txt", "data/b/secret.txt", "data/top.txt"} {
+		if resp := doRequest(t, http.MethodPut, srv.URL+"/"+admin+"/"+p, p); resp.StatusCode >= 300 {
+			t.Fatalf("PUT %s: status %d", p, resp.StatusCode)
+		}
+	}
+
+	// Grants the data/ listing itself but only objects below data/a/
+	narrow := testToken(t, "^/data/(a/.*)?$")
+	resp := doRequest(t, http.MethodGet, srv.URL+"/"+narrow+"/data/?sync", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("sync: status %d", resp.StatusCode)
+	}
+	var body struct {
+		Files map[string]syncEntry `json:"files"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Files) != 2 {
+		t.Fatalf("sync listed %v, want only the two files below data/a/", body.Files)
+	}
+	for _, name := range []string{"a/one.txt", "a/deep/two.txt"} {
+		if _, ok := body.Files[name]; !ok {
+			t.Fatalf("sync is missing %s: %v", name, body.Files)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	maxTags        = 50
+	maxTagKeyLen   = 128
+	maxTagValueLen = 256
+)
+
+// PUT /{token}/path?tags with a JSON object body, e.g. {"project": "apollo"},
+// replaces the object's tags; {} removes them all. Tags are what
+// GET /{token}/dir/?tag=key:value searches, and ?stat reports them.
+func tagsHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) < 2 {
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	relPath := parts[1]
+	target, err := resolvePath(relPath)
+	if err != nil || target == filepath.Clean(StorageDir) {
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	var tags map[string]string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&tags); err != nil {
+		httpError(w, r, `Tags must be a JSON object like {"key": "value"}: `+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateTags(tags); err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	unlock, err := lockPathsFor(r, target)
+	if err != nil {
+		writeWriteInProgress(w, r)
+		return
+	}
+	defer unlock()
+	info, err := os.Stat(target)
+	if err != nil {
+		httpError(w, r, "Not found", http.StatusNotFound)
+		return
+	}
+	if info.IsDir() {
+		httpError(w, r, "Tags can only be set on files", http.StatusBadRequest)
+		return
+	}
+	if len(tags) == 0 {
+		tags = nil
+	}
+	err = updateMeta(target, func(m *objectMeta) {
+		m.Path = storageRel(target)
+		m.Tags = tags
+	})
+	if err != nil {
+		writeStorageError(w, r, "Failed to write metadata", err)
+		return
+	}
+
+	debugf("tagged %s with %d tags\n", relPath, len(tags))
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"success": true, "path": relPath, "tags": tags})
+}
+
+// Keys cannot hold ':', which separates key and value in ?tag= searches
+func validateTags(tags map[string]string) error {
+	if len(tags) > maxTags {
+		return fmt.Errorf("at most %d tags per object", maxTags)
+	}
+	for k, v := range tags {
+		if k == "" || strings.Contains(k, ":") || len(k) > maxTagKeyLen {
+			return fmt.Errorf("tag key %q must be 1-%d bytes without ':'", k, maxTagKeyLen)
+		}
+		if len(v) > maxTagValueLen {
+			return fmt.Errorf("tag %q value exceeds %d bytes", k, maxTagValueLen)
+		}
+	}
+	return nil
+}
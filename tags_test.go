@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestTagSearchFollowsTokenScope(t *testing.T) {
+	srv := newTestServer(t)
+	admin := testToken(t, "^/data/.*")
+	for _, p := range []string{"data/a/one.txt", "data/b/two.txt", "data/a/untagged.txt"} {
+		doRequest(t, http.MethodPut, srv.URL+"/"+admin+"/"+p, p)
+	}
+	for _, p := range []string{"data/a/one.txt", "data/b/two.txt"} {
+		resp := doRequest(t, http.MethodPut, srv.URL+"/"+admin+"/"+p+"?tags", `{"project": "apollo"}`)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("tag %s: status %d", p, resp.StatusCode)
+		}
+	}
+
+	list := func(tok string) []listEntry {
+		resp := doRequest(t, http.MethodGet, srv.URL+"/"+tok+"/data/?tag=project:apollo", "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("tag search: status %d", resp.StatusCode)
+		}
+		var body struct {
+			Entries []listEntry `json:"entries"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body.Entries
+	}
+	if got := list(admin); len(got) != 2 {
+		t.Fatalf("broad token found %v, want both tagged files", got)
+	}
+	got := list(testToken(t, "^/data/(a/.*)?$"))
+	if len(got) != 1 || got[0].Name != "a/one.txt" {
+		t.Fatalf("narrow token found %v, want only a/one.txt", got)
+	}
+}
+
+func TestTagsRejectsBadKeys(t *testing.T) {
+	srv := newTestServer(t)
+	base := srv.URL + "/" + testToken(t, "^/data/.*") + "/data/a.txt"
+	doRequest(t, http.MethodPut, base, "x")
+	for _, body := range []string{`{"a:b": "c"}`, `{"": "c"}`, `["not", "an", "object"]`} {
+		if resp := doRequest(t, http.MethodPut, base+"?tags", body); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("tags %s: status %d", body, resp.StatusCode)
+		}
+	}
+	if resp := doRequest(t, http.MethodPut, srv.URL+"/"+testToken(t, "^/data/.*")+"/data/missing.txt?tags", `{}`); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("tags on a missing file: status %d", resp.StatusCode)
+	}
+}
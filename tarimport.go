@@ -0,0 +1,143 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// POST /{token}/prefix/?import=tar unpacks a tar (or gzip-compressed tar)
+// body below prefix. Every entry goes through the same resolution, regex,
+// size, quota and directory checks as a single upload; entries with absolute
+// paths or ".." segments, and anything but regular files, are refused.
+func tarImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if f := r.URL.Query().Get("import"); f != "tar" && f != "tar.gz" {
+		httpError(w, r, "import must be tar or tar.gz", http.StatusBadRequest)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) < 2 {
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	prefix := parts[1]
+
+	// Accept gzip whether or not the client said so, by sniffing the magic
+	br := bufio.NewReader(r.Body)
+	body := io.Reader(br)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gunzip(br)
+		if err != nil {
+			httpError(w, r, "Invalid archive: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = zr
+	}
+	tr := tar.NewReader(body)
+	re := tokenRegex(r)
+
+	results := []batchResult{}
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if len(results) == 0 {
+				httpError(w, r, "Invalid archive: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			// Entries already stored stay stored; report where the archive broke
+			res := batchResult{}
+			res.fail("bad_request", "Invalid archive: "+err.Error())
+			results = append(results, res)
+			break
+		}
+		if hdr.Typeflag == tar.TypeDir || hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		res := importEntry(r, tr, hdr, prefix, re)
+		results = append(results, res)
+	}
+
+	if len(results) == 0 {
+		httpError(w, r, "No files in archive", http.StatusBadRequest)
+		return
+	}
+
+	writeBatchResults(w, results)
+}
+
+// Store one archive entry, reporting the outcome instead of failing the request
+func importEntry(r *http.Request, tr *tar.Reader, hdr *tar.Header, prefix string, re *regexp.Regexp) batchResult {
+	res := batchResult{Path: hdr.Name}
+	if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+		res.fail("unsupported_entry", "Only regular files can be imported")
+		return res
+	}
+	name := strings.TrimPrefix(hdr.Name, "./")
+	if strings.HasPrefix(name, "/") || checkCanonicalPath("/"+name) != nil {
+		res.fail("invalid_path", "Entry path escapes the prefix")
+		return res
+	}
+	relPath := strings.TrimPrefix(path.Join("/", prefix, name), "/")
+	res.Path = relPath
+
+	dest, err := resolvePath(relPath)
+	if err != nil {
+		res.fail("invalid_path", err.Error())
+		return res
+	}
+	if re != nil && !pathAllowed(re, relPath) {
+		res.failForbidden()
+		return res
+	}
+	if limit, byToken := fileLimitFor(tokenClaims(r), dest); limit > 0 && hdr.Size > limit {
+		res.failErr(fileLimitError(byToken))
+		return res
+	}
+
+	unlock, err := lockPathsFor(r, dest)
+	if err != nil {
+		res.failErr(err)
+		return res
+	}
+	defer unlock()
+	if checkDirCapacity(dest) != nil {
+		res.failErr(errDirFull)
+		return res
+	}
+	if err := checkKeyCase(dest, ""); err != nil {
+		res.failErr(err)
+		return res
+	}
+	if err := checkRetention(dest); err != nil {
+		res.failErr(err)
+		return res
+	}
+	if objectLimitErr(r, dest) != nil {
+		res.failErr(errObjectLimit)
+		return res
+	}
+	oldSize := fileSize(uploadTarget(dest))
+	n, err := writeObject(uploadTarget(dest), quotaLimit(tr, oldSize))
+	if err != nil {
+		noteCanceled(r, "upload")
+		res.failErr(err)
+		return res
+	}
+	addUsage(n - oldSize)
+	debugf("uploaded %s\n", relPath)
+	res.Success, res.Size = true, n
+	return res
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// REQUEST_TIMEOUT bounds how long a request may run, so a runaway handler
+// (a huge recursive listing, a sync manifest of millions of files) cannot
+// tie the server up. When the deadline passes the request context is
+// canceled, walks and hashing stop, and the client gets 503
+// request_timeout. Transfers are exempt: downloads, event streams and
+// uploads lift the deadline once they start streaming, and are bounded by
+// MAX_DOWNLOAD_DURATION and BODY_READ_TIMEOUT instead.
+var RequestTimeout = time.Duration(0) // override with REQUEST_TIMEOUT, 0 disables
+
+var errRequestTimeout = errors.New("request exceeded REQUEST_TIMEOUT")
+
+type requestDeadline struct {
+	timer *time.Timer
+	fired atomic.Bool
+}
+
+type requestDeadlineKey struct{}
+
+func boundRequests(next http.Handler) http.Handler {
+	if RequestTimeout <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancelCause(r.Context())
+		defer cancel(nil)
+		d := &requestDeadline{}
+		d.timer = time.AfterFunc(RequestTimeout, func() {
+			d.fired.Store(true)
+			cancel(errRequestTimeout)
+		})
+		defer d.timer.Stop()
+
+		tw := &deadlineWriter{ResponseWriter: w, d: d}
+		next.ServeHTTP(tw, r.WithContext(context.WithValue(ctx, requestDeadlineKey{}, d)))
+		if d.fired.Load() && !tw.wrote {
+			for _, h := range []string{"Content-Length", "Content-Encoding", "Content-Range", "ETag", "Last-Modified"} {
+				w.Header().Del(h)
+			}
+			debugf("request timed out after %s: %s %s\n", RequestTimeout, r.Method, logPath(r))
+			writeError(w, r, http.StatusServiceUnavailable, errorEnvelope{
+				Code:  "request_timeout",
+				Error: "Request took too long, narrow it down (e.g. a smaller prefix or page)",
+			})
+		}
+	})
+}
+
+// Exempt the rest of r from REQUEST_TIMEOUT, for transfers that
+// legitimately run long
+func liftRequestDeadline(r *http.Request) {
+	if d, ok := r.Context().Value(requestDeadlineKey{}).(*requestDeadline); ok {
+		d.timer.Stop()
+	}
+}
+
+// Drops whatever a handler writes after its deadline fired, an error for
+// the canceled work, so the 503 goes out instead. A response already under
+// way is left alone.
+type deadlineWriter struct {
+	http.ResponseWriter
+	d     *requestDeadline
+	wrote bool
+}
+
+func (tw *deadlineWriter) WriteHeader(status int) {
+	if status >= 200 {
+		if !tw.wrote && tw.d.fired.Load() {
+			return
+		}
+		tw.wrote = true
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *deadlineWriter) Write(p []byte) (int, error) {
+	if !tw.wrote {
+		if tw.d.fired.Load() {
+			return 0, errRequestTimeout
+		}
+		tw.wrote = true
+	}
+	return tw.ResponseWriter.Write(p)
+}
+
+func (tw *deadlineWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PATCH /{token}/path?truncate=<n> cuts a file down to its first n bytes in
+// place, for log-rotation style workflows that free space without deleting
+// and re-uploading. A length past the current size is refused unless
+// TRUNCATE_EXTEND is set, which pads the file with zeros instead.
+var TruncateExtend = false // override with TRUNCATE_EXTEND
+
+func truncateHandler(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.ParseInt(r.URL.Query().Get("truncate"), 10, 64)
+	if err != nil || n < 0 {
+		httpError(w, r, "truncate must be a length in bytes", http.StatusBadRequest)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) < 2 {
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	relPath := parts[1]
+	target, err := resolvePath(relPath)
+	if err != nil || target == filepath.Clean(StorageDir) {
+		httpError(w, r, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	unlock, err := lockPathsFor(r, target)
+	if err != nil {
+		writeWriteInProgress(w, r)
+		return
+	}
+	defer unlock()
+	info, err := os.Stat(target)
+	if err != nil {
+		httpError(w, r, "Not found", http.StatusNotFound)
+		return
+	}
+	if info.IsDir() {
+		httpError(w, r, "Only files can be truncated", http.StatusBadRequest)
+		return
+	}
+	if err := checkRetention(target); err != nil {
+		writeRetentionError(w, r, err)
+		return
+	}
+	oldSize := info.Size()
+	if n > oldSize {
+		if !TruncateExtend {
+			writeError(w, r, http.StatusBadRequest, errorEnvelope{
+				Code:  "beyond_size",
+				Error: "truncate length " + strconv.FormatInt(n, 10) + " exceeds the file size " + strconv.FormatInt(oldSize, 10),
+			})
+			return
+		}
+		if remaining := quotaRemaining(oldSize); remaining >= 0 && n > remaining {
+			writeQuotaError(w, r)
+			return
+		}
+	}
+
+	if err := os.Truncate(target, n); err != nil {
+		writeStorageError(w, r, "Failed to truncate", err)
+		return
+	}
+	addUsage(n - oldSize)
+	invalidateDirSizes(target)
+	// "updated" like any other rewrite, so watchers and directory indexes follow
+	publishEvent("updated", target, "", n)
+
+	debugf("truncated %s to %d bytes\n", relPath, n)
+	if info, err := os.Stat(target); err == nil {
+		setTimeHeaders(w, info.ModTime())
+		if etag, err := objectETag(target, info); err == nil {
+			w.Header().Set("ETag", etag)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"success": true, "path": storageRel(target), "size": n})
+}
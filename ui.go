@@ -0,0 +1,21 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+var UIEnabled = false // override with UI_ENABLED=true to serve the web UI at /ui
+
+//go:embed ui/index.html
+var uiPage []byte
+
+// Minimal browser UI for listing, uploading, downloading and deleting files
+func uiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(uiPage)
+}
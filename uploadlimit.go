@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Caps how many uploads one token may run at once, so a single credential
+// cannot monopolize disk I/O. A token's "max_uploads" claim overrides it.
+var MaxUploadsPerToken = 0 // override with MAX_UPLOADS_PER_TOKEN, 0 means unlimited
+
+var (
+	uploadsMu       sync.Mutex
+	uploadsInFlight = map[string]int{}
+)
+
+// Requests that stream a body into storage
+func isUploadRequest(r *http.Request) bool {
+	q := r.URL.Query()
+	switch r.Method {
+	case http.MethodPut:
+		return !q.Has("acl") && !q.Has("retention") && !isMkdirRequest(r)
+	case http.MethodPost:
+		return !q.Has("delete") && !q.Has("uploads") && !q.Has("share")
+	}
+	return false
+}
+
+// Tokens are counted by jti when present, so reissued copies of a token
+// share its slots, and by the raw token otherwise
+func uploadKey(token string, claims *Claims) string {
+	if claims != nil && claims.ID != "" {
+		return "jti:" + claims.ID
+	}
+	return "token:" + token
+}
+
+func uploadLimitFor(claims *Claims) int {
+	if claims != nil && claims.MaxUploads > 0 {
+		return claims.MaxUploads
+	}
+	return MaxUploadsPerToken
+}
+
+// Reserve an upload slot for key. The returned release must be called once
+// the upload finishes, however it ends; ok is false when key is at limit.
+func acquireUpload(key string, limit int) (release func(), ok bool) {
+	if limit <= 0 {
+		return func() {}, true
+	}
+	uploadsMu.Lock()
+	defer uploadsMu.Unlock()
+	if uploadsInFlight[key] >= limit {
+		return nil, false
+	}
+	uploadsInFlight[key]++
+	return func() {
+		uploadsMu.Lock()
+		defer uploadsMu.Unlock()
+		if uploadsInFlight[key]--; uploadsInFlight[key] <= 0 {
+			delete(uploadsInFlight, key)
+		}
+	}, true
+}
+
+func writeTooManyUploadsError(w http.ResponseWriter, r *http.Request, limit int) {
+	w.Header().Set("Retry-After", "1")
+	writeError(w, r, http.StatusTooManyRequests, errorEnvelope{
+		Code:       "too_many_uploads",
+		Error:      "Too many concurrent uploads for this token, retry later",
+		Limit:      int64(limit),
+		Usage:      int64(limit),
+		RetryAfter: 1,
+	})
+}
+
+// Largest file a token may store at dest: the prefix policy's (or global)
+// MAX_UPLOAD_BYTES or the token's max_file_bytes claim, whichever is
+// stricter, 0 meaning unlimited. byToken reports that the claim decided it.
+func fileLimitFor(claims *Claims, dest string) (limit int64, byToken bool) {
+	limit = policyFor(storageRel(dest)).uploadLimit()
+	if claims != nil && claims.MaxFileBytes > 0 && (limit <= 0 || claims.MaxFileBytes < limit) {
+		return claims.MaxFileBytes, true
+	}
+	return limit, false
+}
+
+// The upload error naming which limit a file exceeded
+func fileLimitError(byToken bool) error {
+	if byToken {
+		return errTokenFileLimit
+	}
+	return errTooLarge
+}
+
+var errTokenFileLimit = fmt.Errorf("%w for this token (max_file_bytes)", errTooLarge)
+
+func writeFileTooLarge(w http.ResponseWriter, r *http.Request, prefix string, limit int64, byToken bool) {
+	writeError(w, r, http.StatusRequestEntityTooLarge, errorEnvelope{Code: "too_large", Error: prefix + ": " + fileLimitError(byToken).Error(), Limit: limit})
+}
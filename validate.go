@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// An UploadValidator vets every finished upload (PUT, form, tar and
+// multipart) after its bytes are written and before it replaces the
+// object, so builds of this server can enforce their own rules (file
+// formats, business checks) without patching the handlers. Register one
+// from an init function in a file added to the build:
+//
+//	func init() { RegisterUploadValidator(pdfOnly{}) }
+//
+// Returning an error rejects the upload with 422 upload_rejected and the
+// staged file is removed; what was stored at the path before is untouched.
+// A direct write (X-Write-Mode: direct) has no staged copy, so TempPath is
+// the destination itself and a rejected upload leaves nothing there.
+type UploadValidator interface {
+	ValidateUpload(u UploadInfo) error
+}
+
+type UploadInfo struct {
+	Path     string // storage-relative destination the object will have
+	TempPath string // the complete bytes, safe to open and read
+	Size     int64
+}
+
+var (
+	uploadValidators  []UploadValidator
+	errUploadRejected = errors.New("upload rejected")
+)
+
+func RegisterUploadValidator(v UploadValidator) {
+	uploadValidators = append(uploadValidators, v)
+}
+
+// Run the validators over the bytes for dest held at tmp. Staged multipart
+// parts are not objects yet; the assembled upload is checked instead.
+func validateUpload(dest, tmp string, size int64) error {
+	if len(uploadValidators) == 0 || strings.HasPrefix(dest, partsRoot()+string(filepath.Separator)) {
+		return nil
+	}
+	rel := storageRel(dest)
+	if q := quarantineRoot(); strings.HasPrefix(dest, q+string(filepath.Separator)) {
+		rel, _ = filepath.Rel(q, dest)
+		rel = filepath.ToSlash(rel)
+	}
+	u := UploadInfo{Path: rel, TempPath: tmp, Size: size}
+	for _, v := range uploadValidators {
+		if err := v.ValidateUpload(u); err != nil {
+			return fmt.Errorf("%w: %v", errUploadRejected, err)
+		}
+	}
+	return nil
+}
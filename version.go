@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+)
+
+// Build info, injected at build time:
+// go build -ldflags "-X main.Version=1.2.0 -X main.Commit=$(git rev-parse --short HEAD)"
+var (
+	Version = "dev"
+	Commit  = "unknown"
+)
+
+var versionBody []byte
+
+// Precompute the /version response once config is loaded so serving it is free
+func initVersionInfo() {
+	versionBody, _ = json.Marshal(map[string]any{
+		"version":   Version,
+		"commit":    Commit,
+		"goVersion": runtime.Version(),
+		"features": map[string]bool{
+			"normalizeUnicode": NormalizeUnicode,
+			"uploadSizeLimit":  MaxUploadBytes > 0,
+			"storageQuota":     StorageQuotaBytes > 0,
+			"ui":               UIEnabled,
+			"readOnly":         ReadOnly,
+		},
+	})
+}
+
+// Unauthenticated build/version info
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(versionBody)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// With STORAGE_VOLUMES, objects are spread over several directories (one
+// per disk or mount) instead of all living under StorageDir. Each object
+// goes to the volume picked by a hash of its top-level path segment, so a
+// directory tree stays on one volume: listings below the top level,
+// renames within a tree and versions sidecars never span volumes. The root
+// listing merges the volumes. StorageDir stays the canonical root and keeps
+// the internal areas (staged parts, quarantine).
+//
+// The mapping depends on the list and its order, so changing them strands
+// existing objects on the wrong volume.
+var StorageVolumes []string // override with STORAGE_VOLUMES (comma separated)
+
+// Volume a top-level path segment lives on
+func volumeFor(top string) string {
+	h := fnv.New32a()
+	h.Write([]byte(top))
+	return StorageVolumes[h.Sum32()%uint32(len(StorageVolumes))]
+}
+
+func isVolumeRoot(dir string) bool {
+	for _, v := range StorageVolumes {
+		if dir == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Absolute location of a clean slash-separated storage path, "" for the root
+func storagePath(rel string) string {
+	if rel == "" || rel == "." {
+		return filepath.Clean(StorageDir)
+	}
+	if len(StorageVolumes) == 0 {
+		return filepath.Join(StorageDir, filepath.FromSlash(rel))
+	}
+	top, _, _ := strings.Cut(rel, "/")
+	if isReservedName(top) {
+		return filepath.Join(StorageDir, filepath.FromSlash(rel))
+	}
+	return filepath.Join(volumeFor(top), filepath.FromSlash(rel))
+}
+
+// Entry name below dir, resolving top-level names to their volume
+func storageChild(dir, name string) string {
+	if len(StorageVolumes) > 0 && dir == filepath.Clean(StorageDir) {
+		return storagePath(name)
+	}
+	return filepath.Join(dir, name)
+}
+
+// The directory containing p in the storage tree; top-level entries on a
+// volume belong to the root
+func storageParent(p string) string {
+	dir := filepath.Dir(p)
+	if isVolumeRoot(dir) {
+		return filepath.Clean(StorageDir)
+	}
+	return dir
+}
+
+// Whether dir lies strictly below the storage root or one of the volumes
+func insideStorage(dir string) bool {
+	for _, root := range append([]string{filepath.Clean(StorageDir)}, StorageVolumes...) {
+		if strings.HasPrefix(dir, root+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// os.ReadDir that merges the volumes for the root. Volumes that do not
+// exist yet hold nothing.
+func readStorageDir(dir string) ([]os.DirEntry, error) {
+	entries, err := os.ReadDir(dir)
+	if len(StorageVolumes) == 0 || dir != filepath.Clean(StorageDir) {
+		return entries, err
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, v := range StorageVolumes {
+		more, err := os.ReadDir(v)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		entries = append(entries, more...)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// Slash-separated path of p relative to the storage directory dir
+func storageRelTo(dir, p string) string {
+	rel, base := storageRel(p), storageRel(dir)
+	if base == "." {
+		return rel
+	}
+	return strings.TrimPrefix(rel, base+"/")
+}
+
+// os.Rename that falls back to copying when from and to are on different
+// volumes. The copy keeps mode and modification time, so ETags stay the same.
+func renamePath(from, to string) error {
+	err := os.Rename(from, to)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyTree(from, to); err != nil {
+		os.RemoveAll(to)
+		return err
+	}
+	return os.RemoveAll(from)
+}
+
+func copyTree(from, to string) error {
+	info, err := os.Stat(from)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return copyFile(from, to, info)
+	}
+	if err := os.MkdirAll(to, DirMode); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(from)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := copyTree(filepath.Join(from, e.Name()), filepath.Join(to, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy through a temp file next to to, so the file appears complete or not at all
+func copyFile(from, to string, info fs.FileInfo) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp, err := createTemp(filepath.Dir(to))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, src)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	os.Chmod(tmp.Name(), info.Mode().Perm())
+	os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime())
+	return os.Rename(tmp.Name(), to)
+}
+
+// Create the canonical root and the volumes, so the root can be listed
+// before anything is stored
+func initVolumes() error {
+	if len(StorageVolumes) == 0 {
+		return nil
+	}
+	for _, dir := range append([]string{StorageDir}, StorageVolumes...) {
+		if err := os.MkdirAll(dir, DirMode); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Sharding objects over %d storage volumes\n", len(StorageVolumes))
+	return nil
+}
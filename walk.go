@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Every recursive walk of the storage tree (sync manifests, tag searches,
+// directory sizes and object counts, compaction, watching) stops descending
+// MaxWalkDepth levels below where it started, so a pathological tree made
+// outside the API cannot make one request recurse without bound. Walks that
+// answer a request report when they were cut short.
+var MaxWalkDepth = 64 // override with MAX_WALK_DEPTH, 0 for unlimited
+
+// filepath.WalkDir over the storage tree at dir, bounded by MaxWalkDepth.
+// For the root, the merged top-level entries of the volumes are visited in
+// name order, the order a single tree would be walked in. truncated reports
+// that a non-empty directory at the depth limit was not entered.
+func walkStorage(dir string, fn fs.WalkDirFunc) (truncated bool, err error) {
+	stopped := false
+	bounded := func(base int) fs.WalkDirFunc {
+		return func(p string, d fs.DirEntry, err error) error {
+			res := fn(p, d, err)
+			if res == filepath.SkipAll {
+				stopped = true
+			}
+			if res != nil || d == nil || !d.IsDir() || p == dir || MaxWalkDepth <= 0 {
+				return res
+			}
+			if strings.Count(p, string(filepath.Separator))-base >= MaxWalkDepth {
+				if !truncated && !isEmptyDir(p) {
+					truncated = true
+				}
+				return filepath.SkipDir
+			}
+			return nil
+		}
+	}
+
+	if len(StorageVolumes) == 0 || dir != filepath.Clean(StorageDir) {
+		return truncated, filepath.WalkDir(dir, bounded(strings.Count(dir, string(filepath.Separator))))
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		err = fn(dir, nil, err)
+	} else {
+		err = fn(dir, fs.FileInfoToDirEntry(info), nil)
+	}
+	if err != nil {
+		if err == filepath.SkipDir || err == filepath.SkipAll {
+			return false, nil
+		}
+		return false, err
+	}
+	entries, err := readStorageDir(dir)
+	if err != nil {
+		return false, fn(dir, fs.FileInfoToDirEntry(info), err)
+	}
+	for _, e := range entries {
+		p := storageChild(dir, e.Name())
+		// Depth counts from the volume (or root) the entry sits in
+		base := strings.Count(filepath.Dir(p), string(filepath.Separator))
+		if !e.IsDir() {
+			if err := fn(p, e, nil); err != nil {
+				if err == filepath.SkipDir || err == filepath.SkipAll {
+					return truncated, nil
+				}
+				return truncated, err
+			}
+			continue
+		}
+		if err := filepath.WalkDir(p, bounded(base)); err != nil || stopped {
+			return truncated, err
+		}
+	}
+	return truncated, nil
+}
+
+func isEmptyDir(dir string) bool {
+	f, err := os.Open(dir)
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+	names, _ := f.Readdirnames(1)
+	return len(names) == 0
+}
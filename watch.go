@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Optional watching of StorageDir for changes made by other processes.
+// They are published as change events like the server's own writes, and
+// the size, count and checksum caches for them are dropped. Off by default:
+// every directory in the tree needs its own inotify watch.
+var (
+	WatchStorage  = false                  // override with WATCH_STORAGE
+	WatchDebounce = 500 * time.Millisecond // override with WATCH_DEBOUNCE, quiet period before changes are processed
+)
+
+// Writes the server itself made recently, so their notifications are not
+// reported a second time as external changes
+var (
+	ownWritesMu sync.Mutex
+	ownWrites   = map[string]time.Time{}
+)
+
+func noteOwnWrite(p string) {
+	if !WatchStorage {
+		return
+	}
+	ownWritesMu.Lock()
+	ownWrites[p] = now()
+	ownWritesMu.Unlock()
+}
+
+// Whether p was written by the server within the last window, pruning older entries
+func recentOwnWrite(p string, window time.Duration) bool {
+	ownWritesMu.Lock()
+	defer ownWritesMu.Unlock()
+	cutoff := now().Add(-window)
+	for k, t := range ownWrites {
+		if t.Before(cutoff) {
+			delete(ownWrites, k)
+		}
+	}
+	_, ok := ownWrites[p]
+	return ok
+}
+
+type storageWatcher struct {
+	w       *fsnotify.Watcher
+	dirs    map[string]bool
+	pending map[string]fsnotify.Op
+}
+
+// Start watching StorageDir and every directory below it
+func startWatcher() error {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	sw := &storageWatcher{w: fw, dirs: map[string]bool{}, pending: map[string]fsnotify.Op{}}
+	if err := os.MkdirAll(StorageDir, DirMode); err != nil {
+		fw.Close()
+		return err
+	}
+	// New top-level entries appear directly in the volumes
+	for _, v := range StorageVolumes {
+		if err := os.MkdirAll(v, DirMode); err != nil {
+			fw.Close()
+			return err
+		}
+		if err := fw.Add(v); err != nil {
+			fw.Close()
+			return err
+		}
+		sw.dirs[v] = true
+	}
+	if err := sw.addTree(filepath.Clean(StorageDir), false); err != nil {
+		fw.Close()
+		return err
+	}
+	fmt.Printf("Watching %d directories under %s for external changes\n", len(sw.dirs), StorageDir)
+	go sw.loop()
+	return nil
+}
+
+// Watch dir and its subdirectories. With announce, files already inside
+// (a directory moved or copied in from outside) are reported as created.
+func (sw *storageWatcher) addTree(dir string, announce bool) error {
+	_, err := walkStorage(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if p != dir && isReservedName(d.Name()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if err := sw.w.Add(p); err != nil {
+				return err
+			}
+			sw.dirs[p] = true
+			return nil
+		}
+		if announce && d.Type().IsRegular() && !recentOwnWrite(p, 2*WatchDebounce+time.Second) {
+			if info, err := d.Info(); err == nil {
+				externalChange(p, "created", info.Size())
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+func (sw *storageWatcher) loop() {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	for {
+		select {
+		case ev, ok := <-sw.w.Events:
+			if !ok {
+				return
+			}
+			if ev.Op == fsnotify.Chmod || isInternalPath(ev.Name) {
+				continue
+			}
+			sw.pending[ev.Name] |= ev.Op
+			timer.Reset(WatchDebounce)
+		case err, ok := <-sw.w.Errors:
+			if !ok {
+				return
+			}
+			fmt.Printf("warning: storage watcher: %v\n", err)
+		case <-timer.C:
+			sw.flush()
+		}
+	}
+}
+
+// Settle the paths that changed during the quiet period by what is on disk now
+func (sw *storageWatcher) flush() {
+	for p, op := range sw.pending {
+		delete(sw.pending, p)
+		info, err := os.Stat(p)
+		switch {
+		case err != nil:
+			if sw.dirs[p] {
+				delete(sw.dirs, p)
+				invalidateStorageCaches(p)
+				continue
+			}
+			if !recentOwnWrite(p, 2*WatchDebounce+time.Second) {
+				externalChange(p, "deleted", 0)
+			}
+		case info.IsDir():
+			if !sw.dirs[p] {
+				sw.addTree(p, true)
+			}
+			invalidateStorageCaches(p)
+		case info.Mode().IsRegular():
+			if recentOwnWrite(p, 2*WatchDebounce+time.Second) {
+				continue
+			}
+			typ := "updated"
+			if op.Has(fsnotify.Create) {
+				typ = "created"
+			}
+			externalChange(p, typ, info.Size())
+		}
+	}
+}
+
+// Drop cached state for a path changed behind the server's back
+func invalidateStorageCaches(p string) {
+	invalidateDirSizes(p)
+	invalidateDirCounts(storageParent(p))
+	invalidateObjectCounts(p)
+}
+
+func externalChange(p, typ string, size int64) {
+	if isDirIndex(filepath.Base(p)) {
+		return
+	}
+	invalidateStorageCaches(p)
+	refreshDirIndexes(storageParent(p))
+	if typ != "deleted" && hasMeta(p) {
+		// Cached digests are keyed by size and modtime, which an external
+		// writer may have preserved
+		updateMeta(p, func(m *objectMeta) { m.Checksums = nil })
+	}
+	debugf("external change: %s %s\n", typ, storageRel(p))
+	broadcastEvent(storageEvent{Type: typ, Path: storageRel(p), Size: size, Time: now().UTC()})
+}